@@ -0,0 +1,293 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Package api serves the visor registry over HTTP as JSON.
+//
+// Reads accept a rev query parameter to read the registry as it was
+// at a past coordinator revision. Responses to reads carry the revision
+// they were read at in the ETag header. Writes to existing objects accept
+// an If-Match header with such a revision, and are refused with 412
+// Precondition Failed if the object has changed since then. Objects
+// below the one written, such as the instances of a proctype, don't
+// count as changes.
+//
+// Registry events are streamed from /events as server-sent events.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/soundcloud/visor"
+)
+
+// A Server is an http.Handler serving the registry.
+type Server struct {
+	snapshot visor.Snapshot
+	routes   []*route
+}
+
+// request holds an incoming request along with the
+// path parameters and the snapshot it is served at.
+type request struct {
+	*http.Request
+	params   map[string]string
+	snapshot visor.Snapshot
+}
+
+// A handler returns the status and the value to be encoded as the
+// response body. Errors are mapped to statuses by errorStatus.
+type handler func(r *request) (status int, body interface{}, err error)
+
+// A streamer writes the response itself, for responses which
+// are written over time rather than encoded at once.
+type streamer func(w http.ResponseWriter, r *request)
+
+type route struct {
+	method  string
+	pattern []string
+	handler handler
+	stream  streamer
+}
+
+// httpError is an error carrying its own status.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// NewServer returns a Server for the registry of the given snapshot.
+// Requests are served at the latest coordinator revision.
+func NewServer(s visor.Snapshot) *Server {
+	srv := &Server{snapshot: s}
+	srv.register()
+	return srv
+}
+
+// handle adds a route for the method and pattern, in which
+// path components starting with ':' name path parameters.
+func (srv *Server) handle(method, pattern string, h handler) {
+	srv.routes = append(srv.routes, &route{method, splitPath(pattern), h, nil})
+}
+
+// handleStream is like handle, for routes served by a streamer.
+func (srv *Server) handleStream(method, pattern string, st streamer) {
+	srv.routes = append(srv.routes, &route{method, splitPath(pattern), nil, st})
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	components := splitPath(r.URL.Path)
+	pathFound := false
+
+	for _, rt := range srv.routes {
+		params, ok := rt.match(components)
+		if !ok {
+			continue
+		}
+		pathFound = true
+
+		if rt.method != r.Method {
+			continue
+		}
+		req := &request{Request: r, params: params}
+
+		if rt.stream != nil {
+			if err := srv.at(req); err != nil {
+				writeError(w, err)
+				return
+			}
+			rt.stream(w, req)
+			return
+		}
+
+		status, body, err := srv.serve(req, rt.handler)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if r.Method == "GET" {
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, req.snapshot.Rev))
+		}
+		writeJSON(w, status, body)
+		return
+	}
+
+	if pathFound {
+		writeError(w, &httpError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed on %s", r.Method, r.URL.Path)})
+	} else {
+		writeError(w, &httpError{http.StatusNotFound, fmt.Sprintf("%s not found", r.URL.Path)})
+	}
+}
+
+func (srv *Server) serve(r *request, h handler) (status int, body interface{}, err error) {
+	if err = srv.at(r); err != nil {
+		return
+	}
+	return h(r)
+}
+
+// at sets the snapshot the request is served at: the latest
+// revision, or the one given with the rev query parameter.
+func (srv *Server) at(r *request) error {
+	s := srv.snapshot.FastForward(-1)
+
+	if v := r.URL.Query().Get("rev"); v != "" {
+		if r.Method != "GET" {
+			return badRequest("rev can only be given for reads")
+		}
+		rev, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rev < 0 {
+			return badRequest("invalid rev '%s'", v)
+		}
+		if rev > s.Rev {
+			return badRequest("rev %d is ahead of the coordinator (%d)", rev, s.Rev)
+		}
+		s = s.Rewind(rev)
+	}
+	r.snapshot = s
+
+	return nil
+}
+
+func (rt *route) match(components []string) (params map[string]string, ok bool) {
+	if len(components) != len(rt.pattern) {
+		return nil, false
+	}
+	params = map[string]string{}
+
+	for i, p := range rt.pattern {
+		if strings.HasPrefix(p, ":") {
+			params[p[1:]] = components[i]
+		} else if p != components[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+// ifMatch returns the revision of the If-Match header of the
+// request, or -1 if it has none.
+func (r *request) ifMatch() (rev int64, err error) {
+	h := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if h == "" || h == "*" {
+		return -1, nil
+	}
+	rev, err = strconv.ParseInt(h, 10, 64)
+	if err != nil || rev < 0 {
+		return -1, badRequest("invalid If-Match revision '%s'", h)
+	}
+	return
+}
+
+// checkIfMatch refuses the request with ErrRevMismatch if it has an
+// If-Match header and one of the given files was changed or deleted
+// after that revision. Only the files describing the object written
+// are checked, so that changes to other objects below it, such as
+// instances of a proctype, don't fail the request.
+func (r *request) checkIfMatch(files ...string) error {
+	rev, err := r.ifMatch()
+	if err != nil || rev < 0 {
+		return err
+	}
+	for _, f := range files {
+		modrev, err := r.snapshot.LastModified(f)
+		if visor.IsErrNoEnt(err) {
+			if _, err = r.snapshot.Rewind(rev).LastModified(f); err == nil {
+				return visor.NewError(visor.ErrRevMismatch, fmt.Sprintf("%s was deleted after %d", f, rev))
+			} else if !visor.IsErrNoEnt(err) {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if modrev > rev {
+			return visor.NewError(visor.ErrRevMismatch, fmt.Sprintf("%s was modified at %d, after %d", f, modrev, rev))
+		}
+	}
+	return nil
+}
+
+// pinIfMatch is like checkIfMatch, but also rewinds the snapshot of the
+// request to the If-Match revision. Files written from it are then
+// checked by the coordinator, so that changes made after checkIfMatch
+// fail the write with ErrRevMismatch as well.
+func (r *request) pinIfMatch(files ...string) error {
+	if err := r.checkIfMatch(files...); err != nil {
+		return err
+	}
+	rev, err := r.ifMatch()
+	if err != nil || rev < 0 {
+		return err
+	}
+	r.snapshot = r.snapshot.Rewind(rev)
+
+	return nil
+}
+
+// decode decodes the JSON request body into v.
+func (r *request) decode(v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest("invalid request body: %s", err)
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status for an error returned by visor.
+func errorStatus(err error) int {
+	if e, ok := err.(*httpError); ok {
+		return e.status
+	}
+	if e, ok := err.(*visor.Error); ok {
+		err = e.Err
+	}
+	switch err {
+	case visor.ErrNoEnt:
+		return http.StatusNotFound
+	case visor.ErrKeyConflict, visor.ErrInsClaimed, visor.ErrInvalidState, visor.ErrRevInUse:
+		return http.StatusConflict
+	case visor.ErrRevMismatch:
+		return http.StatusPreconditionFailed
+	case visor.ErrUnauthorized:
+		return http.StatusForbidden
+	case visor.ErrRevTooOld:
+		return http.StatusGone
+	case visor.ErrBadPath, visor.ErrBadPtyName:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/visor"
+)
+
+func apiSetup(t *testing.T) (s visor.Snapshot, srv *httptest.Server) {
+	s, err := visor.DialUri("mem:", "/api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := visor.Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev)
+
+	srv = httptest.NewServer(NewServer(s))
+	t.Cleanup(srv.Close)
+
+	return
+}
+
+// call sends a request and decodes the JSON response into v, if not nil.
+func call(t *testing.T, srv *httptest.Server, method, path, body string, header map[string]string, v interface{}) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, val := range header {
+		req.Header.Set(k, val)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp
+}
+
+func expectStatus(t *testing.T, resp *http.Response, status int) {
+	if resp.StatusCode != status {
+		t.Errorf("%s %s: expected status %d, got %d", resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode)
+	}
+}
+
+func TestApiApps(t *testing.T) {
+	_, srv := apiSetup(t)
+
+	app := &visor.App{}
+	resp := call(t, srv, "POST", "/apps", `{"name": "apicat", "repo-url": "git://apicat", "stack": "s1", "env": {"MEOW": "loud"}}`, nil, app)
+	expectStatus(t, resp, http.StatusCreated)
+	if app.Name != "apicat" || app.Stack != "s1" {
+		t.Errorf("unexpected app %#v", app)
+	}
+
+	resp = call(t, srv, "POST", "/apps", `{"name": "apicat"}`, nil, nil)
+	expectStatus(t, resp, http.StatusConflict)
+
+	apps := []*visor.App{}
+	expectStatus(t, call(t, srv, "GET", "/apps", "", nil, &apps), http.StatusOK)
+	if len(apps) != 1 || apps[0].Name != "apicat" {
+		t.Errorf("unexpected apps %#v", apps)
+	}
+
+	app = &visor.App{}
+	expectStatus(t, call(t, srv, "GET", "/apps/apicat", "", nil, app), http.StatusOK)
+	if app.Env["MEOW"] != "loud" {
+		t.Errorf("expected env to be returned, got %#v", app.Env)
+	}
+
+	expectStatus(t, call(t, srv, "GET", "/apps/nocat", "", nil, nil), http.StatusNotFound)
+	expectStatus(t, call(t, srv, "PUT", "/apps", "", nil, nil), http.StatusMethodNotAllowed)
+	expectStatus(t, call(t, srv, "DELETE", "/apps/apicat", "", nil, nil), http.StatusNoContent)
+	expectStatus(t, call(t, srv, "GET", "/apps/apicat", "", nil, nil), http.StatusNotFound)
+}
+
+func TestApiEnvIfMatch(t *testing.T) {
+	_, srv := apiSetup(t)
+
+	expectStatus(t, call(t, srv, "POST", "/apps", `{"name": "envcat"}`, nil, nil), http.StatusCreated)
+
+	resp := call(t, srv, "GET", "/apps/envcat", "", nil, nil)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
+	}
+
+	resp = call(t, srv, "PUT", "/apps/envcat/env/PURR", `{"value": "soft"}`, map[string]string{"If-Match": etag}, nil)
+	expectStatus(t, resp, http.StatusOK)
+
+	// PURR has changed since etag
+	resp = call(t, srv, "PUT", "/apps/envcat/env/PURR", `{"value": "hard"}`, map[string]string{"If-Match": etag}, nil)
+	expectStatus(t, resp, http.StatusPreconditionFailed)
+
+	val := map[string]string{}
+	expectStatus(t, call(t, srv, "GET", "/apps/envcat/env/PURR", "", nil, &val), http.StatusOK)
+	if val["value"] != "soft" {
+		t.Errorf("expected 'soft', got %#v", val)
+	}
+
+	// Read at the revision before the variable was set
+	rev := strings.Trim(etag, `"`)
+	env := visor.Env{}
+	expectStatus(t, call(t, srv, "GET", "/apps/envcat/env?rev="+rev, "", nil, &env), http.StatusOK)
+	if _, ok := env["PURR"]; ok {
+		t.Errorf("expected PURR to be unset at %s, got %#v", rev, env)
+	}
+	expectStatus(t, call(t, srv, "PUT", "/apps/envcat/env/PURR?rev="+rev, `{"value": "x"}`, nil, nil), http.StatusBadRequest)
+
+	expectStatus(t, call(t, srv, "DELETE", "/apps/envcat/env/PURR", "", nil, nil), http.StatusNoContent)
+	expectStatus(t, call(t, srv, "DELETE", "/apps/envcat/env/PURR", "", nil, nil), http.StatusNotFound)
+}
+
+func TestApiIfMatchUnrelatedChange(t *testing.T) {
+	s, srv := apiSetup(t)
+
+	expectStatus(t, call(t, srv, "POST", "/apps", `{"name": "matchcat"}`, nil, nil), http.StatusCreated)
+	expectStatus(t, call(t, srv, "POST", "/apps/matchcat/revs", `{"ref": "f00", "archive-url": "http://f00"}`, nil, nil), http.StatusCreated)
+	expectStatus(t, call(t, srv, "POST", "/apps/matchcat/procs", `{"name": "web"}`, nil, nil), http.StatusCreated)
+
+	etag := call(t, srv, "GET", "/apps/matchcat", "", nil, nil).Header.Get("ETag")
+
+	// Other files of the app change after etag
+	if _, err := visor.RegisterInstance("matchcat", "f00", "web", s.FastForward(-1)); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, call(t, srv, "PUT", "/apps/matchcat/env/OTHER", `{"value": "1"}`, nil, nil), http.StatusOK)
+
+	header := map[string]string{"If-Match": etag}
+	expectStatus(t, call(t, srv, "PUT", "/apps/matchcat/env/PURR", `{"value": "soft"}`, header, nil), http.StatusOK)
+	expectStatus(t, call(t, srv, "PUT", "/apps/matchcat/procs/web/scale/f00", `{"scale": 1}`, header, nil), http.StatusOK)
+	expectStatus(t, call(t, srv, "PUT", "/apps/matchcat/procs/web/scale/f00", `{"scale": 2}`, header, nil), http.StatusPreconditionFailed)
+}
+
+func TestApiPinIfMatch(t *testing.T) {
+	s, _ := apiSetup(t)
+
+	app, err := visor.NewApp("pincat", "git://pincat", "s1", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(app.Dir.Snapshot.Rev)
+
+	req, err := http.NewRequest("PUT", "/apps/pincat/env/PURR", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", strconv.FormatInt(s.Rev, 10))
+	r := &request{Request: req, params: map[string]string{"app": "pincat", "key": "PURR"}, snapshot: s}
+
+	if err = r.pinIfMatch(r.envFile()); err != nil {
+		t.Fatal(err)
+	}
+	// PURR is set between the check and the write
+	if _, err = app.FastForward(-1).SetEnvironmentVar("PURR", "hard"); err != nil {
+		t.Fatal(err)
+	}
+	app, err = r.app()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.SetEnvironmentVar("PURR", "soft"); !visor.IsErrRevMismatch(err) {
+		t.Errorf("expected ErrRevMismatch, got %v", err)
+	}
+}
+
+func TestApiScale(t *testing.T) {
+	_, srv := apiSetup(t)
+
+	expectStatus(t, call(t, srv, "POST", "/apps", `{"name": "scalecat"}`, nil, nil), http.StatusCreated)
+	expectStatus(t, call(t, srv, "POST", "/apps/scalecat/revs", `{"ref": "f00", "archive-url": "http://f00"}`, nil, nil), http.StatusCreated)
+
+	pty := &visor.ProcType{}
+	expectStatus(t, call(t, srv, "POST", "/apps/scalecat/procs", `{"name": "web"}`, nil, pty), http.StatusCreated)
+	if pty.Port == 0 {
+		t.Errorf("expected port to be assigned, got %#v", pty)
+	}
+	expectStatus(t, call(t, srv, "POST", "/apps/scalecat/procs", `{"name": "we-b"}`, nil, nil), http.StatusBadRequest)
+
+	sc := &scale{}
+	expectStatus(t, call(t, srv, "PUT", "/apps/scalecat/procs/web/scale/f00", `{"scale": 2}`, nil, sc), http.StatusOK)
+	expectStatus(t, call(t, srv, "GET", "/apps/scalecat/procs/web/scale/f00", "", nil, sc), http.StatusOK)
+	if sc.Scale != 2 || sc.Desired == nil || *sc.Desired != 2 {
+		t.Errorf("expected scale 2, got %#v", sc)
+	}
+
+	ins := []*visor.Instance{}
+	expectStatus(t, call(t, srv, "GET", "/apps/scalecat/procs/web/instances", "", nil, &ins), http.StatusOK)
+	if len(ins) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(ins))
+	}
+
+	i := &visor.Instance{}
+	expectStatus(t, call(t, srv, "GET", "/instances/"+strconv.FormatInt(ins[0].Id, 10), "", nil, i), http.StatusOK)
+	if i.AppName != "scalecat" || i.RevisionName != "f00" {
+		t.Errorf("unexpected instance %#v", i)
+	}
+	expectStatus(t, call(t, srv, "PUT", "/apps/scalecat/procs/web/scale/b4r", `{"scale": 1}`, nil, nil), http.StatusNotFound)
+}
+
+func TestApiServices(t *testing.T) {
+	_, srv := apiSetup(t)
+
+	expectStatus(t, call(t, srv, "POST", "/services", `{"name": "apisrv"}`, nil, nil), http.StatusCreated)
+	expectStatus(t, call(t, srv, "GET", "/services/nosrv", "", nil, nil), http.StatusNotFound)
+
+	ep := &visor.Endpoint{}
+	resp := call(t, srv, "POST", "/services/apisrv/endpoints", `{"addr": "10.0.0.1", "port": 8000, "weight": 3}`, nil, ep)
+	expectStatus(t, resp, http.StatusCreated)
+	if ep.Weight != 3 || ep.Service.Name != "apisrv" {
+		t.Errorf("unexpected endpoint %#v", ep)
+	}
+
+	dflt := &visor.Endpoint{}
+	resp = call(t, srv, "POST", "/services/apisrv/endpoints", `{"addr": "10.0.0.2", "port": 8000}`, nil, dflt)
+	expectStatus(t, resp, http.StatusCreated)
+	if dflt.Weight != visor.DefaultEndpointWeight {
+		t.Errorf("expected endpoint to have the default weight, got %d", dflt.Weight)
+	}
+	expectStatus(t, call(t, srv, "DELETE", "/services/apisrv/endpoints/"+dflt.Id(), "", nil, nil), http.StatusNoContent)
+
+	eps := []*visor.Endpoint{}
+	expectStatus(t, call(t, srv, "GET", "/services/apisrv/endpoints", "", nil, &eps), http.StatusOK)
+	if len(eps) != 1 || eps[0].Id() != ep.Id() {
+		t.Errorf("unexpected endpoints %#v", eps)
+	}
+	expectStatus(t, call(t, srv, "DELETE", "/services/apisrv/endpoints/"+ep.Id(), "", nil, nil), http.StatusNoContent)
+}
+
+func TestErrorStatus(t *testing.T) {
+	statuses := map[error]int{
+		visor.NewError(visor.ErrNoEnt, "not found"):          http.StatusNotFound,
+		visor.ErrKeyConflict:                                 http.StatusConflict,
+		visor.NewError(visor.ErrRevInUse, "in use"):          http.StatusConflict,
+		visor.NewError(visor.ErrRevMismatch, "rev mismatch"): http.StatusPreconditionFailed,
+		visor.ErrUnauthorized:                                http.StatusForbidden,
+		errors.New("boom"):                                   http.StatusInternalServerError,
+	}
+	for err, status := range statuses {
+		if s := errorStatus(err); s != status {
+			t.Errorf("expected status %d for %s, got %d", status, err, s)
+		}
+	}
+}
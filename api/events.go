@@ -0,0 +1,138 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// keepAlive is the interval at which comments are sent on idle
+// event streams, to keep proxies from closing the connection.
+var keepAlive = 15 * time.Second
+
+// streamEvents streams registry events as server-sent events. The
+// id of each event is its coordinator revision; clients resume a
+// stream by passing the id of the last event they received in the
+// Last-Event-ID header, or in the rev query parameter. As events are
+// sent in revision order, no event of the stream is older than the
+// id of the last one received. Events can
+// be filtered with the app, proc, service and type query parameters,
+// where type is a comma-separated list of event types.
+//
+// If the coordinator no longer holds the history needed to resume
+// the stream, the request fails with 410 Gone. Errors after the
+// stream was started are sent as an error event, after which the
+// stream is closed.
+func streamEvents(w http.ResponseWriter, r *request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, fmt.Errorf("streaming is not supported by the connection"))
+		return
+	}
+
+	s := r.snapshot
+
+	if h := r.Header.Get("Last-Event-ID"); h != "" {
+		rev, err := strconv.ParseInt(h, 10, 64)
+		if err != nil || rev < 0 {
+			writeError(w, badRequest("invalid Last-Event-ID '%s'", h))
+			return
+		}
+		if rev > s.Rev {
+			writeError(w, badRequest("Last-Event-ID %d is ahead of the coordinator (%d)", rev, s.Rev))
+			return
+		}
+		s = s.Rewind(rev)
+	}
+
+	if err := s.CheckHistory(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	f := r.filter()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	listener := make(chan *visor.Event)
+	errch := make(chan error, 1)
+
+	go func() {
+		errch <- visor.SubscribeContext(ctx, s, f, listener)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-listener:
+			if !ok {
+				if err := <-errch; ctx.Err() == nil {
+					writeEvent(w, "error", "", map[string]string{"error": err.Error()})
+					flusher.Flush()
+				}
+				return
+			}
+			if err := writeEvent(w, string(e.Type), strconv.FormatInt(e.Rev, 10), e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// filter returns the event filter given with the query parameters.
+func (r *request) filter() (f visor.Filter) {
+	q := r.URL.Query()
+
+	f.App = q.Get("app")
+	f.Proctype = q.Get("proc")
+	f.Service = q.Get("service")
+
+	for _, v := range q["type"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				f.Types = append(f.Types, visor.EventType(t))
+			}
+		}
+	}
+	return
+}
+
+// writeEvent writes a server-sent event with the JSON encoding of v
+// as its data. The id field is left out if id is empty.
+func writeEvent(w http.ResponseWriter, event, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err = fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
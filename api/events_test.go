@@ -0,0 +1,162 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/visor"
+)
+
+// readEvent reads the next server-sent event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	fields := map[string]string{}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		fields[parts[0]] = parts[1]
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	s, srv := apiSetup(t)
+
+	start := s.Rev
+
+	for _, name := range []string{"dogapp", "catapp"} {
+		app := visor.NewApp(name, "git://"+name, "s1", s)
+		if _, err := app.Register(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/events?app=catapp&type=app-register,app-unregister", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(start, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	expectStatus(t, resp, http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected event stream, got %s", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	ev := readEvent(t, r)
+	if ev["event"] != string(visor.EvAppReg) || !strings.Contains(ev["data"], `"catapp"`) {
+		t.Fatalf("expected catapp registration, got %#v", ev)
+	}
+	id, err := strconv.ParseInt(ev["id"], 10, 64)
+	if err != nil || id <= start {
+		t.Errorf("expected id after %d, got '%s'", start, ev["id"])
+	}
+
+	app, err := visor.GetApp(s.FastForward(-1), "catapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = app.Unregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	ev = readEvent(t, r)
+	if ev["event"] != string(visor.EvAppUnreg) {
+		t.Errorf("expected catapp unregistration, got %#v", ev)
+	}
+}
+
+func TestStreamEventsErrors(t *testing.T) {
+	s, err := visor.DialUri("mem:?history=1", "/api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := visor.Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev)
+
+	for i := 0; i < 3; i++ {
+		if s, err = s.RegisterPm("pm"+strconv.Itoa(i), "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(NewServer(s))
+	defer srv.Close()
+
+	ids := map[string]int{
+		"1":                            http.StatusGone,
+		"cat":                          http.StatusBadRequest,
+		strconv.FormatInt(s.Rev+1, 10): http.StatusBadRequest,
+	}
+	for id, status := range ids {
+		resp := call(t, srv, "GET", "/events", "", map[string]string{"Last-Event-ID": id}, nil)
+		expectStatus(t, resp, status)
+	}
+	expectStatus(t, call(t, srv, "POST", "/events", "", nil, nil), http.StatusMethodNotAllowed)
+}
+
+func TestStreamEventsAppInOrder(t *testing.T) {
+	s, srv := apiSetup(t)
+
+	start := s.Rev
+
+	app, err := visor.NewApp("catapp", "git://catapp", "s1", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := visor.RegisterInstance("catapp", "f00", "web", app.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.FastForward(ins.Dir.Snapshot.Rev).SetEnvironmentVar("PURR", "soft"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/events?app=catapp&type=instance-register,app-env-set", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(start, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	// Instance and app events are sent in revision order
+	last := start
+	for _, etype := range []visor.EventType{visor.EvInsReg, visor.EvAppEnvSet} {
+		ev := readEvent(t, r)
+		id, err := strconv.ParseInt(ev["id"], 10, 64)
+		if ev["event"] != string(etype) || err != nil || id <= last {
+			t.Fatalf("expected %s after id %d, got %#v", etype, last, ev)
+		}
+		last = id
+	}
+}
@@ -0,0 +1,557 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/soundcloud/visor"
+)
+
+func (srv *Server) register() {
+	srv.handle("GET", "/apps", listApps)
+	srv.handle("POST", "/apps", createApp)
+	srv.handle("GET", "/apps/:app", getApp)
+	srv.handle("DELETE", "/apps/:app", deleteApp)
+
+	srv.handle("GET", "/apps/:app/env", listEnv)
+	srv.handle("GET", "/apps/:app/env/:key", getEnv)
+	srv.handle("PUT", "/apps/:app/env/:key", setEnv)
+	srv.handle("DELETE", "/apps/:app/env/:key", deleteEnv)
+
+	srv.handle("GET", "/apps/:app/revs", listRevs)
+	srv.handle("POST", "/apps/:app/revs", createRev)
+	srv.handle("GET", "/apps/:app/revs/:rev", getRev)
+	srv.handle("DELETE", "/apps/:app/revs/:rev", deleteRev)
+
+	srv.handle("GET", "/apps/:app/procs", listProcs)
+	srv.handle("POST", "/apps/:app/procs", createProc)
+	srv.handle("GET", "/apps/:app/procs/:proc", getProc)
+	srv.handle("DELETE", "/apps/:app/procs/:proc", deleteProc)
+	srv.handle("GET", "/apps/:app/procs/:proc/instances", listInstances)
+	srv.handle("GET", "/apps/:app/procs/:proc/scale/:rev", getScale)
+	srv.handle("PUT", "/apps/:app/procs/:proc/scale/:rev", setScale)
+
+	srv.handle("GET", "/instances/:id", getInstance)
+
+	srv.handle("GET", "/services", listServices)
+	srv.handle("POST", "/services", createService)
+	srv.handle("GET", "/services/:service", getService)
+	srv.handle("DELETE", "/services/:service", deleteService)
+	srv.handle("GET", "/services/:service/endpoints", listEndpoints)
+	srv.handle("POST", "/services/:service/endpoints", createEndpoint)
+	srv.handle("GET", "/services/:service/endpoints/:endpoint", getEndpoint)
+	srv.handle("DELETE", "/services/:service/endpoints/:endpoint", deleteEndpoint)
+
+	srv.handleStream("GET", "/events", streamEvents)
+}
+
+// scale is the representation of the scale of a proctype at a revision.
+// Desired is omitted if no desired scale was set.
+type scale struct {
+	App      string `json:"app"`
+	Proctype string `json:"proctype"`
+	Revision string `json:"revision"`
+	Scale    int    `json:"scale"`
+	Desired  *int   `json:"desired,omitempty"`
+}
+
+func listApps(r *request) (int, interface{}, error) {
+	apps, err := visor.Apps(r.snapshot)
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+
+	if apps == nil {
+		apps = []*visor.App{}
+	}
+	return http.StatusOK, apps, nil
+}
+
+func createApp(r *request) (int, interface{}, error) {
+	body := &struct {
+		Name       string    `json:"name"`
+		RepoUrl    string    `json:"repo-url"`
+		Stack      string    `json:"stack"`
+		DeployType string    `json:"deploy-type"`
+		Env        visor.Env `json:"env"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+	if body.Name == "" {
+		return 0, nil, badRequest("name is required")
+	}
+
+	app := visor.NewApp(body.Name, body.RepoUrl, body.Stack, r.snapshot)
+	app.DeployType = body.DeployType
+	if body.Env != nil {
+		app.Env = body.Env
+	}
+	app, err := app.Register()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, app, nil
+}
+
+func getApp(r *request) (int, interface{}, error) {
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	if app.Env, err = app.EnvironmentVars(); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, app, nil
+}
+
+func deleteApp(r *request) (int, interface{}, error) {
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = r.checkIfMatch(path.Join(app.Dir.Name, "registered"), path.Join(app.Dir.Name, "attrs")); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, app.Unregister()
+}
+
+func listEnv(r *request) (int, interface{}, error) {
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	env, err := app.EnvironmentVars()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, env, nil
+}
+
+func getEnv(r *request) (int, interface{}, error) {
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	val, err := app.GetEnvironmentVar(r.params["key"])
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]string{"key": r.params["key"], "value": val}, nil
+}
+
+func setEnv(r *request) (int, interface{}, error) {
+	body := &struct {
+		Value *string `json:"value"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+	if body.Value == nil {
+		return 0, nil, badRequest("value is required")
+	}
+
+	if err := r.pinIfMatch(r.envFile()); err != nil {
+		return 0, nil, err
+	}
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = app.SetEnvironmentVar(r.params["key"], *body.Value); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]string{"key": r.params["key"], "value": *body.Value}, nil
+}
+
+func deleteEnv(r *request) (int, interface{}, error) {
+	if err := r.pinIfMatch(r.envFile()); err != nil {
+		return 0, nil, err
+	}
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = app.GetEnvironmentVar(r.params["key"]); err != nil {
+		return 0, nil, err
+	}
+	_, err = app.DelEnvironmentVar(r.params["key"])
+	return http.StatusNoContent, nil, err
+}
+
+func listRevs(r *request) (int, interface{}, error) {
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	revs, err := visor.AppRevisions(r.snapshot, app)
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Ref < revs[j].Ref })
+
+	if revs == nil {
+		revs = []*visor.Revision{}
+	}
+	return http.StatusOK, revs, nil
+}
+
+func createRev(r *request) (int, interface{}, error) {
+	body := &struct {
+		Ref        string `json:"ref"`
+		ArchiveUrl string `json:"archive-url"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+	if body.Ref == "" {
+		return 0, nil, badRequest("ref is required")
+	}
+
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	rev := visor.NewRevision(app, body.Ref, r.snapshot)
+	rev.ArchiveUrl = body.ArchiveUrl
+
+	rev, err = rev.Register()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, rev, nil
+}
+
+func getRev(r *request) (int, interface{}, error) {
+	rev, err := r.rev()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, rev, nil
+}
+
+func deleteRev(r *request) (int, interface{}, error) {
+	rev, err := r.rev()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = r.checkIfMatch(path.Join(rev.Dir.Name, "registered"), path.Join(rev.Dir.Name, "archive-url")); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, rev.Unregister()
+}
+
+func listProcs(r *request) (int, interface{}, error) {
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	ptys, err := app.GetProcTypes()
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Slice(ptys, func(i, j int) bool { return ptys[i].Name < ptys[j].Name })
+
+	if ptys == nil {
+		ptys = []*visor.ProcType{}
+	}
+	return http.StatusOK, ptys, nil
+}
+
+func createProc(r *request) (int, interface{}, error) {
+	body := &struct {
+		Name string `json:"name"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+
+	app, err := r.app()
+	if err != nil {
+		return 0, nil, err
+	}
+	pty, err := visor.NewProcType(app, body.Name, r.snapshot).Register()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, pty, nil
+}
+
+func getProc(r *request) (int, interface{}, error) {
+	pty, err := r.proc()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, pty, nil
+}
+
+func deleteProc(r *request) (int, interface{}, error) {
+	pty, err := r.proc()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = r.checkIfMatch(path.Join(pty.Dir.Name, "registered"), path.Join(pty.Dir.Name, "port")); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, pty.Unregister()
+}
+
+func listInstances(r *request) (int, interface{}, error) {
+	pty, err := r.proc()
+	if err != nil {
+		return 0, nil, err
+	}
+	ins, err := pty.GetInstances()
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Slice(ins, func(i, j int) bool { return ins[i].Id < ins[j].Id })
+
+	if ins == nil {
+		ins = []*visor.Instance{}
+	}
+	return http.StatusOK, ins, nil
+}
+
+func getScale(r *request) (int, interface{}, error) {
+	rev, err := r.rev()
+	if err != nil {
+		return 0, nil, err
+	}
+	pty, err := r.proc()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, _, err := r.snapshot.GetScale(pty.App.Name, rev.Ref, pty.Name)
+	if err != nil {
+		return 0, nil, err
+	}
+	sc := &scale{App: pty.App.Name, Proctype: pty.Name, Revision: rev.Ref, Scale: n}
+
+	desired, _, err := r.snapshot.GetDesiredScale(pty.App.Name, rev.Ref, pty.Name)
+	if err == nil {
+		sc.Desired = &desired
+	} else if !visor.IsErrNoEnt(err) {
+		return 0, nil, err
+	}
+	return http.StatusOK, sc, nil
+}
+
+func setScale(r *request) (int, interface{}, error) {
+	body := &struct {
+		Scale *int `json:"scale"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+	if body.Scale == nil || *body.Scale < 0 {
+		return 0, nil, badRequest("scale must be a positive integer")
+	}
+
+	file := path.Join("apps", r.params["app"], "procs", r.params["proc"], "desired-scale", r.params["rev"])
+	if err := r.pinIfMatch(file); err != nil {
+		return 0, nil, err
+	}
+	rev, err := r.rev()
+	if err != nil {
+		return 0, nil, err
+	}
+	pty, err := r.proc()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, _, err = visor.Scale(pty.App.Name, rev.Ref, pty.Name, *body.Scale, r.snapshot); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, &scale{App: pty.App.Name, Proctype: pty.Name, Revision: rev.Ref, Scale: *body.Scale, Desired: body.Scale}, nil
+}
+
+func getInstance(r *request) (int, interface{}, error) {
+	id, err := strconv.ParseInt(r.params["id"], 10, 64)
+	if err != nil {
+		return 0, nil, badRequest("invalid instance id '%s'", r.params["id"])
+	}
+	ins, err := visor.GetInstance(r.snapshot, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, ins, nil
+}
+
+func listServices(r *request) (int, interface{}, error) {
+	srvs, err := visor.Services(r.snapshot)
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Name < srvs[j].Name })
+
+	if srvs == nil {
+		srvs = []*visor.Service{}
+	}
+	return http.StatusOK, srvs, nil
+}
+
+func createService(r *request) (int, interface{}, error) {
+	body := &struct {
+		Name string `json:"name"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+	if body.Name == "" {
+		return 0, nil, badRequest("name is required")
+	}
+
+	srv, err := visor.NewService(body.Name, r.snapshot).Register()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, srv, nil
+}
+
+func getService(r *request) (int, interface{}, error) {
+	srv, err := r.service()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, srv, nil
+}
+
+func deleteService(r *request) (int, interface{}, error) {
+	srv, err := r.service()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = r.checkIfMatch(path.Join(srv.Dir.Name, "registered")); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, srv.Unregister()
+}
+
+func listEndpoints(r *request) (int, interface{}, error) {
+	srv, err := r.service()
+	if err != nil {
+		return 0, nil, err
+	}
+	eps, err := srv.GetEndpoints()
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Id() < eps[j].Id() })
+
+	if eps == nil {
+		eps = []*visor.Endpoint{}
+	}
+	return http.StatusOK, eps, nil
+}
+
+func createEndpoint(r *request) (int, interface{}, error) {
+	body := &struct {
+		Addr     string `json:"addr"`
+		Port     int    `json:"port"`
+		Priority int    `json:"priority"`
+		Weight   *int   `json:"weight"`
+	}{}
+	if err := r.decode(body); err != nil {
+		return 0, nil, err
+	}
+
+	srv, err := r.service()
+	if err != nil {
+		return 0, nil, err
+	}
+	ep, err := visor.NewEndpoint(srv, body.Addr, body.Port, r.snapshot)
+	if err != nil {
+		return 0, nil, badRequest("invalid endpoint address: %s", err)
+	}
+	ep.Priority = body.Priority
+	if body.Weight != nil {
+		ep.Weight = *body.Weight
+	}
+
+	if ep, err = ep.Register(); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, ep, nil
+}
+
+func getEndpoint(r *request) (int, interface{}, error) {
+	ep, err := r.endpoint()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, ep, nil
+}
+
+func deleteEndpoint(r *request) (int, interface{}, error) {
+	file := path.Join("services", r.params["service"], "endpoints", r.params["endpoint"])
+	if err := r.pinIfMatch(file); err != nil {
+		return 0, nil, err
+	}
+	ep, err := r.endpoint()
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, ep.Unregister()
+}
+
+// envFile returns the file of the environment variable named in the
+// request, with underscores replaced as by App.SetEnvironmentVar.
+func (r *request) envFile() string {
+	return path.Join("apps", r.params["app"], "env", strings.Replace(r.params["key"], "_", "-", -1))
+}
+
+func (r *request) app() (*visor.App, error) {
+	return visor.GetApp(r.snapshot, r.params["app"])
+}
+
+func (r *request) rev() (*visor.Revision, error) {
+	app, err := r.app()
+	if err != nil {
+		return nil, err
+	}
+	return visor.GetRevision(r.snapshot, app, r.params["rev"])
+}
+
+func (r *request) proc() (*visor.ProcType, error) {
+	app, err := r.app()
+	if err != nil {
+		return nil, err
+	}
+	return visor.GetProcType(r.snapshot, app, r.params["proc"])
+}
+
+// service returns the service named in the request, or ErrNoEnt
+// if it isn't registered.
+func (r *request) service() (*visor.Service, error) {
+	name := r.params["service"]
+
+	srvs, err := visor.Services(r.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvs {
+		if srv.Name == name {
+			return srv, nil
+		}
+	}
+	return nil, visor.NewError(visor.ErrNoEnt, fmt.Sprintf("service '%s' not found", name))
+}
+
+func (r *request) endpoint() (*visor.Endpoint, error) {
+	srv, err := r.service()
+	if err != nil {
+		return nil, err
+	}
+	return visor.GetEndpoint(r.snapshot, srv, r.params["endpoint"])
+}
@@ -6,6 +6,7 @@
 package visor
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"strings"
@@ -24,6 +25,8 @@ type App struct {
 	Head       string
 	Env        Env
 	DeployType string
+	// Number of revisions kept by PruneRevisions, 0 keeps all.
+	KeepRevisions int
 }
 
 // NewApp returns a new App given a name, repository url and stack.
@@ -60,30 +63,23 @@ func (a *App) Register() (app *App, err error) {
 		a.DeployType = DeployLXC
 	}
 
-	attrs := &file{
-		Snapshot: a.Dir.Snapshot,
-		codec:    new(jsonCodec),
-		dir:      a.Dir.prefix("attrs"),
-		Value: map[string]interface{}{
-			"repo-url":    a.RepoUrl,
-			"stack":       a.Stack,
-			"deploy-type": a.DeployType,
-		},
-	}
+	//
+	//   apps/
+	//       <app>/
+	// +         attrs      = {"repo-url": ..., "stack": ..., "deploy-type": ...}
+	// +         env/<key>  = <value>
+	// +         registered = 2012-07-19 16:41 UTC
+	//
+	t := a.Dir.Snapshot.txn()
 
-	_, err = attrs.Create()
-	if err != nil {
-		return
-	}
+	t.setFile(a.Dir.prefix("attrs"), a.attrs(), new(jsonCodec))
 
 	for k, v := range a.Env {
-		_, err = a.SetEnvironmentVar(k, v)
-		if err != nil {
-			return
-		}
+		t.set(a.Dir.prefix("env", strings.Replace(k, "_", "-", -1)), v)
 	}
+	t.set(a.Dir.prefix("registered"), timestamp())
 
-	rev, err := a.Dir.set("registered", timestamp())
+	rev, err := t.commit()
 	if err != nil {
 		return
 	}
@@ -93,6 +89,18 @@ func (a *App) Register() (app *App, err error) {
 	return
 }
 
+func (a *App) attrs() map[string]interface{} {
+	attrs := map[string]interface{}{
+		"repo-url":    a.RepoUrl,
+		"stack":       a.Stack,
+		"deploy-type": a.DeployType,
+	}
+	if a.KeepRevisions > 0 {
+		attrs["keep-revisions"] = a.KeepRevisions
+	}
+	return attrs
+}
+
 // Unregister removes the App form the global process state.
 func (a *App) Unregister() error {
 	return a.Dir.del("/")
@@ -110,6 +118,24 @@ func (a *App) SetHead(head string) (a1 *App, err error) {
 	return
 }
 
+// SetKeepRevisions sets the number of revisions kept by PruneRevisions.
+// A value of 0 keeps all revisions.
+func (a *App) SetKeepRevisions(n int) (a1 *App, err error) {
+	if n < 0 {
+		return nil, fmt.Errorf("number of revisions to keep can't be negative")
+	}
+	a1 = a.FastForward(a.Dir.Snapshot.Rev) // Create a copy
+	a1.KeepRevisions = n
+
+	f, err := createFile(a.Dir.Snapshot, a.Dir.prefix("attrs"), a1.attrs(), new(jsonCodec))
+	if err != nil {
+		return nil, err
+	}
+	a1 = a1.FastForward(f.FileRev)
+
+	return
+}
+
 // EnvironmentVars returns all set variables for this app as a map.
 func (a *App) EnvironmentVars() (vars Env, err error) {
 	names, err := a.Dir.Snapshot.getdir(a.Dir.prefix("env"))
@@ -211,17 +237,19 @@ func (a *App) GetProcTypes() (ptys []*ProcType, err error) {
 
 // WatchEvent watches for events related to the app
 func (a *App) WatchEvent(listener chan *Event) {
-	ch := make(chan *Event)
-	go WatchEvent(a.Dir.Snapshot, ch)
+	a.watchEvent(context.Background(), listener)
+}
 
-	for e := range ch {
-		if e.Path.App != nil && *e.Path.App == a.Name {
-			listener <- e
-		}
-		if i, ok := e.Source.(*Instance); ok && i.AppName == a.Name {
-			listener <- e
-		}
-	}
+// WatchEventContext is like WatchEvent, but returns ctx.Err()
+// once ctx is done. The listener channel is closed on return.
+func (a *App) WatchEventContext(ctx context.Context, listener chan *Event) error {
+	defer close(listener)
+	return a.watchEvent(ctx, listener)
+}
+
+func (a *App) watchEvent(ctx context.Context, listener chan *Event) error {
+	f := Filter{App: a.Name}
+	return watchEvent(ctx, a.Dir.Snapshot, f.Glob(), listener, f.Match)
 }
 
 func (a *App) String() string {
@@ -246,6 +274,9 @@ func GetApp(s Snapshot, name string) (app *App, err error) {
 	app.RepoUrl = value["repo-url"].(string)
 	app.Stack = value["stack"].(string)
 	app.DeployType = value["deploy-type"].(string)
+	if n, ok := value["keep-revisions"].(float64); ok {
+		app.KeepRevisions = int(n)
+	}
 
 	f, err = s.getFile(app.Dir.prefix("head"), new(stringCodec))
 	if err == nil {
@@ -256,7 +287,8 @@ func GetApp(s Snapshot, name string) (app *App, err error) {
 	return
 }
 
-// Apps returns the list of all registered Apps.
+// Apps returns the list of all registered Apps. Apps which
+// are only partially registered are left out.
 func Apps(s Snapshot) (apps []*App, err error) {
 	exists, _, err := s.conn.Exists(appsPath)
 	if err != nil || !exists {
@@ -269,6 +301,10 @@ func Apps(s Snapshot) (apps []*App, err error) {
 	}
 
 	results, err := getSnapshotables(names, func(name string) (snapshotable, error) {
+		registered, _, err := s.exists(path.Join(appsPath, name, "registered"))
+		if err != nil || !registered {
+			return nil, err
+		}
 		return GetApp(s, name)
 	})
 	if err != nil {
@@ -276,7 +312,9 @@ func Apps(s Snapshot) (apps []*App, err error) {
 	}
 
 	for _, r := range results {
-		apps = append(apps, r.(*App))
+		if r != nil {
+			apps = append(apps, r.(*App))
+		}
 	}
 	return
 }
@@ -10,7 +10,7 @@ import (
 )
 
 func appSetup(name string) (app *App) {
-	s, err := Dial(DefaultAddr, "/app-test")
+	s, err := testDial("/app-test")
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,124 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Backend is the interface to a revisioned coordinator store. Its
+// semantics follow doozer's: every mutation advances the store
+// revision, files are addressed by absolute path, directories
+// report negative file revisions and missing files report a file
+// revision of 0.
+//
+// Backends report missing directories on Getdir with an error
+// for which IsErrNoEnt returns true, and failed compare-and-set
+// operations on Set with a zero revision. Deleting a missing
+// file is not an error. Reads and waits at revisions which are
+// no longer part of the store's history fail with an error for
+// which IsErrRevTooOld returns true.
+type Backend interface {
+	// Get returns the body and file revision of path at rev,
+	// or at the latest revision if rev is nil.
+	Get(path string, rev *int64) (value []byte, filerev int64, err error)
+
+	// Set sets the body of path if its current file revision
+	// is not greater than rev. A rev of -1 sets unconditionally.
+	Set(path string, rev int64, value []byte) (newrev int64, err error)
+
+	// Del deletes the file at path if its current file revision
+	// is not greater than rev.
+	Del(path string, rev int64) error
+
+	// Stat returns the length of the file at path, or the number
+	// of entries if path is a directory, along with its file revision.
+	Stat(path string, rev *int64) (len int, filerev int64, err error)
+
+	// Getdir returns at most limit entries of the directory at path,
+	// starting at offset, as of rev.
+	Getdir(path string, rev int64, offset, limit int) (names []string, err error)
+
+	// Wait blocks until a file matching glob is changed at or after rev.
+	Wait(glob string, rev int64) (BackendEvent, error)
+
+	// Rev returns the current revision of the store.
+	Rev() (int64, error)
+
+	Close()
+}
+
+// ContextWaiter is implemented by backends which support
+// cancelling a Wait through a context, as the doozer and mem
+// backends do. Waits on backends which don't implement it are
+// abandoned on cancellation instead, leaving them pending.
+type ContextWaiter interface {
+	WaitContext(ctx context.Context, glob string, rev int64) (BackendEvent, error)
+}
+
+// BackendEvent represents a single file mutation returned by Backend.Wait.
+type BackendEvent struct {
+	Rev  int64
+	Path string
+	Body []byte
+	Del  bool
+}
+
+// IsSet returns true if the event was caused by a set operation.
+func (e BackendEvent) IsSet() bool {
+	return !e.Del
+}
+
+// IsDel returns true if the event was caused by a delete operation.
+func (e BackendEvent) IsDel() bool {
+	return e.Del
+}
+
+// BackendDialer opens a Backend given a coordinator uri.
+type BackendDialer func(uri string) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendDialer{
+		"doozer":  dialDoozerUri,
+		memScheme: dialMemUri,
+	}
+)
+
+// RegisterBackend makes a Backend available to DialUri under the
+// given uri scheme. Registering a scheme twice replaces the
+// previous dialer.
+func RegisterBackend(scheme string, dialer BackendDialer) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	backends[scheme] = dialer
+}
+
+// dialBackend looks up the dialer registered for the scheme
+// of uri and uses it to open a Backend.
+func dialBackend(uri string) (Backend, error) {
+	dialer, ok := backendDialer(uri)
+	if !ok {
+		return nil, fmt.Errorf("unsupported coordinator uri '%s'", uri)
+	}
+	return dialer(uri)
+}
+
+func backendDialer(uri string) (dialer BackendDialer, ok bool) {
+	i := strings.Index(uri, ":")
+	if i < 1 {
+		return
+	}
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	dialer, ok = backends[uri[:i]]
+	return
+}
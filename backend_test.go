@@ -0,0 +1,32 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBackendDialerScheme(t *testing.T) {
+	dialErr := errors.New("dialed")
+
+	RegisterBackend("backend-test", func(uri string) (Backend, error) {
+		return nil, dialErr
+	})
+
+	if _, err := DialUri("backend-test:foo", "/"); err != dialErr {
+		t.Errorf("expected registered dialer to be used, got %v", err)
+	}
+	if _, err := Dial("backend-test:foo", "/"); err != dialErr {
+		t.Errorf("expected registered dialer to be used, got %v", err)
+	}
+	if _, err := DialUri("unknown:foo", "/"); err == nil {
+		t.Error("expected unknown scheme to fail")
+	}
+	if _, ok := backendDialer("localhost:8046"); ok {
+		t.Error("expected address not to match a registered scheme")
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+const canaryPath = "canary"
+
+// DefaultCanaryWeight is the SRV weight of the endpoints of a canary.
+// Compared to endpoints with the DefaultEndpointWeight, each canary
+// instance receives a tenth of the traffic of a regular instance.
+const DefaultCanaryWeight = 10
+
+type CanaryState string
+
+const (
+	CanaryRunning  CanaryState = "running"
+	CanaryPromoted CanaryState = "promoted"
+	CanaryAborted  CanaryState = "aborted"
+)
+
+// A Canary runs a few instances of a new revision of a proctype next
+// to the instances of the head revision of the app. The endpoints of
+// the canary instances are published with a reduced Weight, so that
+// proxies send them a share of the traffic only. The canary is then
+// either promoted, making its revision the head, or aborted.
+type Canary struct {
+	Dir       dir         `json:"-"`
+	App       string      `json:"app"`
+	Proc      string      `json:"proc"`
+	Rev       string      `json:"rev"`
+	Head      string      `json:"head"`
+	Instances int         `json:"instances"`
+	Weight    int         `json:"weight"`
+	HeadScale int         `json:"head-scale"` // Instances of Head when started
+	State     CanaryState `json:"state"`
+	Started   string      `json:"started"`
+
+	// Endpoints published for the canary instances,
+	// by id, with the weight they had before.
+	Endpoints map[string]int `json:"endpoints"`
+}
+
+// A CanaryCheck tells whether the instances of a canary are healthy.
+type CanaryCheck func(ctx context.Context, c *Canary, ins []*Instance) error
+
+// NewCanary returns a Canary of n instances of app:proc@rev, next
+// to the head of app.
+func NewCanary(app *App, proc, rev string, n int, s Snapshot) *Canary {
+	return &Canary{
+		App:       app.Name,
+		Proc:      proc,
+		Rev:       rev,
+		Head:      app.Head,
+		Instances: n,
+		Weight:    DefaultCanaryWeight,
+		Dir:       dir{s, path.Join(appsPath, app.Name, procsPath, proc)},
+	}
+}
+
+// GetCanary returns the last canary of app:proc.
+func GetCanary(s Snapshot, app, proc string) (c *Canary, err error) {
+	d := dir{s, path.Join(appsPath, app, procsPath, proc)}
+
+	val, _, err := d.get(canaryPath)
+	if err != nil {
+		return
+	}
+	c = &Canary{}
+	if err = json.Unmarshal([]byte(val), c); err != nil {
+		return nil, err
+	}
+	c.Dir = d
+
+	return
+}
+
+func (c *Canary) createSnapshot(rev int64) snapshotable {
+	tmp := *c
+	tmp.Dir.Snapshot = Snapshot{rev, c.Dir.Snapshot.conn}
+	return &tmp
+}
+
+// FastForward advances the canary in time. It returns
+// a new instance of Canary with the supplied revision.
+func (c *Canary) FastForward(rev int64) *Canary {
+	return c.Dir.Snapshot.fastForward(c, rev).(*Canary)
+}
+
+// Start registers the canary instances. It fails with ErrKeyConflict
+// if another canary of the proctype is running.
+func (c *Canary) Start() (c1 *Canary, err error) {
+	if c.Instances < 1 || c.Weight < 0 {
+		return nil, errors.New("canary instances need to be a positive integer")
+	}
+	if c.Rev == c.Head {
+		return nil, fmt.Errorf("%s is already the head of %s", c.Rev, c.App)
+	}
+	s := c.Dir.Snapshot
+
+	last, err := GetCanary(s, c.App, c.Proc)
+	if err == nil && last.State == CanaryRunning {
+		return nil, NewError(ErrKeyConflict, fmt.Sprintf("%s already has a canary of %s", c, last.Rev))
+	} else if err != nil && !IsErrNoEnt(err) {
+		return
+	}
+
+	if c.Head != "" {
+		ids, err := liveInstanceIds(s, c.App, c.Head, c.Proc)
+		if err != nil {
+			return nil, err
+		}
+		c.HeadScale = len(ids)
+	}
+	c.State = CanaryRunning
+	c.Started = timestamp()
+	c.Endpoints = map[string]int{}
+
+	if c, err = c.save(); err != nil {
+		return
+	}
+	if _, _, err = Scale(c.App, c.Rev, c.Proc, c.Instances, s.FastForward(-1)); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// Publish waits for the canary instances to run, and publishes their
+// endpoints with the canary Weight. Endpoints which were registered
+// already get the canary Weight until the canary is promoted.
+func (c *Canary) Publish(ctx context.Context) (c1 *Canary, err error) {
+	ins, err := c.waitInstances(ctx)
+	if err != nil {
+		return c, err
+	}
+	c1 = c.FastForward(c.Dir.Snapshot.Rev)
+	c1.Endpoints = map[string]int{}
+	for id, w := range c.Endpoints {
+		c1.Endpoints[id] = w
+	}
+
+	for _, i := range ins {
+		s := c1.Dir.Snapshot.FastForward(-1)
+
+		srv := NewService(i.ServiceName(), s)
+		if _, err = srv.Register(); err != nil && err != ErrKeyConflict {
+			return c, err
+		}
+		ep, err := NewEndpoint(srv, i.Ip, i.Port, s)
+		if err != nil {
+			return c, err
+		}
+		if _, published := c1.Endpoints[ep.Id()]; published {
+			continue
+		}
+
+		existing, err := GetEndpoint(s, srv, ep.Id())
+		if err == nil {
+			c1.Endpoints[ep.Id()] = existing.Weight
+			_, err = existing.SetWeight(c1.Weight)
+		} else if IsErrNoEnt(err) {
+			c1.Endpoints[ep.Id()] = ep.Weight
+			ep.Weight = c1.Weight
+			_, err = ep.Register()
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+	return c1.save()
+}
+
+// Verify runs check on the canary instances every interval, n times.
+// If all checks pass, the canary is promoted. Otherwise it is aborted,
+// and the error of the failed check is returned.
+func (c *Canary) Verify(ctx context.Context, check CanaryCheck, interval time.Duration, n int) (c1 *Canary, err error) {
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return c, ctx.Err()
+			}
+		}
+		ins, err := c.instances(c.Dir.Snapshot.FastForward(-1))
+		if err != nil {
+			return c, err
+		}
+		if err = check(ctx, c, ins); err != nil {
+			c1, e := c.Abort()
+			if e != nil {
+				err = e
+			}
+			return c1, err
+		}
+	}
+	return c.Promote()
+}
+
+// CheckRunning is a CanaryCheck which passes while
+// all canary instances are running.
+func CheckRunning(ctx context.Context, c *Canary, ins []*Instance) error {
+	if len(ins) < c.Instances {
+		return fmt.Errorf("%d of %d canary instances are left", len(ins), c.Instances)
+	}
+	for _, i := range ins {
+		if i.Status != InsStatusRunning {
+			return fmt.Errorf("canary instance %d is %s", i.Id, i.Status)
+		}
+	}
+	return nil
+}
+
+// Promote makes the canary revision the head of the app. The canary
+// revision is scaled to the former scale of the head, which is scaled
+// down to zero, and the canary endpoints get back their weight.
+func (c *Canary) Promote() (c1 *Canary, err error) {
+	if c.State != CanaryRunning {
+		return nil, NewError(ErrInvalidState, fmt.Sprintf("%s canary is %s", c, c.State))
+	}
+	s := c.Dir.Snapshot.FastForward(-1)
+
+	if c.HeadScale > c.Instances {
+		if _, _, err = Scale(c.App, c.Rev, c.Proc, c.HeadScale, s); err != nil {
+			return c, err
+		}
+	}
+	if err = c.restoreEndpoints(false); err != nil {
+		return c, err
+	}
+
+	app, err := GetApp(s.FastForward(-1), c.App)
+	if err != nil {
+		return c, err
+	}
+	if _, err = app.SetHead(c.Rev); err != nil {
+		return c, err
+	}
+	if c.Head != "" {
+		if _, _, err = Scale(c.App, c.Head, c.Proc, 0, s.FastForward(-1)); err != nil {
+			return c, err
+		}
+	}
+
+	c1 = c.FastForward(c.Dir.Snapshot.Rev)
+	c1.State = CanaryPromoted
+
+	return c1.save()
+}
+
+// Abort removes the canary endpoints and instances.
+func (c *Canary) Abort() (c1 *Canary, err error) {
+	if c.State != CanaryRunning {
+		return nil, NewError(ErrInvalidState, fmt.Sprintf("%s canary is %s", c, c.State))
+	}
+	if err = c.restoreEndpoints(true); err != nil {
+		return c, err
+	}
+	if _, _, err = Scale(c.App, c.Rev, c.Proc, 0, c.Dir.Snapshot.FastForward(-1)); err != nil {
+		return c, err
+	}
+
+	c1 = c.FastForward(c.Dir.Snapshot.Rev)
+	c1.State = CanaryAborted
+
+	return c1.save()
+}
+
+// restoreEndpoints gives the canary endpoints back their previous
+// weight, or unregisters them if unregister is true.
+func (c *Canary) restoreEndpoints(unregister bool) error {
+	srv := NewService(fmt.Sprintf("%s-%s", c.App, c.Proc), c.Dir.Snapshot)
+
+	for id, weight := range c.Endpoints {
+		s := c.Dir.Snapshot.FastForward(-1)
+
+		ep, err := GetEndpoint(s, srv, id)
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if unregister {
+			err = ep.Unregister()
+		} else {
+			_, err = ep.SetWeight(weight)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitInstances waits until all canary instances are running,
+// and returns them. It fails if one of them fails or exits.
+func (c *Canary) waitInstances(ctx context.Context) (ins []*Instance, err error) {
+	s := c.Dir.Snapshot.FastForward(-1)
+
+	ids, err := liveInstanceIds(s, c.App, c.Rev, c.Proc)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		i, err := waitRunning(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if i.Status != InsStatusRunning {
+			return nil, NewError(ErrInvalidState, fmt.Sprintf("canary instance %d is %s", id, i.Status))
+		}
+		ins = append(ins, i)
+	}
+	return
+}
+
+func (c *Canary) instances(s Snapshot) (ins []*Instance, err error) {
+	ids, err := liveInstanceIds(s, c.App, c.Rev, c.Proc)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		i, err := GetInstance(s, id)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, i)
+	}
+	return
+}
+
+func (c *Canary) save() (c1 *Canary, err error) {
+	//
+	//   apps/<app>/procs/<proc>/
+	// +     canary = {"rev": "d4e5f6", "head": "a1b2c3", "state": "running", ...}
+	//
+	data, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	rev, err := c.Dir.set(canaryPath, string(data))
+	if err != nil {
+		return c, err
+	}
+	return c.FastForward(rev), nil
+}
+
+func (c *Canary) String() string {
+	return fmt.Sprintf("%s:%s", c.App, c.Proc)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func canarySetup(t *testing.T) (app *App, cancel context.CancelFunc) {
+	s, err := DialUri("mem:", "/canary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = NewApp("canarycat", "git://canarycat", "s1", s.FastForward(rev)).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"r1", "r2"} {
+		if _, err = NewRevision(app, ref, app.Dir.Snapshot.FastForward(-1)).Register(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = NewProcType(app, "web", app.Dir.Snapshot.FastForward(-1)).Register(); err != nil {
+		t.Fatal(err)
+	}
+	if app, err = app.FastForward(-1).SetHead("r1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	go rolloutPm(ctx, t, app.Dir.Snapshot, "")
+
+	if _, _, err = Scale(app.Name, "r1", "web", 2, app.Dir.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return app, cancel
+}
+
+func canaryStart(t *testing.T, app *App) *Canary {
+	c, err := NewCanary(app, "web", "r2", 1, app.Dir.Snapshot.FastForward(-1)).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCanary(app, "web", "r2", 1, c.Dir.Snapshot).Start(); err == nil {
+		t.Error("expected a second canary of the proctype to be refused")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if c, err = c.Publish(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Endpoints) != 1 {
+		t.Fatalf("expected one canary endpoint, got %v", c.Endpoints)
+	}
+	for _, ep := range canaryEndpoints(t, c) {
+		if ep.Weight != DefaultCanaryWeight {
+			t.Errorf("expected endpoint %s to have the canary weight, got %d", ep.Id(), ep.Weight)
+		}
+	}
+	return c
+}
+
+func canaryEndpoints(t *testing.T, c *Canary) (eps []*Endpoint) {
+	s := c.Dir.Snapshot.FastForward(-1)
+	srv := NewService("canarycat-web", s)
+
+	for id := range c.Endpoints {
+		ep, err := GetEndpoint(s, srv, id)
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		eps = append(eps, ep)
+	}
+	return
+}
+
+func TestCanaryPromote(t *testing.T) {
+	app, cancel := canarySetup(t)
+	defer cancel()
+
+	c := canaryStart(t, app)
+
+	c, err := c.Verify(context.Background(), CheckRunning, time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State != CanaryPromoted {
+		t.Errorf("expected canary to be promoted, got %s", c.State)
+	}
+
+	s := c.Dir.Snapshot.FastForward(-1)
+	if app, err = GetApp(s, app.Name); err != nil || app.Head != "r2" {
+		t.Errorf("expected r2 to be the head, got %v (%v)", app, err)
+	}
+	if ids, _ := liveInstanceIds(s, app.Name, "r2", "web"); len(ids) != 2 {
+		t.Errorf("expected r2 to be scaled to 2, got %v", ids)
+	}
+	if ids, _ := liveInstanceIds(s, app.Name, "r1", "web"); len(ids) != 0 {
+		t.Errorf("expected r1 to be scaled down, got %v", ids)
+	}
+	for _, ep := range canaryEndpoints(t, c) {
+		if ep.Weight != DefaultEndpointWeight {
+			t.Errorf("expected endpoint %s to get its weight back, got %d", ep.Id(), ep.Weight)
+		}
+	}
+	if _, err = c.Abort(); err == nil {
+		t.Error("expected promoted canary not to be aborted")
+	}
+}
+
+func TestCanaryAbort(t *testing.T) {
+	app, cancel := canarySetup(t)
+	defer cancel()
+
+	c := canaryStart(t, app)
+
+	unhealthy := func(ctx context.Context, c *Canary, ins []*Instance) error {
+		return errors.New("too many errors")
+	}
+	c, err := c.Verify(context.Background(), unhealthy, time.Millisecond, 2)
+	if err == nil || err.Error() != "too many errors" {
+		t.Fatalf("expected check to fail, got %v", err)
+	}
+	if c.State != CanaryAborted {
+		t.Errorf("expected canary to be aborted, got %s", c.State)
+	}
+
+	s := c.Dir.Snapshot.FastForward(-1)
+	if app, err = GetApp(s, app.Name); err != nil || app.Head != "r1" {
+		t.Errorf("expected r1 to stay the head, got %v (%v)", app, err)
+	}
+	if ids, _ := liveInstanceIds(s, app.Name, "r2", "web"); len(ids) != 0 {
+		t.Errorf("expected canary instances to be stopped, got %v", ids)
+	}
+	if eps := canaryEndpoints(t, c); len(eps) != 0 {
+		t.Errorf("expected canary endpoints to be removed, got %v", eps)
+	}
+	if c, err = GetCanary(s, app.Name, "web"); err != nil || c.State != CanaryAborted {
+		t.Errorf("expected aborted canary to be stored, got %v (%v)", c, err)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Finding is an inconsistency in the registry found by Check,
+// along with a fix for it.
+type Finding struct {
+	Path    string // Path of the inconsistent file or directory
+	Problem string // Description of the inconsistency
+	Fix     string // Description of the fix
+	fix     func() error
+}
+
+// Apply applies the fix for the finding. Files which were changed
+// after the revision Check was run at are left alone, in which case
+// Apply fails with ErrRevMismatch.
+func (f *Finding) Apply() error {
+	return f.fix()
+}
+
+func (f *Finding) String() string {
+	return fmt.Sprintf("%s: %s (fix: %s)", f.Path, f.Problem, f.Fix)
+}
+
+// Check walks the registry and reports inconsistencies left behind
+// by crashed clients and coordinator incidents:
+//
+//   - instances listed under a proctype without an instance object
+//   - instance objects of unregistered apps, revisions or proctypes
+//   - running instances claimed by a host which isn't registered as a pm
+//   - endpoints of services which aren't registered
+//   - proctypes sharing a port
+//   - a next port which isn't above all allocated ports
+//
+// Objects left half-written by interrupted registrations are fixed
+// by Repair instead.
+func Check(s Snapshot) (findings []*Finding, err error) {
+	c := &checker{s: s}
+
+	for _, check := range []func() error{c.checkApps, c.checkInstances, c.checkServices, c.checkPorts} {
+		if err = check(); err != nil {
+			return
+		}
+	}
+	return c.findings, nil
+}
+
+type checker struct {
+	s        Snapshot
+	findings []*Finding
+
+	// Registered apps, revisions (app@rev) and proctypes (app:proc)
+	apps, revs, procs map[string]bool
+	// Ports of registered proctypes, by proctype
+	ports map[string]int
+}
+
+func (c *checker) report(p, problem, fix string, fn func() error) {
+	c.findings = append(c.findings, &Finding{Path: p, Problem: problem, Fix: fix, fix: fn})
+}
+
+// getdir returns the entries of the dir at p, or none if it doesn't exist.
+func (c *checker) getdir(p string) ([]string, error) {
+	names, err := c.s.getdir(p)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
+func (c *checker) registered(p string) (bool, error) {
+	exists, _, err := c.s.exists(path.Join(p, "registered"))
+	return exists, err
+}
+
+func (c *checker) checkApps() error {
+	c.apps, c.revs, c.procs = map[string]bool{}, map[string]bool{}, map[string]bool{}
+	c.ports = map[string]int{}
+
+	apps, err := c.getdir(appsPath)
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		p := path.Join(appsPath, app)
+
+		ok, err := c.registered(p)
+		if err != nil {
+			return err
+		}
+		c.apps[app] = ok
+
+		revs, err := c.getdir(path.Join(p, revsPath))
+		if err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			ok, err := c.registered(path.Join(p, revsPath, rev))
+			if err != nil {
+				return err
+			}
+			c.revs[app+"@"+rev] = ok
+		}
+
+		procs, err := c.getdir(path.Join(p, procsPath))
+		if err != nil {
+			return err
+		}
+		for _, proc := range procs {
+			if err = c.checkProc(app, proc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkProc(app, proc string) error {
+	p := path.Join(appsPath, app, procsPath, proc)
+
+	ok, err := c.registered(p)
+	if err != nil {
+		return err
+	}
+	c.procs[app+":"+proc] = ok
+
+	if ok {
+		f, err := c.s.getFile(path.Join(p, "port"), new(intCodec))
+		if err == nil {
+			c.ports[app+":"+proc] = f.Value.(int)
+		} else if !IsErrNoEnt(err) {
+			return err
+		}
+	}
+
+	revs, err := c.getdir(path.Join(p, instancesPath))
+	if err != nil {
+		return err
+	}
+	for _, rev := range revs {
+		ids, err := c.getdir(path.Join(p, instancesPath, rev))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			exists, _, err := c.s.exists(path.Join(instancesPath, id, "object"))
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			entry := path.Join(p, instancesPath, rev, id)
+
+			c.report(entry, fmt.Sprintf("instance %s has no object", id), "remove the entry", func() error {
+				return c.s.del(entry)
+			})
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkInstances() error {
+	ids, err := c.getdir(instancesPath)
+	if err != nil {
+		return err
+	}
+	pms, err := c.getdir(pmDir)
+	if err != nil {
+		return err
+	}
+	hosts := map[string]bool{}
+	for _, pm := range pms {
+		hosts[pm] = true
+	}
+
+	for _, name := range ids {
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		exists, _, err := c.s.exists(path.Join(instancePath(id), "object"))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			// Left for Repair
+			continue
+		}
+		ins, err := GetInstance(c.s, id)
+		if err != nil {
+			return err
+		}
+
+		var problem string
+
+		switch {
+		case !c.apps[ins.AppName]:
+			problem = fmt.Sprintf("app '%s' of instance %d is not registered", ins.AppName, id)
+		case !c.revs[ins.AppName+"@"+ins.RevisionName]:
+			problem = fmt.Sprintf("revision '%s' of instance %d is not registered", ins.RevisionName, id)
+		case !c.procs[ins.AppName+":"+ins.ProcessName]:
+			problem = fmt.Sprintf("proctype '%s' of instance %d is not registered", ins.ProcessName, id)
+		}
+		if problem != "" {
+			c.reportOrphan(ins, problem)
+			continue
+		}
+
+		if ins.Status == InsStatusRunning && !hosts[ins.Ip] {
+			c.report(ins.Dir.Name, fmt.Sprintf("instance %d is claimed by %s, which is not a registered pm", id, ins.Ip), "mark the instance as failed", func() error {
+				_, err := ins.Failed(ins.Ip, fmt.Errorf("%s is not a registered pm", ins.Ip))
+				return err
+			})
+		}
+	}
+	return nil
+}
+
+// reportOrphan reports an instance whose app, revision or proctype is gone.
+// Running instances are stopped, so that their pm cleans them up, others
+// are unregistered.
+func (c *checker) reportOrphan(ins *Instance, problem string) {
+	if ins.Status == InsStatusRunning {
+		c.report(ins.Dir.Name, problem, "stop the instance", func() error {
+			_, err := StopInstance(ins.Id, c.s)
+			return err
+		})
+		return
+	}
+	c.report(ins.Dir.Name, problem, "unregister the instance", ins.Unregister)
+}
+
+func (c *checker) checkServices() error {
+	srvs, err := c.getdir(servicesPath)
+	if err != nil {
+		return err
+	}
+	for _, srv := range srvs {
+		p := path.Join(servicesPath, srv)
+
+		ok, err := c.registered(p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		eps, err := c.getdir(path.Join(p, endpointsPath))
+		if err != nil {
+			return err
+		}
+		for _, ep := range eps {
+			ep := path.Join(p, endpointsPath, ep)
+
+			c.report(ep, fmt.Sprintf("service '%s' of the endpoint is not registered", srv), "remove the endpoint", func() error {
+				return c.s.del(ep)
+			})
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkPorts() error {
+	byPort := map[int][]string{}
+	max := 0
+
+	for proc, port := range c.ports {
+		byPort[port] = append(byPort[port], proc)
+		if port > max {
+			max = port
+		}
+	}
+
+	if len(c.ports) > 0 {
+		f, err := c.s.getFile(nextPortPath, new(intCodec))
+		if err != nil {
+			return err
+		}
+		if next := f.Value.(int); next <= max {
+			c.report(nextPortPath, fmt.Sprintf("next port %d is not above the highest allocated port %d", next, max), fmt.Sprintf("set it to %d", max+1), func() error {
+				_, err := f.Set(max + 1)
+				return err
+			})
+		}
+	}
+
+	var ports []int
+	for port, procs := range byPort {
+		if len(procs) > 1 {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+
+	for _, port := range ports {
+		procs, err := c.byPortRev(byPort[port])
+		if err != nil {
+			return err
+		}
+		// The proctype which got the port first keeps it
+		for _, proc := range procs[1:] {
+			p := c.portPath(proc)
+
+			c.report(p, fmt.Sprintf("port %d is also used by %s", port, procs[0]), "assign a new port", func() error {
+				return c.reassignPort(p, max)
+			})
+		}
+	}
+	return nil
+}
+
+// byPortRev sorts proctypes by the revision their port was set at.
+func (c *checker) byPortRev(procs []string) ([]string, error) {
+	revs := map[string]int64{}
+
+	for _, proc := range procs {
+		_, rev, err := c.s.exists(c.portPath(proc))
+		if err != nil {
+			return nil, err
+		}
+		revs[proc] = rev
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		if revs[procs[i]] != revs[procs[j]] {
+			return revs[procs[i]] < revs[procs[j]]
+		}
+		return procs[i] < procs[j]
+	})
+	return procs, nil
+}
+
+// portPath returns the path of the port file of a proctype given as app:proc.
+func (c *checker) portPath(proc string) string {
+	i := strings.LastIndex(proc, ":")
+	return path.Join(appsPath, proc[:i], procsPath, proc[i+1:], "port")
+}
+
+// reassignPort claims a new port for the proctype port file at p. The
+// next port is first moved above max, in case it was found too low.
+func (c *checker) reassignPort(p string, max int) error {
+	f, err := getLatest(c.s, nextPortPath, new(intCodec))
+	if err != nil {
+		return err
+	}
+	if f.Value.(int) <= max {
+		if _, err = f.Set(max + 1); err != nil {
+			return err
+		}
+	}
+	port, err := ClaimNextPort(c.s.FastForward(-1))
+	if err != nil {
+		return err
+	}
+	_, err = c.s.set(p, strconv.Itoa(port))
+	return err
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"path"
+	"sort"
+	"testing"
+)
+
+func checkSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/check-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	s = s.FastForward(rev)
+
+	app, err := NewApp("checkcat", "git://checkcat", "s1", s).Register()
+	if err != nil {
+		panic(err)
+	}
+	if _, err = NewRevision(app, "f00", app.Dir.Snapshot).Register(); err != nil {
+		panic(err)
+	}
+	for _, name := range []string{"web", "worker"} {
+		if _, err = NewProcType(app, name, s.FastForward(-1)).Register(); err != nil {
+			panic(err)
+		}
+	}
+	return s.FastForward(-1)
+}
+
+func TestCheckConsistent(t *testing.T) {
+	s := checkSetup()
+
+	ins, err := RegisterInstance("checkcat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.FastForward(-1).RegisterPm("10.0.0.1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ins.Started("10.0.0.1", 8000, "box1"); err != nil {
+		t.Fatal(err)
+	}
+
+	findings, err := Check(s.FastForward(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected no findings, got %v", findings)
+	}
+}
+
+func TestCheckAndFix(t *testing.T) {
+	s := checkSetup()
+
+	// Instance entry without object
+	orphan := path.Join(ptyInstancesPath("checkcat", "f00", "web"), "999")
+	s, err := s.set(orphan, timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Instance of an unregistered app
+	gone, err := RegisterInstance("gonecat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Running instance claimed by a host which isn't a pm
+	lost, err := RegisterInstance("checkcat", "f00", "web", s.FastForward(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lost, err = lost.Claim("10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lost.Started("10.0.0.9", 8000, "box9"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoint of an unregistered service
+	s = s.FastForward(-1)
+	endpoint := path.Join(servicesPath, "gonesrv", endpointsPath, "10-0-0-1-8000")
+	if s, err = s.set(endpoint, "{}"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Duplicate port and a next port below it
+	port, _, err := s.get(path.Join(appsPath, "checkcat", procsPath, "web", "port"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workerPort := path.Join(appsPath, "checkcat", procsPath, "worker", "port")
+	if s, err = s.set(workerPort, port); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = s.set(nextPortPath, "7000"); err != nil {
+		t.Fatal(err)
+	}
+
+	findings, err := Check(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, f := range findings {
+		paths = append(paths, f.Path)
+	}
+	sort.Strings(paths)
+
+	expected := []string{
+		nextPortPath,
+		workerPort,
+		orphan,
+		gone.Dir.Name,
+		lost.Dir.Name,
+		endpoint,
+	}
+	sort.Strings(expected)
+
+	if len(paths) != len(expected) {
+		t.Fatalf("expected findings for %v, got %v", expected, findings)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("expected finding for %s, got %s", expected[i], paths[i])
+		}
+	}
+
+	for _, f := range findings {
+		if err = f.Apply(); err != nil {
+			t.Errorf("fixing %s: %s", f, err)
+		}
+	}
+
+	s = s.FastForward(-1)
+	if findings, err = Check(s); err != nil || len(findings) != 0 {
+		t.Errorf("expected no findings after fixing, got %v (%v)", findings, err)
+	}
+
+	lost, err = GetInstance(s, lost.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lost.Status != InsStatusFailed {
+		t.Errorf("expected instance of missing pm to be failed, got %s", lost.Status)
+	}
+	newPort, _, err := s.get(workerPort)
+	if err != nil || newPort == port {
+		t.Errorf("expected worker to get a new port, got %s (%v)", newPort, err)
+	}
+}
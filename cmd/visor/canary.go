@@ -0,0 +1,81 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/soundcloud/visor"
+)
+
+// runCanaryStart starts a canary and waits for its
+// instances to publish their endpoints.
+func runCanaryStart(c *cli, s visor.Snapshot, args []string) error {
+	var weight int
+
+	flags := flag.NewFlagSet("canary start", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.IntVar(&weight, "weight", visor.DefaultCanaryWeight, "SRV weight of the canary endpoints")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 4 {
+		return errUsage
+	}
+	args = flags.Args()
+
+	n, err := strconv.Atoi(args[3])
+	if err != nil || n < 1 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	canary := visor.NewCanary(app, args[1], args[2], n, s)
+	canary.Weight = weight
+
+	if canary, err = canary.Start(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "started %d instances of %s@%s, waiting for them to run\n", n, canary, canary.Rev)
+
+	if canary, err = canary.Publish(c.ctx); err != nil {
+		return err
+	}
+	for id := range canary.Endpoints {
+		fmt.Fprintf(c.out, "published %s with weight %d\n", id, canary.Weight)
+	}
+	return nil
+}
+
+func runCanaryPromote(c *cli, s visor.Snapshot, args []string) error {
+	canary, err := getCanary(s, args)
+	if err != nil {
+		return err
+	}
+	if canary, err = canary.Promote(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s@%s is the new head\n", canary, canary.Rev)
+	return nil
+}
+
+func runCanaryAbort(c *cli, s visor.Snapshot, args []string) error {
+	canary, err := getCanary(s, args)
+	if err != nil {
+		return err
+	}
+	_, err = canary.Abort()
+	return err
+}
+
+func getCanary(s visor.Snapshot, args []string) (*visor.Canary, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	return visor.GetCanary(s, args[0], args[1])
+}
@@ -0,0 +1,527 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/soundcloud/visor"
+)
+
+var commands = []*command{
+	{name: "apps", help: "list applications", run: runApps},
+	{name: "app show", args: "<app>", help: "show an application", run: runAppShow},
+	{name: "env get", args: "<app> [<key>]", help: "show the environment of an application", run: runEnvGet},
+	{name: "env set", args: "<app> <key> <value>", help: "set an environment variable", write: true, run: runEnvSet},
+	{name: "env unset", args: "<app> <key>", help: "unset an environment variable", write: true, run: runEnvUnset},
+	{name: "revs", args: "<app>", help: "list the revisions of an application", run: runRevs},
+	{name: "revs keep", args: "<app> <n>", help: "keep the last n revisions of an application, 0 keeps all", write: true, run: runRevsKeep},
+	{name: "revs prune", args: "<app>", help: "unregister revisions not kept by the application", write: true, run: runRevsPrune},
+	{name: "procs", args: "<app>", help: "list the proctypes of an application", run: runProcs},
+	{name: "instances", args: "[<app> [<proctype>]]", help: "list instances", run: runInstances},
+	{name: "instance history", args: "<id>", help: "show the status changes of an instance", run: runInstanceHistory},
+	{name: "scales", args: "<app>", help: "compare desired and live instances per proctype and revision", run: runScales},
+	{name: "scale", args: "<app> <rev> <proctype> <factor>", help: "scale a proctype at a revision", write: true, run: runScale},
+	{name: "canary start", args: "[-weight <weight>] <app> <proctype> <rev> <n>", help: "run n instances of a revision next to the head", write: true, run: runCanaryStart},
+	{name: "canary promote", args: "<app> <proctype>", help: "make the canary revision the head", write: true, run: runCanaryPromote},
+	{name: "canary abort", args: "<app> <proctype>", help: "stop the canary instances", write: true, run: runCanaryAbort},
+	{name: "services", help: "list services", run: runServices},
+	{name: "endpoints", args: "<service>", help: "list the endpoints of a service", run: runEndpoints},
+	{name: "pms", help: "list registered process managers", run: runPms},
+	{name: "proxies", help: "list registered proxies", run: runProxies},
+	{name: "watch", args: "[-app <app>] [-proc <proctype>] [-service <service>] [-type <types>] [-json]", help: "stream registry events", run: runWatch},
+	{name: "serve", args: "[-addr <addr>]", help: "serve the registry over HTTP", write: true, run: runServe},
+	{name: "check", args: "[-fix]", help: "check the registry for inconsistencies", run: runCheck},
+	{name: "gc", args: "[-keep-failed <n>] [-max-exited-age <duration>] [-dry-run] [-interval <duration>]", help: "remove old exited, lost and failed instances", write: true, run: runGC},
+	{name: "reconcile", args: "[-max-restarts <n>] [-window <duration>] [-interval <duration>]", help: "replace missing instances up to the desired scale", write: true, run: runReconcile},
+	{name: "reap", args: "[-ttl <duration>] [-interval <duration>]", help: "mark instances with expired leases as lost", write: true, run: runReap},
+	{name: "schema verify", help: "verify the coordinator schema version", run: runSchemaVerify},
+	{name: "version", help: "print the version"},
+	{name: "help", help: "print this help"},
+}
+
+func table(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+}
+
+func runApps(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	apps, err := visor.Apps(s)
+	if err != nil {
+		return err
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+
+	w := table(c.out)
+	fmt.Fprintln(w, "NAME\tHEAD\tSTACK\tDEPLOY\tREPO")
+	for _, app := range apps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", app.Name, app.Head, app.Stack, app.DeployType, app.RepoUrl)
+	}
+	return w.Flush()
+}
+
+func runAppShow(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	env, err := app.EnvironmentVars()
+	if err != nil {
+		return err
+	}
+	revs, err := visor.AppRevisions(s, app)
+	if err != nil {
+		return err
+	}
+	ptys, err := app.GetProcTypes()
+	if err != nil {
+		return err
+	}
+
+	w := table(c.out)
+	fmt.Fprintf(w, "name:\t%s\n", app.Name)
+	fmt.Fprintf(w, "repo:\t%s\n", app.RepoUrl)
+	fmt.Fprintf(w, "stack:\t%s\n", app.Stack)
+	fmt.Fprintf(w, "deploy:\t%s\n", app.DeployType)
+	fmt.Fprintf(w, "head:\t%s\n", app.Head)
+	fmt.Fprintf(w, "env:\t%d vars\n", len(env))
+	if app.KeepRevisions > 0 {
+		fmt.Fprintf(w, "keep:\t%d revs\n", app.KeepRevisions)
+	}
+	fmt.Fprintf(w, "revs:\t%s\n", joinNames(len(revs), func(i int) string { return revs[i].Ref }))
+	fmt.Fprintf(w, "procs:\t%s\n", joinNames(len(ptys), func(i int) string { return ptys[i].Name }))
+	fmt.Fprintf(w, "rev:\t%d\n", s.Rev)
+	return w.Flush()
+}
+
+func runEnvGet(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		val, err := app.GetEnvironmentVar(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, val)
+		return nil
+	}
+
+	env, err := app.EnvironmentVars()
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(c.out, "%s=%s\n", k, env[k])
+	}
+	return nil
+}
+
+func runEnvSet(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	app, err = app.SetEnvironmentVar(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s=%s (rev %d)\n", args[1], args[2], app.Dir.Snapshot.Rev)
+	return nil
+}
+
+func runEnvUnset(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	_, err = app.DelEnvironmentVar(args[1])
+	return err
+}
+
+func runRevs(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	revs, err := visor.AppRevisions(s, app)
+	if err != nil {
+		return err
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Ref < revs[j].Ref })
+
+	w := table(c.out)
+	fmt.Fprintln(w, "REF\tHEAD\tARCHIVE")
+	for _, rev := range revs {
+		head := ""
+		if rev.Ref == app.Head {
+			head = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", rev.Ref, head, rev.ArchiveUrl)
+	}
+	return w.Flush()
+}
+
+func runRevsKeep(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	_, err = app.SetKeepRevisions(n)
+	return err
+}
+
+func runRevsPrune(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	removed, err := visor.PruneRevisions(app)
+	for _, rev := range removed {
+		fmt.Fprintln(c.out, rev.Ref)
+	}
+	return err
+}
+
+func runProcs(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	ptys, err := app.GetProcTypes()
+	if err != nil {
+		return err
+	}
+	sort.Slice(ptys, func(i, j int) bool { return ptys[i].Name < ptys[j].Name })
+
+	w := table(c.out)
+	fmt.Fprintln(w, "NAME\tPORT\tINSTANCES")
+	for _, pty := range ptys {
+		n, err := pty.NumInstances()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", pty.Name, pty.Port, n)
+	}
+	return w.Flush()
+}
+
+func runInstances(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) > 2 {
+		return errUsage
+	}
+
+	var apps []*visor.App
+
+	if len(args) > 0 {
+		app, err := visor.GetApp(s, args[0])
+		if err != nil {
+			return err
+		}
+		apps = []*visor.App{app}
+	} else {
+		var err error
+		if apps, err = visor.Apps(s); err != nil {
+			return err
+		}
+	}
+
+	instances := []*visor.Instance{}
+
+	for _, app := range apps {
+		ptys, err := app.GetProcTypes()
+		if err != nil {
+			return err
+		}
+		for _, pty := range ptys {
+			if len(args) == 2 && pty.Name != args[1] {
+				continue
+			}
+			ins, err := pty.GetInstances()
+			if err != nil {
+				return err
+			}
+			instances = append(instances, ins...)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Id < instances[j].Id })
+
+	w := table(c.out)
+	fmt.Fprintln(w, "ID\tAPP\tREV\tPROC\tSTATUS\tHOST\tADDR")
+	for _, ins := range instances {
+		addr := ""
+		if ins.Ip != "" {
+			addr = ins.Ip + ":" + strconv.Itoa(ins.Port)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", ins.Id, ins.AppName, ins.RevisionName, ins.ProcessName, ins.Status, ins.Host, addr)
+	}
+	return w.Flush()
+}
+
+func runInstanceHistory(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	ins, err := visor.GetInstance(s, id)
+	if err != nil {
+		return err
+	}
+	history, err := ins.History()
+	if err != nil {
+		return err
+	}
+
+	w := table(c.out)
+	fmt.Fprintln(w, "TIME\tFROM\tTO\tHOST")
+	for _, t := range history {
+		from := string(t.From)
+		if from == "" {
+			from = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Time, from, t.To, t.Host)
+	}
+	return w.Flush()
+}
+
+func runScale(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 4 {
+		return errUsage
+	}
+	factor, err := strconv.Atoi(args[3])
+	if err != nil || factor < 0 {
+		return errUsage
+	}
+	_, current, err := visor.Scale(args[0], args[1], args[2], factor, s)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "scaled %s:%s@%s from %d to %d\n", args[0], args[2], args[1], current, factor)
+	return nil
+}
+
+func runScales(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	app, err := visor.GetApp(s, args[0])
+	if err != nil {
+		return err
+	}
+	revs, err := visor.AppRevisions(s, app)
+	if err != nil && !visor.IsErrNoEnt(err) {
+		return err
+	}
+	ptys, err := app.GetProcTypes()
+	if err != nil {
+		return err
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Ref < revs[j].Ref })
+	sort.Slice(ptys, func(i, j int) bool { return ptys[i].Name < ptys[j].Name })
+
+	w := table(c.out)
+	fmt.Fprintln(w, "PROC\tREV\tWANT\tHAVE")
+	for _, pty := range ptys {
+		for _, rev := range revs {
+			want, _, err := s.GetDesiredScale(app.Name, rev.Ref, pty.Name)
+			if visor.IsErrNoEnt(err) {
+				want = -1
+			} else if err != nil {
+				return err
+			}
+			have, _, err := s.GetScale(app.Name, rev.Ref, pty.Name)
+			if err != nil {
+				return err
+			}
+			if want < 0 && have == 0 {
+				continue
+			}
+			wantStr := "-"
+			if want >= 0 {
+				wantStr = strconv.Itoa(want)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", pty.Name, rev.Ref, wantStr, have)
+		}
+	}
+	return w.Flush()
+}
+
+func runServices(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	srvs, err := visor.Services(s)
+	if err != nil {
+		return err
+	}
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Name < srvs[j].Name })
+
+	for _, srv := range srvs {
+		fmt.Fprintln(c.out, srv.Name)
+	}
+	return nil
+}
+
+func runEndpoints(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	srv, err := visor.GetService(s, args[0])
+	if err != nil {
+		return err
+	}
+	eps, err := srv.GetEndpoints()
+	if err != nil {
+		return err
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Id() < eps[j].Id() })
+
+	w := table(c.out)
+	fmt.Fprintln(w, "ID\tADDR\tPORT\tPRIORITY\tWEIGHT")
+	for _, ep := range eps {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", ep.Id(), ep.Addr, ep.Port, ep.Priority, ep.Weight)
+	}
+	return w.Flush()
+}
+
+func runPms(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return printList(c.out, s.GetPms)
+}
+
+func runProxies(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return printList(c.out, s.GetProxies)
+}
+
+func runSchemaVerify(c *cli, s visor.Snapshot, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	version, err := visor.VerifySchema(s)
+	if err == visor.ErrSchemaMism {
+		return fmt.Errorf("coordinator schema version %d doesn't match %d", version, visor.SchemaVersion)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "schema version %d ok\n", visor.SchemaVersion)
+	return nil
+}
+
+// runCheck reports the inconsistencies found by visor.Check, and
+// fixes them with -fix. It fails if any inconsistency is left.
+func runCheck(c *cli, s visor.Snapshot, args []string) error {
+	var fix bool
+
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.BoolVar(&fix, "fix", false, "fix the inconsistencies found")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	if fix && c.rev >= 0 {
+		return fmt.Errorf("-fix can't be used with -rev")
+	}
+
+	findings, err := visor.Check(s)
+	if err != nil {
+		return err
+	}
+	left := 0
+
+	for _, f := range findings {
+		if !fix {
+			fmt.Fprintln(c.out, f)
+			left++
+			continue
+		}
+		if err := f.Apply(); err != nil {
+			fmt.Fprintf(c.out, "%s: %s, fixing failed: %s\n", f.Path, f.Problem, err)
+			left++
+		} else {
+			fmt.Fprintf(c.out, "%s: %s, fixed: %s\n", f.Path, f.Problem, f.Fix)
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d inconsistencies left", left)
+	}
+	return nil
+}
+
+func printList(w io.Writer, list func() ([]string, error)) error {
+	names, err := list()
+	if visor.IsErrNoEnt(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+	return nil
+}
+
+func joinNames(n int, name func(i int) string) string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = name(i)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
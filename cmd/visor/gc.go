@@ -0,0 +1,54 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// runGC removes the exited, lost and failed instances no longer retained,
+// once, or at every -interval until interrupted.
+func runGC(c *cli, s visor.Snapshot, args []string) error {
+	var (
+		p        visor.GCPolicy
+		interval time.Duration
+	)
+
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.IntVar(&p.KeepFailed, "keep-failed", 10, "number of failures to keep per proctype, 0 keeps all")
+	flags.DurationVar(&p.MaxExitedAge, "max-exited-age", 24*time.Hour, "age after which exited and lost instances are removed, 0 keeps all")
+	flags.BoolVar(&p.DryRun, "dry-run", false, "only print the instances which would be removed")
+	flags.DurationVar(&interval, "interval", 0, "run at every interval until interrupted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	report := func(garbage []*visor.Garbage) {
+		for _, g := range garbage {
+			fmt.Fprintln(c.out, g)
+		}
+	}
+
+	if interval <= 0 {
+		garbage, err := visor.GC(s, p)
+		report(garbage)
+		return err
+	}
+
+	collector := visor.NewCollector(s, p, interval)
+	collector.OnCollect = report
+	collector.OnError = func(err error) {
+		fmt.Fprintf(c.errout, "visor: gc failed: %s\n", err)
+	}
+	collector.Run(c.ctx)
+
+	return nil
+}
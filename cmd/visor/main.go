@@ -0,0 +1,170 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+// Command visor inspects and mutates the visor registry.
+//
+// Usage:
+//
+//	visor [-uri <uri>] [-root <root>] [-rev <rev>] <command> [args]
+//
+// Run visor help for the list of commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/soundcloud/visor"
+)
+
+// Set *automatically* at link time (see Makefile)
+var Version string
+
+var errUsage = errors.New("invalid arguments")
+
+// cli holds the global options and output of a command invocation.
+type cli struct {
+	ctx    context.Context
+	uri    string
+	root   string
+	rev    int64
+	out    io.Writer
+	errout io.Writer
+}
+
+type command struct {
+	name  string
+	args  string
+	help  string
+	write bool
+	run   func(c *cli, s visor.Snapshot, args []string) error
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+func run(ctx context.Context, argv []string, stdout, stderr io.Writer) int {
+	c := &cli{ctx: ctx, out: stdout, errout: stderr}
+
+	flags := flag.NewFlagSet("visor", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&c.uri, "uri", visor.DefaultUri, "coordinator uri")
+	flags.StringVar(&c.root, "root", visor.DefaultRoot, "coordinator root path")
+	flags.Int64Var(&c.rev, "rev", -1, "read at the given coordinator revision")
+	flags.Usage = func() {
+		usage(stderr)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(argv); err != nil {
+		return 2
+	}
+	args := flags.Args()
+
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cmd, args := lookup(args)
+	if cmd == nil {
+		fmt.Fprintf(stderr, "visor: unknown command '%s'\n", strings.Join(flags.Args(), " "))
+		usage(stderr)
+		return 2
+	}
+	if cmd.run == nil {
+		// Commands which don't need a coordinator
+		if cmd.name == "version" {
+			fmt.Fprintln(stdout, versionString())
+		} else {
+			usage(stdout)
+		}
+		return 0
+	}
+
+	if cmd.write && c.rev >= 0 {
+		fmt.Fprintf(stderr, "visor: %s can't be used with -rev\n", cmd.name)
+		return 2
+	}
+
+	s, err := c.snapshot()
+	if err == nil {
+		err = cmd.run(c, s, args)
+	}
+	if err == errUsage {
+		fmt.Fprintf(stderr, "usage: visor %s %s\n", cmd.name, cmd.args)
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(stderr, "visor: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// snapshot dials the coordinator and returns a snapshot
+// at the revision given with -rev, or at the latest one.
+func (c *cli) snapshot() (s visor.Snapshot, err error) {
+	return c.snapshotAt(c.rev)
+}
+
+// snapshotAt dials the coordinator and returns a snapshot at
+// rev, or at the latest revision if rev is negative.
+func (c *cli) snapshotAt(rev int64) (s visor.Snapshot, err error) {
+	s, err = visor.DialUri(c.uri, c.root)
+	if err != nil {
+		return
+	}
+	if rev >= 0 {
+		if rev > s.Rev {
+			return s, fmt.Errorf("revision %d is ahead of the coordinator (%d)", rev, s.Rev)
+		}
+		s = s.Rewind(rev)
+	}
+	return
+}
+
+// lookup returns the command named by the first one or two
+// arguments, along with the remaining arguments.
+func lookup(args []string) (*command, []string) {
+	if len(args) > 1 {
+		name := args[0] + " " + args[1]
+		for _, cmd := range commands {
+			if cmd.name == name {
+				return cmd, args[2:]
+			}
+		}
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd, args[1:]
+		}
+	}
+	return nil, nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: visor [-uri <uri>] [-root <root>] [-rev <rev>] <command> [args]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-40s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.help)
+	}
+	fmt.Fprintln(w)
+}
+
+func versionString() string {
+	v := Version
+	if v == "" {
+		v = "dev"
+	}
+	return fmt.Sprintf("visor %s (schema %d)", v, visor.SchemaVersion)
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/visor"
+)
+
+const testUri = "mem:cli-test"
+
+func cliSetup(t *testing.T) (s visor.Snapshot) {
+	s, err := visor.DialUri(testUri, "/cli-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.ResetCoordinator(); err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(-1)
+
+	rev, err := visor.Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev)
+
+	app, err := visor.NewApp("clicat", "git://clicat", "stack", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = app.SetEnvironmentVar("MEOW", "loud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev1, err := visor.NewRevision(app, "f00", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = visor.NewProcType(app, "web", rev1.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.FastForward(-1)
+}
+
+func runCli(t *testing.T, args ...string) (code int, stdout, stderr string) {
+	out := &bytes.Buffer{}
+	errout := &bytes.Buffer{}
+
+	args = append([]string{"-uri", testUri, "-root", "/cli-test"}, args...)
+	code = run(context.Background(), args, out, errout)
+
+	return code, out.String(), errout.String()
+}
+
+func TestCliReadCommands(t *testing.T) {
+	cliSetup(t)
+
+	expected := map[string]string{
+		"apps":          "clicat",
+		"app show":      "f00",
+		"env get":       "MEOW=loud",
+		"revs":          "f00",
+		"procs":         "web",
+		"schema verify": "ok",
+	}
+	for cmd, substr := range expected {
+		args := strings.Fields(cmd)
+		if cmd != "apps" && cmd != "schema verify" {
+			args = append(args, "clicat")
+		}
+		code, out, errout := runCli(t, args...)
+		if code != 0 {
+			t.Errorf("%s: exit code %d: %s", cmd, code, errout)
+		}
+		if !strings.Contains(out, substr) {
+			t.Errorf("%s: expected output to contain '%s', got:\n%s", cmd, substr, out)
+		}
+	}
+}
+
+func TestCliEnvAndScale(t *testing.T) {
+	cliSetup(t)
+
+	if code, _, errout := runCli(t, "env", "set", "clicat", "PURR", "soft"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, errout)
+	}
+	if _, out, _ := runCli(t, "env", "get", "clicat", "PURR"); strings.TrimSpace(out) != "soft" {
+		t.Errorf("expected 'soft', got '%s'", out)
+	}
+	if code, _, errout := runCli(t, "env", "unset", "clicat", "PURR"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, errout)
+	}
+	if code, _, _ := runCli(t, "env", "get", "clicat", "PURR"); code != 1 {
+		t.Errorf("expected exit code 1 for unset variable, got %d", code)
+	}
+
+	if code, _, errout := runCli(t, "scale", "clicat", "f00", "web", "2"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, errout)
+	}
+	_, out, _ := runCli(t, "instances", "clicat", "web")
+	if n := strings.Count(out, "clicat"); n != 2 {
+		t.Errorf("expected 2 instances, got:\n%s", out)
+	}
+	_, out, _ = runCli(t, "scales", "clicat")
+	if fields := strings.Fields(out); len(fields) != 8 || fields[6] != "2" || fields[7] != "2" {
+		t.Errorf("expected want 2, have 2, got:\n%s", out)
+	}
+}
+
+func TestCliHistoricalRev(t *testing.T) {
+	s := cliSetup(t)
+
+	if code, _, errout := runCli(t, "env", "set", "clicat", "PURR", "soft"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, errout)
+	}
+
+	rev := []string{"-rev", strconv.FormatInt(s.Rev, 10)}
+
+	_, out, _ := runCli(t, append(rev, "env", "get", "clicat")...)
+	if strings.Contains(out, "PURR") {
+		t.Errorf("expected PURR to be unset at rev %d, got:\n%s", s.Rev, out)
+	}
+	if code, _, _ := runCli(t, append(rev, "env", "set", "clicat", "PURR", "hard")...); code != 2 {
+		t.Errorf("expected writes at a historical rev to be refused, got exit code %d", code)
+	}
+}
+
+func TestCliCheck(t *testing.T) {
+	s := cliSetup(t)
+
+	if code, out, errout := runCli(t, "check"); code != 0 {
+		t.Fatalf("expected no inconsistencies, got exit code %d: %s%s", code, out, errout)
+	}
+	if _, err := visor.RegisterInstance("gonecat", "f00", "web", s); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, out, _ := runCli(t, "check"); code != 1 || !strings.Contains(out, "gonecat") {
+		t.Errorf("expected orphaned instance to be reported, got exit code %d: %s", code, out)
+	}
+	if code, out, errout := runCli(t, "check", "-fix"); code != 0 || !strings.Contains(out, "fixed") {
+		t.Errorf("expected orphaned instance to be fixed, got exit code %d: %s%s", code, out, errout)
+	}
+	if code, out, _ := runCli(t, "check"); code != 0 {
+		t.Errorf("expected no inconsistencies after fixing, got exit code %d: %s", code, out)
+	}
+}
+
+func TestCliGC(t *testing.T) {
+	s := cliSetup(t)
+
+	var ins *visor.Instance
+
+	// The first failure is older than the second
+	for i := 0; i < 2; i++ {
+		failed, err := visor.RegisterInstance("clicat", "f00", "web", s.FastForward(-1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed, err = failed.Claim("10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = failed.Failed("10.0.0.1", errors.New("oops")); err != nil {
+			t.Fatal(err)
+		}
+		if ins == nil {
+			ins = failed
+		}
+	}
+
+	id := strconv.FormatInt(ins.Id, 10)
+
+	if code, out, errout := runCli(t, "gc", "-keep-failed", "1", "-dry-run"); code != 0 || !strings.HasPrefix(out, id+" ") {
+		t.Errorf("expected instance %s to be reported, got exit code %d: %s%s", id, code, out, errout)
+	}
+	if _, err := visor.GetInstance(s.FastForward(-1), ins.Id); err != nil {
+		t.Errorf("expected dry run to keep the instance, got %v", err)
+	}
+	if code, out, errout := runCli(t, "gc", "-keep-failed", "1"); code != 0 || !strings.HasPrefix(out, id+" ") {
+		t.Errorf("expected instance %s to be removed, got exit code %d: %s%s", id, code, out, errout)
+	}
+	if _, err := visor.GetInstance(s.FastForward(-1), ins.Id); !visor.IsErrNoEnt(err) {
+		t.Errorf("expected instance to be removed, got %v", err)
+	}
+}
+
+func TestCliInstanceHistory(t *testing.T) {
+	s := cliSetup(t)
+
+	ins, err := visor.RegisterInstance("clicat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ins.Failed("10.0.0.1", errors.New("oops")); err != nil {
+		t.Fatal(err)
+	}
+
+	code, out, errout := runCli(t, "instance", "history", strconv.FormatInt(ins.Id, 10))
+	if code != 0 {
+		t.Fatalf("expected history to be shown, got exit code %d: %s", code, errout)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected header and 3 transitions, got %q", out)
+	}
+	if fields := strings.Fields(lines[3]); len(fields) != 4 || fields[1] != "claimed" || fields[2] != "failed" || fields[3] != "10.0.0.1" {
+		t.Errorf("expected claimed -> failed by 10.0.0.1, got %q", lines[3])
+	}
+}
+
+func TestCliRevsPrune(t *testing.T) {
+	s := cliSetup(t)
+
+	app, err := visor.GetApp(s, "clicat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = visor.NewRevision(app, "f01", s).Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, errout := runCli(t, "revs", "keep", "clicat", "1"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, errout)
+	}
+	if _, out, _ := runCli(t, "app", "show", "clicat"); !strings.Contains(out, "1 revs") {
+		t.Errorf("expected retention to be shown, got:\n%s", out)
+	}
+	code, out, errout := runCli(t, "revs", "prune", "clicat")
+	if code != 0 || strings.TrimSpace(out) != "f00" {
+		t.Errorf("expected f00 to be pruned, got exit code %d: %s%s", code, out, errout)
+	}
+	if _, out, _ = runCli(t, "revs", "clicat"); strings.Contains(out, "f00") {
+		t.Errorf("expected f00 to be unregistered, got:\n%s", out)
+	}
+}
+
+func TestCliCanaryAbort(t *testing.T) {
+	s := cliSetup(t)
+
+	app, err := visor.GetApp(s, "clicat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = visor.NewRevision(app, "f01", s).Register(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = visor.NewCanary(app, "web", "f01", 1, s.FastForward(-1)).Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, errout := runCli(t, "canary", "abort", "clicat", "web"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, errout)
+	}
+	canary, err := visor.GetCanary(s.FastForward(-1), "clicat", "web")
+	if err != nil || canary.State != visor.CanaryAborted {
+		t.Errorf("expected canary to be aborted, got %v (%v)", canary, err)
+	}
+	if code, _, _ := runCli(t, "canary", "promote", "clicat", "web"); code != 1 {
+		t.Errorf("expected aborted canary not to be promoted, got exit code %d", code)
+	}
+}
+
+func TestCliUsage(t *testing.T) {
+	if code, _, _ := runCli(t, "cows"); code != 2 {
+		t.Errorf("expected exit code 2 for unknown command, got %d", code)
+	}
+	if code, _, errout := runCli(t, "revs"); code != 2 || !strings.Contains(errout, "usage: visor revs <app>") {
+		t.Errorf("expected usage error, got %d: %s", code, errout)
+	}
+	if code, out, _ := runCli(t, "version"); code != 0 || !strings.HasPrefix(out, "visor dev") {
+		t.Errorf("unexpected version output %d: %s", code, out)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// runReap marks the instances with expired leases as lost,
+// once, or at every -interval until interrupted.
+func runReap(c *cli, s visor.Snapshot, args []string) error {
+	var ttl, interval time.Duration
+
+	flags := flag.NewFlagSet("reap", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.DurationVar(&ttl, "ttl", visor.DefaultLeaseTTL, "time after which the lease of an instance expires")
+	flags.DurationVar(&interval, "interval", 0, "run at every interval until interrupted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	report := func(lost []*visor.Instance) {
+		for _, ins := range lost {
+			fmt.Fprintf(c.out, "%d %s lost\n", ins.Id, ins.RefString())
+		}
+	}
+
+	if interval <= 0 {
+		lost, err := visor.Reap(s, ttl)
+		report(lost)
+		return err
+	}
+
+	reaper := visor.NewReaper(s, ttl, interval)
+	reaper.OnLost = report
+	reaper.OnError = func(err error) {
+		fmt.Fprintf(c.errout, "visor: reaping failed: %s\n", err)
+	}
+	reaper.Run(c.ctx)
+
+	return nil
+}
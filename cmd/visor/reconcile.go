@@ -0,0 +1,55 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// runReconcile registers replacements for missing instances, once,
+// or at every -interval until interrupted.
+func runReconcile(c *cli, s visor.Snapshot, args []string) error {
+	var (
+		maxRestarts      int
+		window, interval time.Duration
+	)
+
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.IntVar(&maxRestarts, "max-restarts", 10, "instances registered per proctype and revision within -window")
+	flags.DurationVar(&window, "window", 10*time.Minute, "window of -max-restarts")
+	flags.DurationVar(&interval, "interval", 0, "run at every interval until interrupted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	r := visor.NewReconciler(s, interval)
+	r.MaxRestarts, r.Window = maxRestarts, window
+
+	report := func(started []*visor.Instance) {
+		for _, ins := range started {
+			fmt.Fprintf(c.out, "%d %s registered\n", ins.Id, ins.RefString())
+		}
+	}
+
+	if interval <= 0 {
+		started, err := r.Reconcile()
+		report(started)
+		return err
+	}
+
+	r.OnRestart = report
+	r.OnError = func(err error) {
+		fmt.Fprintf(c.errout, "visor: reconciling failed: %s\n", err)
+	}
+	r.Run(c.ctx)
+
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/soundcloud/visor"
+	"github.com/soundcloud/visor/api"
+)
+
+// runServe serves the registry over HTTP until interrupted.
+func runServe(c *cli, s visor.Snapshot, args []string) error {
+	var addr string
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.StringVar(&addr, "addr", ":8080", "address to listen on")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	server := &http.Server{Addr: addr, Handler: api.NewServer(s)}
+	errch := make(chan error, 1)
+
+	go func() {
+		errch <- server.ListenAndServe()
+	}()
+	fmt.Fprintf(c.errout, "visor: serving %s%s on %s\n", c.uri, c.root, addr)
+
+	select {
+	case err := <-errch:
+		return err
+	case <-c.ctx.Done():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
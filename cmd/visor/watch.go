@@ -0,0 +1,174 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+const (
+	reconnectBackoff    = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// runWatch streams registry events until interrupted. Events are
+// watched from the revision given with -rev, or from the latest one.
+// When the connection to the coordinator is lost, it is dialed again
+// and watching resumes after the last printed event.
+func runWatch(c *cli, s visor.Snapshot, args []string) error {
+	var (
+		types  string
+		asJSON bool
+		f      visor.Filter
+	)
+
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.SetOutput(c.errout)
+	flags.StringVar(&f.App, "app", "", "only show events of the given app")
+	flags.StringVar(&f.Proctype, "proc", "", "only show events of the given proctype")
+	flags.StringVar(&f.Service, "service", "", "only show events of the given service")
+	flags.StringVar(&types, "type", "", "comma-separated list of event types to show")
+	flags.BoolVar(&asJSON, "json", false, "print events as JSON lines")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	if types != "" {
+		for _, t := range strings.Split(types, ",") {
+			f.Types = append(f.Types, visor.EventType(strings.TrimSpace(t)))
+		}
+	}
+
+	rev := s.Rev
+	backoff := reconnectBackoff
+
+	for {
+		start := rev
+		err := watch(c, s, f, asJSON, &rev)
+
+		for {
+			if c.ctx.Err() != nil {
+				return nil
+			}
+			if visor.IsErrRevTooOld(err) {
+				return fmt.Errorf("can't resume after revision %d, events have been missed", rev)
+			}
+			if rev != start {
+				// Events were received since the last reconnect
+				backoff = reconnectBackoff
+				start = rev
+			}
+			fmt.Fprintf(c.errout, "visor: watch interrupted after revision %d: %v, reconnecting in %s\n", rev, err, backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+				return nil
+			}
+			if backoff *= 2; backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+
+			if s, err = c.snapshotAt(rev); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// watch prints the events matching f, and updates rev to the revision
+// of the last printed event. As events are received in revision order,
+// no matching event up to rev is left to print when resuming after rev.
+func watch(c *cli, s visor.Snapshot, f visor.Filter, asJSON bool, rev *int64) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	listener := make(chan *visor.Event)
+	errch := make(chan error, 1)
+
+	go func() {
+		errch <- visor.SubscribeContext(ctx, s, f, listener)
+	}()
+
+	for e := range listener {
+		if err := printEvent(c.out, e, asJSON); err != nil {
+			return err
+		}
+		*rev = e.Rev
+	}
+	return <-errch
+}
+
+func printEvent(w io.Writer, e *visor.Event, asJSON bool) error {
+	if asJSON {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	_, err := fmt.Fprintln(w, formatEvent(e))
+	return err
+}
+
+// formatEvent returns a one-line description of an event, as in
+//
+//	1234 instance-start       cat:web@f00 #1207 box12.example.com
+func formatEvent(e *visor.Event) string {
+	fields := []string{fmt.Sprintf("%-6d %-20s", e.Rev, e.Type)}
+
+	if ins, ok := e.Source.(*visor.Instance); ok {
+		fields = append(fields, fmt.Sprintf("%s:%s@%s", ins.AppName, ins.ProcessName, ins.RevisionName), "#"+strconv.FormatInt(ins.Id, 10))
+		if ins.Host != "" {
+			fields = append(fields, ins.Host)
+		} else if e.Path.Host != nil {
+			fields = append(fields, *e.Path.Host)
+		}
+		return strings.Join(fields, " ")
+	}
+
+	p := e.Path
+
+	if p.App != nil {
+		ref := *p.App
+		if p.Proctype != nil {
+			ref += ":" + *p.Proctype
+		}
+		if p.Revision != nil {
+			ref += "@" + *p.Revision
+		}
+		fields = append(fields, ref)
+	}
+	if p.Env != nil {
+		fields = append(fields, *p.Env)
+	}
+	if p.Service != nil {
+		ref := *p.Service
+		if p.Endpoint != nil {
+			ref += "/" + *p.Endpoint
+		}
+		fields = append(fields, ref)
+	}
+	if p.Instance != nil {
+		fields = append(fields, "#"+*p.Instance)
+	}
+	if p.Host != nil {
+		fields = append(fields, *p.Host)
+	}
+	if e.Type == visor.EvAppHead {
+		fields = append(fields, e.Body)
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/visor"
+)
+
+// watchCli runs the watch command with args in the background
+// and returns its output after fn has been run.
+func watchCli(t *testing.T, rev int64, args []string, fn func()) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &bytes.Buffer{}
+	c := &cli{ctx: ctx, uri: testUri, root: "/cli-test", rev: rev, out: out, errout: &bytes.Buffer{}}
+
+	s, err := c.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- runWatch(c, s, args)
+	}()
+
+	fn()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestCliWatch(t *testing.T) {
+	s := cliSetup(t)
+
+	out := watchCli(t, -1, []string{"-app", "clicat", "-type", "instance-register"}, func() {
+		time.Sleep(10 * time.Millisecond)
+
+		if _, err := visor.RegisterInstance("clidog", "f00", "web", s); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := visor.RegisterInstance("clicat", "f00", "web", s.FastForward(-1)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one event, got:\n%s", out)
+	}
+	if !strings.Contains(lines[0], "instance-register") || !strings.Contains(lines[0], "clicat:web@f00 #") {
+		t.Errorf("unexpected output %s", lines[0])
+	}
+}
+
+func TestCliWatchResumeJSON(t *testing.T) {
+	s := cliSetup(t)
+
+	app, err := visor.GetApp(s, "clicat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.SetHead("f00"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := watchCli(t, s.Rev, []string{"-json", "-type", "app-head-change"}, func() {})
+
+	e := &visor.Event{}
+	if err = json.Unmarshal([]byte(strings.TrimSpace(out)), e); err != nil {
+		t.Fatalf("expected a single JSON event, got %s: %s", out, err)
+	}
+	if e.Type != visor.EvAppHead || e.Body != "f00" {
+		t.Errorf("unexpected event %#v", e)
+	}
+}
+
+func TestCliWatchAppResume(t *testing.T) {
+	s := cliSetup(t)
+
+	ins, err := visor.RegisterInstance("clicat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := visor.GetApp(ins.Dir.Snapshot, "clicat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.SetEnvironmentVar("PURR", "soft"); err != nil {
+		t.Fatal(err)
+	}
+
+	// App and instance events come from different directories
+	args := []string{"-app", "clicat", "-type", "instance-register,app-env-set"}
+	all := strings.Split(strings.TrimSpace(watchCli(t, s.Rev, args, func() {})), "\n")
+	if len(all) != 2 || !strings.Contains(all[0], "instance-register") || !strings.Contains(all[1], "app-env-set") {
+		t.Fatalf("expected instance and env events in revision order, got:\n%s", strings.Join(all, "\n"))
+	}
+
+	// Resuming after the first event prints the second one
+	rev, err := strconv.ParseInt(strings.Fields(all[0])[0], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := strings.TrimSpace(watchCli(t, rev, args, func() {})); out != all[1] {
+		t.Errorf("expected resuming after revision %d to print %q, got %q", rev, all[1], out)
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	app, host := "cat", "10.0.0.1"
+
+	line := formatEvent(&visor.Event{Type: visor.EvPmReg, Rev: 12, Path: visor.EventData{Host: &host}})
+	if !strings.HasPrefix(line, "12") || !strings.HasSuffix(line, "pm-register          10.0.0.1") {
+		t.Errorf("unexpected format '%s'", line)
+	}
+
+	line = formatEvent(&visor.Event{Type: visor.EvAppHead, Rev: 13, Body: "f00", Path: visor.EventData{App: &app}})
+	if !strings.HasSuffix(line, "cat f00") {
+		t.Errorf("unexpected format '%s'", line)
+	}
+}
@@ -6,22 +6,23 @@
 package visor
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/soundcloud/doozer"
+	"path"
 	"strings"
 )
 
-// Conn is a wrapper around doozer.Conn,
+// Conn is a wrapper around a Backend,
 // providing some additional and sometimes
 // higher-level methods.
 type conn struct {
 	Addr string
 	Root string
-	conn *doozer.Conn
+	conn Backend
 }
 
-// Set calls (*doozer.Conn).Set with a prefixed path
+// Set calls (Backend).Set with a prefixed path
 func (c *conn) Set(path string, rev int64, value []byte) (newrev int64, err error) {
 	path = c.prefixPath(path)
 	if !pathRe.MatchString(path) {
@@ -38,7 +39,7 @@ func (c *conn) Set(path string, rev int64, value []byte) (newrev int64, err erro
 	return
 }
 
-// Stat calls (*doozer.Conn).Stat with a prefixed path
+// Stat calls (Backend).Stat with a prefixed path
 func (c *conn) Stat(path string, rev *int64) (len int, pathrev int64, err error) {
 	return c.conn.Stat(c.prefixPath(path), rev)
 }
@@ -75,12 +76,12 @@ func (c *conn) Create(path string, value []byte) (newrev int64, err error) {
 	return c.Set(path, newrev, value)
 }
 
-// Rev is a wrapper around (*doozer.Conn).Rev.
+// Rev is a wrapper around (Backend).Rev.
 func (c *conn) Rev() (int64, error) {
 	return c.conn.Rev()
 }
 
-// Get is a wrapper around (*doozer.Conn).Get with a prefixed path.
+// Get is a wrapper around (Backend).Get with a prefixed path.
 func (c *conn) Get(path string, rev *int64) (value []byte, filerev int64, err error) {
 	value, filerev, err = c.conn.Get(c.prefixPath(path), rev)
 
@@ -96,7 +97,7 @@ func (c *conn) Get(path string, rev *int64) (value []byte, filerev int64, err er
 	return
 }
 
-// Getdir is a wrapper around (*doozer.Conn).Getdir with a prefixed path.
+// Getdir is a wrapper around (Backend).Getdir with a prefixed path.
 func (c *conn) Getdir(path string, rev int64) (names []string, err error) {
 	type reply struct {
 		name  string
@@ -110,7 +111,7 @@ func (c *conn) Getdir(path string, rev int64) (names []string, err error) {
 	path = c.prefixPath(path)
 	size, _, err := c.conn.Stat(path, &rev)
 
-	if err == doozer.ErrNoEnt || (err != nil && err.Error() == "NOENT") {
+	if IsErrNoEnt(err) {
 		return nil, NewError(ErrNoEnt, fmt.Sprintf(`dir "%s" not found at %d`, path, rev))
 	}
 	names = make([]string, size)
@@ -137,48 +138,110 @@ func (c *conn) Getdir(path string, rev int64) (names []string, err error) {
 	return
 }
 
-// Wait is a wrapper around (*doozer.Conn).Wait
-func (c *conn) Wait(path string, rev int64) (event doozer.Event, err error) {
+// Wait is a wrapper around (Backend).Wait
+func (c *conn) Wait(path string, rev int64) (event BackendEvent, err error) {
+	return c.WaitContext(context.Background(), path, rev)
+}
+
+// WaitContext is like Wait, but returns ctx.Err() once ctx is done.
+func (c *conn) WaitContext(ctx context.Context, path string, rev int64) (event BackendEvent, err error) {
+	type reply struct {
+		event BackendEvent
+		err   error
+	}
+
 	path = c.prefixPath(path)
-	event, err = c.conn.Wait(path, rev)
+
+	if w, ok := c.conn.(ContextWaiter); ok {
+		event, err = w.WaitContext(ctx, path, rev)
+	} else if ctx.Done() == nil {
+		event, err = c.conn.Wait(path, rev)
+	} else {
+		replies := make(chan reply, 1)
+
+		go func() {
+			event, err := c.conn.Wait(path, rev)
+			replies <- reply{event, err}
+		}()
+
+		select {
+		case r := <-replies:
+			event, err = r.event, r.err
+		case <-ctx.Done():
+			return event, ctx.Err()
+		}
+	}
 	event.Path = strings.Replace(event.Path, c.Root, "", 1)
 	return
 }
 
-// Wait is a wrapper around (*doozer.Conn).Close
+// Close is a wrapper around (Backend).Close
 func (c *conn) Close() {
 	c.conn.Close()
 }
 
-// Del is a wrapper around (*doozer.Conn).Del which also supports
+// Del is a wrapper around (Backend).Del which also supports
 // deleting directories.
 // TODO: Concurrent implementation
-// TODO: Better error messages on NOENT
 func (c *conn) Del(path string, rev int64) (err error) {
 	path = c.prefixPath(path)
 
-	err = doozer.Walk(c.conn, rev, path, func(path string, f *doozer.FileInfo, e error) error {
-		if e != nil {
-			return e
+	err = c.walk(path, rev, func(path string, filerev int64) error {
+		e := c.conn.Del(path, rev)
+		if IsErrNoEnt(e) {
+			return NewError(ErrNoEnt, fmt.Sprintf(`path "%s" not found @ %d`, path, rev))
 		}
+		return e
+	})
+	if IsErrNoEnt(err) {
+		return NewError(ErrNoEnt, fmt.Sprintf(`path "%s" not found @ %d`, path, rev))
+	}
 
-		if !f.IsDir {
-			e = c.conn.Del(path, rev)
-			if e == doozer.ErrNoEnt || (e != nil && e.Error() == "NOENT") {
-				return NewError(ErrNoEnt, fmt.Sprintf(`path "%s" not found @ %d`, path, rev))
-			}
-			if e != nil {
-				return e
-			}
-		}
+	return
+}
 
+// LastModified returns the revision of the latest change to the file
+// at path at rev, or to any file below path if it is a directory.
+func (c *conn) LastModified(path string, rev int64) (modrev int64, err error) {
+	path = c.prefixPath(path)
+
+	err = c.walk(path, rev, func(p string, filerev int64) error {
+		if filerev > modrev {
+			modrev = filerev
+		}
 		return nil
 	})
-	if err == doozer.ErrNoEnt || (err != nil && err.Error() == "NOENT") {
-		return NewError(ErrNoEnt, fmt.Sprintf(`path "%s" not found @ %d`, path, rev))
+	return
+}
+
+// walk calls fn for every file below the given, already prefixed,
+// path at rev. Directories are traversed but not passed to fn.
+func (c *conn) walk(p string, rev int64, fn func(path string, filerev int64) error) error {
+	size, filerev, err := c.conn.Stat(p, &rev)
+	if err != nil {
+		return err
+	}
+	if filerev == 0 {
+		return NewError(ErrNoEnt, fmt.Sprintf(`path "%s" not found @ %d`, p, rev))
+	}
+	if filerev > 0 {
+		return fn(p, filerev)
+	}
+	if size == 0 {
+		return nil
 	}
 
-	return
+	names, err := c.conn.Getdir(p, rev, 0, size)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = c.walk(path.Join(p, name), rev, fn)
+		if err != nil && !IsErrNoEnt(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetMulti returns multiple key/value pairs organized in a map.
@@ -0,0 +1,293 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// ChangeSet represents the changes to the registry
+// between two snapshots, as returned by Diff.
+type ChangeSet struct {
+	FromRev        int64
+	ToRev          int64
+	AppsAdded      []*App
+	AppsRemoved    []*App
+	EnvChanges     []*EnvChange
+	RevsRegistered []*Revision
+	ProcsAdded     []*ProcType
+	InsChanges     []*InsChange
+	EndpointsAdded []*Endpoint
+}
+
+// EnvChange represents a change to an application's environment.
+// Old is nil if the variable was set, New is nil if it was unset.
+type EnvChange struct {
+	App string
+	Key string
+	Old *string
+	New *string
+}
+
+// InsChange represents a change to an instance's status.
+// From is empty if the instance was registered in between
+// the two snapshots, To is empty if it was removed.
+type InsChange struct {
+	Instance *Instance
+	From     InsStatus
+	To       InsStatus
+}
+
+// registryState holds the registry objects which are compared by Diff.
+type registryState struct {
+	apps      map[string]*App
+	env       map[string]Env
+	revs      map[string]*Revision
+	procs     map[string]*ProcType
+	instances map[string]*Instance
+	endpoints map[string]*Endpoint
+}
+
+// Diff returns the changes to the registry between the snapshots a and b.
+func Diff(a, b Snapshot) (cs *ChangeSet, err error) {
+	from, err := getRegistryState(a)
+	if err != nil {
+		return
+	}
+	to, err := getRegistryState(b)
+	if err != nil {
+		return
+	}
+
+	cs = &ChangeSet{FromRev: a.Rev, ToRev: b.Rev}
+
+	for _, k := range sortedKeys(to.apps) {
+		if _, ok := from.apps[k]; !ok {
+			cs.AppsAdded = append(cs.AppsAdded, to.apps[k])
+		}
+	}
+	for _, k := range sortedKeys(from.apps) {
+		if _, ok := to.apps[k]; !ok {
+			cs.AppsRemoved = append(cs.AppsRemoved, from.apps[k])
+		}
+	}
+	for _, k := range sortedKeys(to.apps) {
+		cs.EnvChanges = append(cs.EnvChanges, diffEnv(k, from.env[k], to.env[k])...)
+	}
+	for _, k := range sortedKeys(to.revs) {
+		if _, ok := from.revs[k]; !ok {
+			cs.RevsRegistered = append(cs.RevsRegistered, to.revs[k])
+		}
+	}
+	for _, k := range sortedKeys(to.procs) {
+		if _, ok := from.procs[k]; !ok {
+			cs.ProcsAdded = append(cs.ProcsAdded, to.procs[k])
+		}
+	}
+	for _, k := range sortedKeys(to.instances) {
+		ins := to.instances[k]
+		if old, ok := from.instances[k]; !ok {
+			cs.InsChanges = append(cs.InsChanges, &InsChange{ins, "", ins.Status})
+		} else if old.Status != ins.Status {
+			cs.InsChanges = append(cs.InsChanges, &InsChange{ins, old.Status, ins.Status})
+		}
+	}
+	for _, k := range sortedKeys(from.instances) {
+		if _, ok := to.instances[k]; !ok {
+			ins := from.instances[k]
+			cs.InsChanges = append(cs.InsChanges, &InsChange{ins, ins.Status, ""})
+		}
+	}
+	for _, k := range sortedKeys(to.endpoints) {
+		if _, ok := from.endpoints[k]; !ok {
+			cs.EndpointsAdded = append(cs.EndpointsAdded, to.endpoints[k])
+		}
+	}
+	return
+}
+
+// IsEmpty returns true if the change set doesn't contain any changes.
+func (cs *ChangeSet) IsEmpty() bool {
+	return len(cs.AppsAdded) == 0 &&
+		len(cs.AppsRemoved) == 0 &&
+		len(cs.EnvChanges) == 0 &&
+		len(cs.RevsRegistered) == 0 &&
+		len(cs.ProcsAdded) == 0 &&
+		len(cs.InsChanges) == 0 &&
+		len(cs.EndpointsAdded) == 0
+}
+
+func (cs *ChangeSet) String() string {
+	return fmt.Sprintf("ChangeSet<%d..%d>{apps: +%d -%d, env: %d, revs: +%d, procs: +%d, instances: %d, endpoints: +%d}",
+		cs.FromRev, cs.ToRev, len(cs.AppsAdded), len(cs.AppsRemoved), len(cs.EnvChanges), len(cs.RevsRegistered),
+		len(cs.ProcsAdded), len(cs.InsChanges), len(cs.EndpointsAdded))
+}
+
+func (c *EnvChange) String() string {
+	return fmt.Sprintf("EnvChange<%s>{%s: %s -> %s}", c.App, c.Key, envValueString(c.Old), envValueString(c.New))
+}
+
+func (c *InsChange) String() string {
+	return fmt.Sprintf("InsChange<%d>{%s: %s -> %s}", c.Instance.Id, c.Instance.RefString(), c.From, c.To)
+}
+
+func diffEnv(app string, from, to Env) (changes []*EnvChange) {
+	for _, k := range sortedKeys(to) {
+		v := to[k]
+		if old, ok := from[k]; !ok {
+			changes = append(changes, &EnvChange{App: app, Key: k, New: &v})
+		} else if old != v {
+			changes = append(changes, &EnvChange{App: app, Key: k, Old: &old, New: &v})
+		}
+	}
+	for _, k := range sortedKeys(from) {
+		if _, ok := to[k]; !ok {
+			old := from[k]
+			changes = append(changes, &EnvChange{App: app, Key: k, Old: &old})
+		}
+	}
+	return
+}
+
+func getRegistryState(s Snapshot) (state *registryState, err error) {
+	state = &registryState{
+		apps:      map[string]*App{},
+		env:       map[string]Env{},
+		revs:      map[string]*Revision{},
+		procs:     map[string]*ProcType{},
+		instances: map[string]*Instance{},
+		endpoints: map[string]*Endpoint{},
+	}
+
+	names, err := getdirOrEmpty(s, appsPath)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var app *App
+
+		app, err = GetApp(s, name)
+		if IsErrNoEnt(err) {
+			// Skip apps which aren't fully registered
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		state.apps[name] = app
+
+		state.env[name], err = app.EnvironmentVars()
+		if err != nil {
+			return
+		}
+
+		var refs []string
+
+		refs, err = getdirOrEmpty(s, app.Dir.prefix(revsPath))
+		if err != nil {
+			return
+		}
+		for _, ref := range refs {
+			var rev *Revision
+
+			rev, err = GetRevision(s, app, ref)
+			if err != nil {
+				return
+			}
+			state.revs[path.Join(name, ref)] = rev
+		}
+
+		var ptys []*ProcType
+
+		ptys, err = app.GetProcTypes()
+		if err != nil {
+			return
+		}
+		for _, pty := range ptys {
+			state.procs[path.Join(name, pty.Name)] = pty
+		}
+	}
+
+	ids, err := getdirOrEmpty(s, instancesPath)
+	if err != nil {
+		return
+	}
+	for _, idstr := range ids {
+		var (
+			id  int64
+			ins *Instance
+		)
+
+		id, err = strconv.ParseInt(idstr, 10, 64)
+		if err != nil {
+			return
+		}
+		ins, err = GetInstance(s, id)
+		if IsErrNoEnt(err) {
+			// Skip instances without an object file
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		state.instances[idstr] = ins
+	}
+
+	names, err = getdirOrEmpty(s, servicesPath)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var eps []*Endpoint
+
+		eps, err = NewService(name, s).GetEndpoints()
+		if IsErrNoEnt(err) {
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		for _, ep := range eps {
+			state.endpoints[path.Join(name, ep.Id())] = ep
+		}
+	}
+	return
+}
+
+// getdirOrEmpty is like (Snapshot).getdir, but returns
+// an empty list if the directory doesn't exist.
+func getdirOrEmpty(s Snapshot, path string) (names []string, err error) {
+	names, err = s.getdir(path)
+	if IsErrNoEnt(err) {
+		return []string{}, nil
+	}
+	return
+}
+
+// sortedKeys returns the keys of a map with string keys in sorted order.
+// It panics if m isn't such a map.
+func sortedKeys(m interface{}) (keys []string) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		panic(fmt.Sprintf("sortedKeys: %T is not a map with string keys", m))
+	}
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return
+}
+
+func envValueString(v *string) string {
+	if v == nil {
+		return "<unset>"
+	}
+	return *v
+}
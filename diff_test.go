@@ -0,0 +1,155 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"strings"
+	"testing"
+)
+
+func diffSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/diff-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+func TestDiffEmpty(t *testing.T) {
+	s := diffSetup()
+
+	cs, err := Diff(s, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.IsEmpty() {
+		t.Errorf("expected empty change set, got %s", cs)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	s := diffSetup()
+
+	app := NewApp("diffcat", "git://diffcat.git", "stack", s)
+	app.Env["GONE"] = "soon"
+	app.Env["CHANGED"] = "before"
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := NewApp("diffdog", "git://diffdog.git", "stack", app.Dir.Snapshot)
+	gone, err = gone.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := NewProcType(app, "web", gone.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance(app.Name, "f00", web.Name, web.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := ins.Dir.Snapshot
+	app = app.FastForward(from.Rev)
+
+	if err = gone.FastForward(from.Rev).Unregister(); err != nil {
+		t.Fatal(err)
+	}
+	app = app.FastForward(-1)
+	if app, err = app.SetEnvironmentVar("CHANGED", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if app, err = app.DelEnvironmentVar("GONE"); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := NewRevision(app, "f00", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pty, err := NewProcType(app, "worker", rev.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.FastForward(pty.Dir.Snapshot.Rev).Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := NewApp("diffbat", "git://diffbat.git", "stack", ins.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewService("diffsrv", added.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := NewEndpoint(srv, "127.0.0.1", 8080, srv.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err = ep.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := Diff(from, ep.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cs.AppsAdded) != 1 || cs.AppsAdded[0].Name != added.Name {
+		t.Errorf("expected %s to be added, got %v", added, cs.AppsAdded)
+	}
+	if len(cs.AppsRemoved) != 1 || cs.AppsRemoved[0].Name != gone.Name {
+		t.Errorf("expected %s to be removed, got %v", gone, cs.AppsRemoved)
+	}
+	if len(cs.EnvChanges) != 2 {
+		t.Fatalf("expected 2 env changes, got %v", cs.EnvChanges)
+	}
+	if c := cs.EnvChanges[0]; c.Key != "CHANGED" || *c.Old != "before" || *c.New != "after" {
+		t.Errorf("unexpected env change %s", c)
+	}
+	if c := cs.EnvChanges[1]; c.Key != "GONE" || *c.Old != "soon" || c.New != nil {
+		t.Errorf("unexpected env change %s", c)
+	}
+	if len(cs.RevsRegistered) != 1 || cs.RevsRegistered[0].Ref != rev.Ref {
+		t.Errorf("expected %s to be registered, got %v", rev, cs.RevsRegistered)
+	}
+	if len(cs.ProcsAdded) != 1 || cs.ProcsAdded[0].Name != pty.Name {
+		t.Errorf("expected %s to be added, got %v", pty, cs.ProcsAdded)
+	}
+	if len(cs.InsChanges) != 1 {
+		t.Fatalf("expected 1 instance change, got %v", cs.InsChanges)
+	}
+	if c := cs.InsChanges[0]; c.From != InsStatusPending || c.To != InsStatusClaimed {
+		t.Errorf("unexpected instance change %s", c)
+	}
+	if len(cs.EndpointsAdded) != 1 || cs.EndpointsAdded[0].Id() != ep.Id() {
+		t.Errorf("expected %s to be added, got %v", ep, cs.EndpointsAdded)
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	keys := sortedKeys(map[string]*Pm{"b": nil, "c": nil, "a": nil})
+	if strings.Join(keys, " ") != "a b c" {
+		t.Errorf("expected sorted keys, got %v", keys)
+	}
+
+	for _, m := range []interface{}{[]string{"a"}, map[int]string{1: "a"}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected sortedKeys to panic on %T", m)
+				}
+			}()
+			sortedKeys(m)
+		}()
+	}
+}
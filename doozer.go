@@ -0,0 +1,195 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/soundcloud/doozer"
+)
+
+// doozerBackend is the Backend implementation
+// for doozerd, wrapping a *doozer.Conn.
+//
+// doozer can't cancel a pending wait, so cancellable waits run on
+// connections of their own, which are closed when the wait is
+// cancelled. Connections of waits which completed are kept for
+// the next ones.
+type doozerBackend struct {
+	conn *doozer.Conn
+	dial func() (waitConn, error)
+
+	mu     sync.Mutex
+	idle   []waitConn
+	closed bool
+}
+
+// waitConn is the part of a *doozer.Conn used for cancellable waits.
+type waitConn interface {
+	Wait(glob string, rev int64) (doozer.Event, error)
+	Close()
+}
+
+func dialDoozer(addr string) (Backend, error) {
+	dconn, err := doozer.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newDoozerBackend(dconn, func() (waitConn, error) {
+		return doozer.Dial(addr)
+	}), nil
+}
+
+func dialDoozerUri(uri string) (Backend, error) {
+	dconn, err := doozer.DialUri(uri, "")
+	if err != nil {
+		return nil, err
+	}
+	return newDoozerBackend(dconn, func() (waitConn, error) {
+		return doozer.DialUri(uri, "")
+	}), nil
+}
+
+func newDoozerBackend(conn *doozer.Conn, dial func() (waitConn, error)) *doozerBackend {
+	return &doozerBackend{conn: conn, dial: dial}
+}
+
+func (b *doozerBackend) Get(path string, rev *int64) ([]byte, int64, error) {
+	value, filerev, err := b.conn.Get(path, rev)
+	return value, filerev, doozerError(path, err)
+}
+
+func (b *doozerBackend) Set(path string, rev int64, value []byte) (int64, error) {
+	newrev, err := b.conn.Set(path, rev, value)
+	return newrev, doozerError(path, err)
+}
+
+func (b *doozerBackend) Del(path string, rev int64) error {
+	return doozerError(path, b.conn.Del(path, rev))
+}
+
+func (b *doozerBackend) Stat(path string, rev *int64) (int, int64, error) {
+	size, filerev, err := b.conn.Stat(path, rev)
+	return size, filerev, doozerError(path, err)
+}
+
+func (b *doozerBackend) Getdir(path string, rev int64, offset, limit int) ([]string, error) {
+	names, err := b.conn.Getdir(path, rev, offset, limit)
+	return names, doozerError(path, err)
+}
+
+func (b *doozerBackend) Wait(glob string, rev int64) (BackendEvent, error) {
+	ev, err := b.conn.Wait(glob, rev)
+	if err != nil {
+		return BackendEvent{}, doozerError(glob, err)
+	}
+	return BackendEvent{Rev: ev.Rev, Path: ev.Path, Body: ev.Body, Del: ev.IsDel()}, nil
+}
+
+// WaitContext is like Wait, but returns ctx.Err() once ctx is done.
+// The connection the wait runs on is closed on cancellation, so that
+// no wait is left pending in doozerd.
+func (b *doozerBackend) WaitContext(ctx context.Context, glob string, rev int64) (BackendEvent, error) {
+	if ctx.Done() == nil {
+		return b.Wait(glob, rev)
+	}
+	if err := ctx.Err(); err != nil {
+		return BackendEvent{}, err
+	}
+	wc, err := b.waitConn()
+	if err != nil {
+		return BackendEvent{}, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			wc.Close()
+			stopped <- true
+		case <-done:
+			stopped <- false
+		}
+	}()
+
+	ev, err := wc.Wait(glob, rev)
+	close(done)
+	if <-stopped {
+		return BackendEvent{}, ctx.Err()
+	}
+	if err != nil {
+		// The connection may be broken, don't reuse it
+		wc.Close()
+		return BackendEvent{}, doozerError(glob, err)
+	}
+	b.putWaitConn(wc)
+
+	return BackendEvent{Rev: ev.Rev, Path: ev.Path, Body: ev.Body, Del: ev.IsDel()}, nil
+}
+
+// waitConn returns an idle wait connection, or dials a new one.
+func (b *doozerBackend) waitConn() (waitConn, error) {
+	b.mu.Lock()
+	if n := len(b.idle); n > 0 {
+		wc := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.mu.Unlock()
+		return wc, nil
+	}
+	b.mu.Unlock()
+
+	return b.dial()
+}
+
+// putWaitConn keeps wc for the next wait, or closes it if the
+// backend was closed.
+func (b *doozerBackend) putWaitConn(wc waitConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		wc.Close()
+		return
+	}
+	b.idle = append(b.idle, wc)
+}
+
+func (b *doozerBackend) Rev() (int64, error) {
+	return b.conn.Rev()
+}
+
+func (b *doozerBackend) Close() {
+	b.mu.Lock()
+	for _, wc := range b.idle {
+		wc.Close()
+	}
+	b.idle, b.closed = nil, true
+	b.mu.Unlock()
+
+	b.conn.Close()
+}
+
+// doozerError translates doozer's NOENT and TOO_LATE errors
+// into errors recognized by IsErrNoEnt and IsErrRevTooOld.
+func doozerError(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := err
+	if derr, ok := err.(*doozer.Error); ok {
+		cause = derr.Err
+	}
+	if cause == doozer.ErrNoEnt || cause.Error() == "NOENT" {
+		return NewError(ErrNoEnt, fmt.Sprintf(`path "%s" not found`, path))
+	}
+	if cause == doozer.ErrTooLate || cause.Error() == "TOO_LATE" {
+		return NewError(ErrRevTooOld, fmt.Sprintf("%s: %s", ErrRevTooOld.Error(), path))
+	}
+	return err
+}
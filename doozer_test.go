@@ -0,0 +1,129 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/doozer"
+)
+
+// fakeWaitConn blocks waits until an event is sent
+// on events, or until it is closed.
+type fakeWaitConn struct {
+	events chan doozer.Event
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeWaitConn() *fakeWaitConn {
+	return &fakeWaitConn{events: make(chan doozer.Event, 1), closed: make(chan struct{})}
+}
+
+func (c *fakeWaitConn) Wait(glob string, rev int64) (doozer.Event, error) {
+	select {
+	case ev := <-c.events:
+		return ev, nil
+	case <-c.closed:
+		return doozer.Event{}, errors.New("use of closed connection")
+	}
+}
+
+func (c *fakeWaitConn) Close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func doozerWaitSetup() (b *doozerBackend, conns chan *fakeWaitConn) {
+	conns = make(chan *fakeWaitConn, 100)
+	b = newDoozerBackend(nil, func() (waitConn, error) {
+		c := newFakeWaitConn()
+		conns <- c
+		return c, nil
+	})
+	return
+}
+
+func TestDoozerWaitContextCancel(t *testing.T) {
+	b, conns := doozerWaitSetup()
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := b.WaitContext(ctx, "/**", 1)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-conns
+	}
+	cancel()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case err := <-errs:
+			if err != context.Canceled {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected cancelled waits to return")
+		}
+	}
+	if len(b.idle) != 0 {
+		t.Errorf("expected connections of cancelled waits to be closed, got %d idle", len(b.idle))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected goroutines to go back to %d, got %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoozerWaitContextReuse(t *testing.T) {
+	b, conns := doozerWaitSetup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evs := make(chan BackendEvent, 1)
+	go func() {
+		ev, err := b.WaitContext(ctx, "/**", 1)
+		if err != nil {
+			t.Error(err)
+		}
+		evs <- ev
+	}()
+	c := <-conns
+	c.events <- doozer.Event{Rev: 5, Path: "/foo", Body: []byte("bar"), Flag: 4}
+
+	if ev := <-evs; ev.Rev != 5 || ev.Path != "/foo" || !ev.IsSet() {
+		t.Errorf("unexpected event %#v", ev)
+	}
+
+	// The next wait runs on the same connection
+	go b.WaitContext(ctx, "/**", 6)
+	select {
+	case <-conns:
+		t.Error("expected the connection to be reused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Error("expected the connection to be closed on cancel")
+	}
+}
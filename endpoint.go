@@ -14,6 +14,11 @@ import (
 
 const endpointsPath = "endpoints"
 
+// DefaultEndpointWeight is the SRV weight of new endpoints. Endpoints
+// meant to receive a smaller share of the traffic of their service,
+// such as those of a Canary, have a lower weight.
+const DefaultEndpointWeight = 100
+
 // Endpoint represents an entry of a Service and supports all fields to be used
 // as SRV record.
 type Endpoint struct {
@@ -34,9 +39,11 @@ func NewEndpoint(srv *Service, addr string, port int, s Snapshot) (e *Endpoint,
 	}
 
 	e = &Endpoint{
-		Addr: addr,
-		IP:   tcpAddr.IP.String(),
-		Port: tcpAddr.Port,
+		Service: srv,
+		Addr:    addr,
+		IP:      tcpAddr.IP.String(),
+		Port:    tcpAddr.Port,
+		Weight:  DefaultEndpointWeight,
 	}
 	e.Dir = dir{s, srv.Dir.prefix(endpointsPath, e.Id())}
 
@@ -65,15 +72,7 @@ func (e *Endpoint) Register() (ep *Endpoint, err error) {
 		return nil, ErrKeyConflict
 	}
 
-	data := []string{
-		e.Addr,
-		e.IP,
-		strconv.Itoa(e.Port),
-		strconv.Itoa(e.Priority),
-		strconv.Itoa(e.Weight),
-	}
-
-	f, err := createFile(e.Dir.Snapshot, e.Dir.String(), data, new(listCodec))
+	f, err := createFile(e.Dir.Snapshot, e.Dir.String(), e.fields(), new(listCodec))
 	if err != nil {
 		return
 	}
@@ -83,6 +82,33 @@ func (e *Endpoint) Register() (ep *Endpoint, err error) {
 	return
 }
 
+// SetWeight changes the SRV weight of a registered endpoint.
+func (e *Endpoint) SetWeight(weight int) (ep *Endpoint, err error) {
+	if weight < 0 {
+		return nil, fmt.Errorf("endpoint weight can't be negative")
+	}
+	ep = e.FastForward(e.Dir.Snapshot.Rev) // Create a copy
+	ep.Weight = weight
+
+	f, err := createFile(e.Dir.Snapshot, e.Dir.String(), ep.fields(), new(listCodec))
+	if err != nil {
+		return nil, err
+	}
+	ep = ep.FastForward(f.Snapshot.Rev)
+
+	return
+}
+
+func (e *Endpoint) fields() []string {
+	return []string{
+		e.Addr,
+		e.IP,
+		strconv.Itoa(e.Port),
+		strconv.Itoa(e.Priority),
+		strconv.Itoa(e.Weight),
+	}
+}
+
 // Unregister the endpoint.
 func (e *Endpoint) Unregister() error {
 	return e.Dir.del("/")
@@ -111,7 +137,7 @@ func GetEndpoint(s Snapshot, srv *Service, id string) (e *Endpoint, err error) {
 	}
 	data := f.Value.([]string)
 
-	e = &Endpoint{Addr: data[0], IP: data[1]}
+	e = &Endpoint{Service: srv, Addr: data[0], IP: data[1]}
 	e.Dir = dir{s, srv.Dir.prefix(endpointsPath, id)}
 
 	p, err := strconv.ParseInt(data[2], 10, 0)
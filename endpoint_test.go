@@ -10,7 +10,7 @@ import (
 )
 
 func endpointSetup(srvName string) (s Snapshot, srv *Service) {
-	s, err := Dial(DefaultAddr, "/endpoint-test")
+	s, err := testDial("/endpoint-test")
 	if err != nil {
 		panic(err)
 	}
@@ -19,6 +19,10 @@ var (
 	ErrBadPath      = errors.New("invalid path: only ASCII letters, numbers, '.', or '-' are allowed")
 	ErrSchemaMism   = errors.New("visor version not compatible with current coordinator schema")
 	ErrBadPtyName   = errors.New("invalid proc type name: only alphanumeric chars allowed")
+	ErrRevTooOld    = errors.New("revision is no longer available in the coordinator history")
+	ErrIncomplete   = errors.New("write was only partially applied")
+	ErrRevInUse     = errors.New("revision still has instances")
+	ErrRolledBack   = errors.New("rollout was rolled back")
 )
 
 type Error struct {
@@ -40,3 +44,24 @@ func IsErrNoEnt(e error) (r bool) {
 	}
 	return
 }
+
+func IsErrRevMismatch(e error) (r bool) {
+	if err, ok := e.(*Error); ok {
+		r = err.Err == ErrRevMismatch
+	}
+	return
+}
+
+func IsErrRevTooOld(e error) (r bool) {
+	if err, ok := e.(*Error); ok {
+		r = err.Err == ErrRevTooOld
+	}
+	return
+}
+
+func IsErrRevInUse(e error) (r bool) {
+	if err, ok := e.(*Error); ok {
+		r = err.Err == ErrRevInUse
+	}
+	return
+}
@@ -6,8 +6,8 @@
 package visor
 
 import (
+	"context"
 	"fmt"
-	"github.com/soundcloud/doozer"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,6 +16,8 @@ import (
 type EventData struct {
 	App      *string
 	Endpoint *string
+	Env      *string
+	Host     *string
 	Instance *string
 	Proctype *string
 	Revision *string
@@ -28,29 +30,41 @@ type Event struct {
 	Body   string    // Body of the changed file
 	Source snapshotable
 	Path   EventData
-	raw    *doozer.Event // Original event returned by doozer
+	raw    *BackendEvent // Original event returned by the backend
 	Rev    int64
 }
 
 type EventType string
 
 const (
-	EvAppReg    = EventType("app-register")
-	EvAppUnreg  = EventType("app-unregister")
-	EvRevReg    = EventType("rev-register")
-	EvRevUnreg  = EventType("rev-unregister")
-	EvProcReg   = EventType("proc-register")
-	EvProcUnreg = EventType("proc-unregister")
-	EvInsReg    = EventType("instance-register")
-	EvInsUnreg  = EventType("instance-unregister")
-	EvInsStart  = EventType("instance-start")
-	EvInsFail   = EventType("instance-fail")
-	EvInsExit   = EventType("instance-exit")
-	EvSrvReg    = EventType("service-register")
-	EvSrvUnreg  = EventType("service-unregister")
-	EvEpReg     = EventType("endpoint-register")
-	EvEpUnreg   = EventType("endpoint-unregister")
-	EvUnknown   = EventType("UNKNOWN")
+	EvAppReg     = EventType("app-register")
+	EvAppUnreg   = EventType("app-unregister")
+	EvAppEnvSet  = EventType("app-env-set")
+	EvAppEnvDel  = EventType("app-env-del")
+	EvAppHead    = EventType("app-head-change")
+	EvRevReg     = EventType("rev-register")
+	EvRevUnreg   = EventType("rev-unregister")
+	EvRevArchive = EventType("rev-archive-change")
+	EvProcReg    = EventType("proc-register")
+	EvProcUnreg  = EventType("proc-unregister")
+	EvProcScale  = EventType("proc-scale-change")
+	EvInsReg     = EventType("instance-register")
+	EvInsUnreg   = EventType("instance-unregister")
+	EvInsStart   = EventType("instance-start")
+	EvInsFail    = EventType("instance-fail")
+	EvInsExit    = EventType("instance-exit")
+	EvInsLost    = EventType("instance-lost")
+	EvInsClaim   = EventType("instance-claim")
+	EvInsStop    = EventType("instance-stop")
+	EvSrvReg     = EventType("service-register")
+	EvSrvUnreg   = EventType("service-unregister")
+	EvEpReg      = EventType("endpoint-register")
+	EvEpUnreg    = EventType("endpoint-unregister")
+	EvPmReg      = EventType("pm-register")
+	EvPmUnreg    = EventType("pm-unregister")
+	EvProxyReg   = EventType("proxy-register")
+	EvProxyUnreg = EventType("proxy-unregister")
+	EvUnknown    = EventType("UNKNOWN")
 )
 
 const (
@@ -61,26 +75,40 @@ type eventPath int
 
 const (
 	pathApp eventPath = iota
+	pathAppEnv
+	pathAppHead
 	pathRev
+	pathRevArchive
 	pathProc
+	pathProcScale
 	pathIns
 	pathInsStatus
 	pathInsStart
 	pathInsStop
+	pathInsClaim
 	pathSrv
 	pathEp
+	pathPm
+	pathProxy
 )
 
 var eventPatterns = map[*regexp.Regexp]eventPath{
-	regexp.MustCompile("^/apps/(" + charPat + "+)/registered$"):                          pathApp,
-	regexp.MustCompile("^/apps/(" + charPat + "+)/revs/(" + charPat + "+)/registered$"):  pathRev,
-	regexp.MustCompile("^/apps/(" + charPat + "+)/procs/(" + charPat + "+)/registered$"): pathProc,
-	regexp.MustCompile("^/instances/([-0-9]+)/object$"):                                  pathIns,
-	regexp.MustCompile("^/instances/([-0-9]+)/status$"):                                  pathInsStatus,
-	regexp.MustCompile("^/instances/([-0-9]+)/start$"):                                   pathInsStart,
-	regexp.MustCompile("^/instances/([-0-9]+)/stop$"):                                    pathInsStop,
-	regexp.MustCompile("^/services/(" + charPat + "+)/registered$"):                      pathSrv,
-	regexp.MustCompile("^/services/(" + charPat + "+)/endpoints/([-0-9]+)$"):             pathEp,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/registered$"):                                                pathApp,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/env/(" + charPat + "+)$"):                                    pathAppEnv,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/head$"):                                                      pathAppHead,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/revs/(" + charPat + "+)/registered$"):                        pathRev,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/revs/(" + charPat + "+)/archive-url$"):                       pathRevArchive,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/procs/(" + charPat + "+)/registered$"):                       pathProc,
+	regexp.MustCompile("^/apps/(" + charPat + "+)/procs/(" + charPat + "+)/desired-scale/(" + charPat + "+)$"): pathProcScale,
+	regexp.MustCompile("^/instances/([-0-9]+)/object$"):                                                        pathIns,
+	regexp.MustCompile("^/instances/([-0-9]+)/status$"):                                                        pathInsStatus,
+	regexp.MustCompile("^/instances/([-0-9]+)/start$"):                                                         pathInsStart,
+	regexp.MustCompile("^/instances/([-0-9]+)/stop$"):                                                          pathInsStop,
+	regexp.MustCompile("^/instances/([-0-9]+)/claims/(" + charPat + "+)$"):                                     pathInsClaim,
+	regexp.MustCompile("^/services/(" + charPat + "+)/registered$"):                                            pathSrv,
+	regexp.MustCompile("^/services/(" + charPat + "+)/endpoints/([-0-9]+)$"):                                   pathEp,
+	regexp.MustCompile("^/pms/(" + charPat + "+)$"):                                                            pathPm,
+	regexp.MustCompile("^/proxies/(" + charPat + "+)$"):                                                        pathProxy,
 }
 
 func (ev *Event) String() string {
@@ -90,45 +118,70 @@ func (ev *Event) String() string {
 // WatchEventRaw watches for changes to the registry and sends
 // them as *Event objects to the provided channel.
 func WatchEventRaw(s Snapshot, listener chan *Event) error {
-	rev := s.Rev
-	for {
-		ev, err := s.conn.Wait(doozerGlobPlural, rev+1)
-		if err != nil {
-			return err
-		}
-		rev = ev.Rev
-
-		event, err := enrichEvent(s.FastForward(rev), &ev)
-		if err != nil {
-			return err
-		}
+	return watchEvent(context.Background(), s, doozerGlobPlural, listener, nil)
+}
 
-		listener <- event
-	}
-	return nil
+// WatchEventRawContext is like WatchEventRaw, but returns ctx.Err()
+// once ctx is done. The listener channel is closed on return.
+func WatchEventRawContext(ctx context.Context, s Snapshot, listener chan *Event) error {
+	defer close(listener)
+	return watchEvent(ctx, s, doozerGlobPlural, listener, nil)
 }
 
 // WatchEvent wraps WatchEventRaw with additional information.
 func WatchEvent(s Snapshot, listener chan *Event) error {
+	return watchEvent(context.Background(), s, doozerGlobPlural, listener, isKnownEvent)
+}
+
+// WatchEventContext is like WatchEvent, but returns ctx.Err()
+// once ctx is done. The listener channel is closed on return.
+func WatchEventContext(ctx context.Context, s Snapshot, listener chan *Event) error {
+	defer close(listener)
+	return watchEvent(ctx, s, doozerGlobPlural, listener, isKnownEvent)
+}
+
+// watchEvent waits for changes to paths matching glob, and sends
+// the resulting events to listener. If match is not nil, only
+// events for which it returns true are sent.
+func watchEvent(ctx context.Context, s Snapshot, glob string, listener chan *Event, match func(*Event) bool) error {
 	rev := s.Rev
 	for {
-		ev, err := s.conn.Wait(doozerGlobPlural, rev+1)
+		ev, err := s.conn.WaitContext(ctx, glob, rev+1)
 		if err != nil {
 			return err
 		}
 		rev = ev.Rev
+
 		event, err := enrichEvent(s.FastForward(rev), &ev)
 		if err != nil {
 			return err
 		}
 
-		if event.Type == EvUnknown {
+		if match != nil && !match(event) {
 			continue
 		}
 
-		listener <- event
+		select {
+		case listener <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// hasOptionalSource tells whether events of type etype are sent
+// without a source when looking it up fails, e.g. because the
+// object was removed since.
+func hasOptionalSource(etype EventType) bool {
+	switch etype {
+	case EvAppEnvSet, EvAppHead, EvRevArchive, EvInsClaim, EvInsStop, EvPmReg, EvProxyReg:
+		return true
 	}
-	return nil
+	return false
+}
+
+func isKnownEvent(e *Event) bool {
+	return e.Type != EvUnknown
 }
 
 func canonicalizeMetadata(s Snapshot, etype EventType, uncanonicalized EventData) (source snapshotable, err error) {
@@ -190,24 +243,34 @@ func canonicalizeMetadata(s Snapshot, etype EventType, uncanonicalized EventData
 	}
 
 	switch etype {
-	case EvAppReg:
+	case EvAppReg, EvAppEnvSet, EvAppHead:
 		source = app
-	case EvRevReg:
+	case EvRevReg, EvRevArchive:
 		source = rev
-	case EvProcReg:
+	case EvProcReg, EvProcScale:
 		source = pty
-	case EvInsReg, EvInsStart, EvInsFail, EvInsExit:
+	case EvInsReg, EvInsStart, EvInsFail, EvInsExit, EvInsLost, EvInsClaim, EvInsStop:
 		source = ins
 	case EvSrvReg:
 		source = srv
 	case EvEpReg:
 		source = edp
+	case EvPmReg:
+		var pm *Pm
+		if pm, err = GetPm(s, *uncanonicalized.Host); err == nil {
+			source = pm
+		}
+	case EvProxyReg:
+		var proxy *Proxy
+		if proxy, err = GetProxy(s, *uncanonicalized.Host); err == nil {
+			source = proxy
+		}
 	}
 
 	return
 }
 
-func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
+func enrichEvent(s Snapshot, src *BackendEvent) (event *Event, err error) {
 	var canonicalized snapshotable
 
 	path := src.Path
@@ -225,6 +288,22 @@ func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
 				} else if src.IsDel() {
 					etype = EvAppUnreg
 				}
+			case pathAppEnv:
+				key := strings.Replace(match[2], "-", "_", -1)
+				uncanonicalized.App = &match[1]
+				uncanonicalized.Env = &key
+
+				if src.IsSet() {
+					etype = EvAppEnvSet
+				} else if src.IsDel() {
+					etype = EvAppEnvDel
+				}
+			case pathAppHead:
+				uncanonicalized.App = &match[1]
+
+				if src.IsSet() {
+					etype = EvAppHead
+				}
 			case pathRev:
 				uncanonicalized.App = &match[1]
 				uncanonicalized.Revision = &match[2]
@@ -234,6 +313,13 @@ func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
 				} else if src.IsDel() {
 					etype = EvRevUnreg
 				}
+			case pathRevArchive:
+				uncanonicalized.App = &match[1]
+				uncanonicalized.Revision = &match[2]
+
+				if src.IsSet() {
+					etype = EvRevArchive
+				}
 			case pathProc:
 				uncanonicalized.App = &match[1]
 				uncanonicalized.Proctype = &match[2]
@@ -243,6 +329,14 @@ func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
 				} else if src.IsDel() {
 					etype = EvProcUnreg
 				}
+			case pathProcScale:
+				uncanonicalized.App = &match[1]
+				uncanonicalized.Proctype = &match[2]
+				uncanonicalized.Revision = &match[3]
+
+				if src.IsSet() {
+					etype = EvProcScale
+				}
 			case pathIns:
 				uncanonicalized.Instance = &match[1]
 
@@ -280,6 +374,21 @@ func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
 					etype = EvInsExit
 				case InsStatusFailed:
 					etype = EvInsFail
+				case InsStatusLost:
+					etype = EvInsLost
+				}
+			case pathInsStop:
+				uncanonicalized.Instance = &match[1]
+
+				if src.IsSet() {
+					etype = EvInsStop
+				}
+			case pathInsClaim:
+				uncanonicalized.Instance = &match[1]
+				uncanonicalized.Host = &match[2]
+
+				if src.IsSet() {
+					etype = EvInsClaim
 				}
 			case pathSrv:
 				uncanonicalized.Service = &match[1]
@@ -297,6 +406,22 @@ func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
 				} else if src.IsDel() {
 					etype = EvEpUnreg
 				}
+			case pathPm:
+				uncanonicalized.Host = &match[1]
+
+				if src.IsSet() {
+					etype = EvPmReg
+				} else if src.IsDel() {
+					etype = EvPmUnreg
+				}
+			case pathProxy:
+				uncanonicalized.Host = &match[1]
+
+				if src.IsSet() {
+					etype = EvProxyReg
+				} else if src.IsDel() {
+					etype = EvProxyUnreg
+				}
 			}
 			break
 		}
@@ -304,7 +429,9 @@ func enrichEvent(s Snapshot, src *doozer.Event) (event *Event, err error) {
 
 	if src.IsSet() {
 		canonicalized, err = canonicalizeMetadata(s, etype, uncanonicalized)
-		if err != nil {
+		if err != nil && hasOptionalSource(etype) {
+			canonicalized, err = nil, nil
+		} else if err != nil {
 			fmt.Printf("error canonicalizing inputs: %s\n", err)
 			return nil, err
 		}
@@ -6,6 +6,7 @@
 package visor
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"strconv"
@@ -14,7 +15,7 @@ import (
 )
 
 func eventSetup() (s Snapshot, l chan *Event) {
-	s, err := Dial(DefaultAddr, "/event-test")
+	s, err := testDial("/event-test")
 	if err != nil {
 		panic(err)
 	}
@@ -122,6 +123,7 @@ func TestEventRevRegistered(t *testing.T) {
 		t.Error(err)
 	}
 
+	expectEvent(EvRevArchive, rev, l, t)
 	ev := expectEvent(EvRevReg, rev, l, t)
 	if ev.Path.Revision == nil || (*ev.Path.Revision != rev.Ref) {
 		t.Error("event.Path doesn't contain expected data")
@@ -226,6 +228,34 @@ func TestEventProcTypeUnregistered(t *testing.T) {
 	}
 }
 
+func TestEventProcTypeScaleChanged(t *testing.T) {
+	s, l := eventSetup()
+	app, err := eventAppSetup("scalestar", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := NewRevision(app, "bang", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pty, err := NewProcType(app, "all", rev.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(pty.Dir.Snapshot.Rev)
+
+	go WatchEvent(s, l)
+
+	if _, err = s.SetDesiredScale(app.Name, rev.Ref, pty.Name, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := expectEvent(EvProcScale, pty, l, t)
+	if ev.Path.Revision == nil || *ev.Path.Revision != rev.Ref || ev.Body != "4" {
+		t.Errorf("event doesn't contain the new desired scale: %#v", ev)
+	}
+}
+
 func TestEventInstanceRegistered(t *testing.T) {
 	s, l := eventSetup()
 	app := eventAppSetup("regmouse", s)
@@ -276,16 +306,26 @@ func TestEventInstanceStateChange(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	s = s.FastForward(ins.Dir.Snapshot.Rev)
-
 	ins, err = ins.Claim(ip)
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Only stopped instances can exit
+	other, err := RegisterInstance("statemouse", "stable-state", "web-state", ins.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err = other.Claim(ip); err != nil {
+		t.Fatal(err)
+	}
+	if other, err = other.Started(ip, port+1, host); err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(other.Dir.Snapshot.Rev)
 
 	go WatchEvent(s, l)
 
-	ins, err = ins.Started(ip, port, host)
+	ins, err = ins.FastForward(s.Rev).Started(ip, port, host)
 	if err != nil {
 		t.Error(err)
 	}
@@ -306,11 +346,17 @@ func TestEventInstanceStateChange(t *testing.T) {
 	}
 	expectEvent(EvInsFail, ins, l, t)
 
-	ins, err = ins.Exited(ip)
+	s, err = StopInstance(other.Id, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvInsStop, other, l, t)
+
+	other, err = other.FastForward(s.Rev).Exited(ip)
 	if err != nil {
 		t.Error(err)
 	}
-	expectEvent(EvInsExit, ins, l, t)
+	expectEvent(EvInsExit, other, l, t)
 }
 
 func TestEventSrvRegistered(t *testing.T) {
@@ -390,3 +436,261 @@ func TestEventEpUnregistered(t *testing.T) {
 
 	expectEvent(EvEpUnreg, nil, l, t)
 }
+
+func TestEventAppEnv(t *testing.T) {
+	s, l := eventSetup()
+	app := eventAppSetup("envcat", s)
+
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(app.Dir.Snapshot.Rev)
+
+	go WatchEvent(s, l)
+
+	app, err = app.SetEnvironmentVar("JAVA_OPTS", "-Xmx1g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvAppEnvSet, app, l, t)
+	if ev.Path.App == nil || *ev.Path.App != app.Name {
+		t.Error("event.Path doesn't contain expected data")
+	}
+	if ev.Path.Env == nil || *ev.Path.Env != "JAVA_OPTS" {
+		t.Errorf("expected env var JAVA_OPTS, got %v", ev.Path.Env)
+	}
+	if ev.Body != "-Xmx1g" {
+		t.Errorf("expected body -Xmx1g, got %s", ev.Body)
+	}
+
+	_, err = app.DelEnvironmentVar("JAVA_OPTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = expectEvent(EvAppEnvDel, nil, l, t)
+	if ev.Path.Env == nil || *ev.Path.Env != "JAVA_OPTS" {
+		t.Errorf("expected env var JAVA_OPTS, got %v", ev.Path.Env)
+	}
+}
+
+func TestEventAppHead(t *testing.T) {
+	s, l := eventSetup()
+	app := eventAppSetup("headcat", s)
+
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(app.Dir.Snapshot.Rev)
+
+	go WatchEvent(s, l)
+
+	_, err = app.SetHead("f00bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvAppHead, app, l, t)
+	if ev.Source.(*App).Head != "f00bar" {
+		t.Errorf("expected head f00bar, got %s", ev.Source.(*App).Head)
+	}
+}
+
+func TestEventRevArchive(t *testing.T) {
+	s, l := eventSetup()
+	app := eventAppSetup("archivedog", s)
+
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(app.Dir.Snapshot.Rev)
+
+	rev, err := NewRevision(app, "stable", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev.Dir.Snapshot.Rev)
+
+	go WatchEvent(s, l)
+
+	_, err = rev.SetArchiveUrl("http://archive/archivedog.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvRevArchive, rev, l, t)
+	if ev.Source.(*Revision).ArchiveUrl != "http://archive/archivedog.tgz" {
+		t.Errorf("unexpected archive url %s", ev.Source.(*Revision).ArchiveUrl)
+	}
+}
+
+func TestEventInstanceClaimStop(t *testing.T) {
+	s, l := eventSetup()
+
+	ins, err := RegisterInstance("claimmouse", "stable", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(ins.Dir.Snapshot.Rev)
+
+	go WatchEvent(s, l)
+
+	ins, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvInsClaim, ins, l, t)
+	if ev.Path.Host == nil || *ev.Path.Host != "10.0.0.1" {
+		t.Errorf("expected claim host 10.0.0.1, got %v", ev.Path.Host)
+	}
+
+	_, err = ins.Dir.set(stopPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = expectEvent(EvInsStop, ins, l, t)
+	if ev.Path.Instance == nil || *ev.Path.Instance != strconv.FormatInt(ins.Id, 10) {
+		t.Error("event.Path doesn't contain expected data")
+	}
+}
+
+func TestEventPmProxy(t *testing.T) {
+	s, l := eventSetup()
+
+	go WatchEvent(s, l)
+
+	s, err := s.RegisterPm("10.0.0.2", "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvPmReg, &Pm{}, l, t)
+	if ev.Path.Host == nil || *ev.Path.Host != "10.0.0.2" {
+		t.Errorf("expected host 10.0.0.2, got %v", ev.Path.Host)
+	}
+	if pm, ok := ev.Source.(*Pm); !ok || pm.Host != "10.0.0.2" || pm.Version != "0.1.0" {
+		t.Errorf("unexpected source %#v", ev.Source)
+	}
+	if err = s.UnregisterPm("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvPmUnreg, nil, l, t)
+
+	s, err = s.RegisterProxy("10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = expectEvent(EvProxyReg, &Proxy{}, l, t)
+	if ev.Path.Host == nil || *ev.Path.Host != "10.0.0.3" {
+		t.Errorf("expected host 10.0.0.3, got %v", ev.Path.Host)
+	}
+	if proxy, ok := ev.Source.(*Proxy); !ok || proxy.Host != "10.0.0.3" {
+		t.Errorf("unexpected source %#v", ev.Source)
+	}
+	if err = s.UnregisterProxy("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvProxyUnreg, nil, l, t)
+}
+
+func TestEventMissingSource(t *testing.T) {
+	s, l := eventSetup()
+
+	go WatchEvent(s, l)
+
+	// The env of an app which isn't registered
+	s, err := s.set("/apps/ghostcat/env/KEY", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvAppEnvSet, nil, l, t)
+	if ev.Path.App == nil || *ev.Path.App != "ghostcat" {
+		t.Errorf("expected app ghostcat, got %v", ev.Path.App)
+	}
+
+	// The watch goes on
+	if _, err = s.RegisterPm("10.0.0.2", "0.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvPmReg, &Pm{}, l, t)
+}
+
+func TestEventWatchContextCancel(t *testing.T) {
+	s, err := DialUri("mem:", "/event-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := make(chan *Event)
+	errch := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		errch <- WatchEventContext(ctx, s, l)
+	}()
+
+	_, err = NewApp("cancelcat", "git://cancelcat", "stack", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(EvAppReg, &App{}, l, t)
+
+	cancel()
+
+	select {
+	case err = <-errch:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher didn't return after cancellation")
+	}
+	if _, ok := <-l; ok {
+		t.Error("expected listener to be closed")
+	}
+}
+
+func TestEventReplay(t *testing.T) {
+	s, err := DialUri("mem:", "/event-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := make(chan *Event)
+
+	app, err := NewApp("replaycat", "git://replaycat", "stack", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewService("replaysrv", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go WatchEvent(s.FastForward(-1).Rewind(s.Rev), l)
+
+	ev := expectEvent(EvAppReg, app, l, t)
+	expectEvent(EvSrvReg, &Service{}, l, t)
+
+	// Resume after the first event
+	l = make(chan *Event)
+
+	go WatchEvent(s.FastForward(-1).Rewind(ev.Rev), l)
+
+	expectEvent(EvSrvReg, &Service{}, l, t)
+}
+
+func TestEventReplayTooOld(t *testing.T) {
+	s, err := DialUri("mem:?history=2", "/event-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err = NewService("gapsrv"+strconv.Itoa(i), s.FastForward(-1)).Register()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = WatchEvent(s.FastForward(-1).Rewind(s.Rev), make(chan *Event))
+	if !IsErrRevTooOld(err) {
+		t.Errorf("expected ErrRevTooOld, got %v", err)
+	}
+}
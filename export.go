@@ -0,0 +1,420 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// ExportVersion is the version of the document format
+// written by Export and understood by Import.
+const ExportVersion = 1
+
+// exportDoc is the root of an exported registry document.
+// File values are kept as they are stored in the coordinator,
+// so that an import restores them unchanged.
+type exportDoc struct {
+	Version       int               `json:"version"`
+	SchemaVersion *string           `json:"schema-version,omitempty"`
+	Rev           int64             `json:"rev"`
+	NextPort      *string           `json:"next-port,omitempty"`
+	Apps          []*exportApp      `json:"apps"`
+	Instances     []*exportInstance `json:"instances"`
+	Services      []*exportService  `json:"services"`
+	Pms           map[string]string `json:"pms"`
+	Proxies       map[string]string `json:"proxies"`
+}
+
+type exportApp struct {
+	Name       string            `json:"name"`
+	Attrs      json.RawMessage   `json:"attrs,omitempty"`
+	Registered *string           `json:"registered,omitempty"`
+	Head       *string           `json:"head,omitempty"`
+	Env        map[string]string `json:"env"`
+	Revisions  []*exportRevision `json:"revisions"`
+	ProcTypes  []*exportProcType `json:"proctypes"`
+}
+
+type exportRevision struct {
+	Ref        string  `json:"ref"`
+	ArchiveUrl string  `json:"archive-url"`
+	Registered *string `json:"registered,omitempty"`
+}
+
+type exportProcType struct {
+	Name         string                       `json:"name"`
+	Port         string                       `json:"port"`
+	Registered   *string                      `json:"registered,omitempty"`
+	DesiredScale map[string]string            `json:"desired-scale"`
+	Rollout      *string                      `json:"rollout,omitempty"`
+	Canary       *string                      `json:"canary,omitempty"`
+	Instances    map[string]map[string]string `json:"instances"`
+	Failed       map[string]string            `json:"failed"`
+}
+
+type exportInstance struct {
+	Id      string            `json:"id"`
+	Object  string            `json:"object"`
+	Start   *string           `json:"start,omitempty"`
+	Status  *string           `json:"status,omitempty"`
+	Stop    *string           `json:"stop,omitempty"`
+	History *string           `json:"history,omitempty"`
+	Claims  map[string]string `json:"claims"`
+}
+
+type exportService struct {
+	Name       string            `json:"name"`
+	Registered *string           `json:"registered,omitempty"`
+	Endpoints  map[string]string `json:"endpoints"`
+}
+
+// Export serializes the registry at the given snapshot into
+// a versioned JSON document, which can be restored with Import.
+//
+// The desired scales of proctypes are exported, as well as their
+// last rollout and canary, so that deploys interrupted by the loss
+// of the coordinator can be resumed or aborted after an import.
+// Instance leases are not: they are renewed by the heartbeats of
+// the process managers, which prove the instances alive again.
+func Export(s Snapshot) ([]byte, error) {
+	doc, err := exportRegistry(s)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// Import restores a document created by Export into the coordinator,
+// and returns a snapshot of the coordinator after the import. Unless
+// overwrite is true, the import is refused with ErrKeyConflict if
+// any of the files to be written already exists.
+//
+// Note that instance ids are restored as they are, while new ids
+// are derived from the coordinator revision. After importing into a
+// coordinator which is behind the exported one, RegisterInstance
+// fails with ErrKeyConflict when it is handed the id of an imported
+// instance, and can be retried with the next id.
+func Import(s Snapshot, data []byte, overwrite bool) (Snapshot, error) {
+	doc := &exportDoc{}
+
+	if err := json.Unmarshal(data, doc); err != nil {
+		return s, err
+	}
+	if doc.Version != ExportVersion {
+		return s, fmt.Errorf("unsupported export version %d, expected %d", doc.Version, ExportVersion)
+	}
+
+	files := doc.files()
+
+	if !overwrite {
+		for _, p := range sortedFileKeys(files) {
+			exists, _, err := s.conn.Exists(p)
+			if err != nil {
+				return s, err
+			}
+			if exists {
+				return s, NewError(ErrKeyConflict, fmt.Sprintf("path '%s' already exists", p))
+			}
+		}
+	}
+
+	for _, p := range sortedFileKeys(files) {
+		rev, err := s.conn.Set(p, -1, []byte(files[p]))
+		if err != nil {
+			return s, err
+		}
+		s = s.FastForward(rev)
+	}
+	return s, nil
+}
+
+func exportRegistry(s Snapshot) (doc *exportDoc, err error) {
+	doc = &exportDoc{
+		Version:   ExportVersion,
+		Rev:       s.Rev,
+		Apps:      []*exportApp{},
+		Instances: []*exportInstance{},
+		Services:  []*exportService{},
+	}
+
+	if doc.SchemaVersion, err = getOptional(s, schemaPath); err != nil {
+		return
+	}
+	if doc.NextPort, err = getOptional(s, nextPortPath); err != nil {
+		return
+	}
+	if doc.Pms, err = getFiles(s, pmDir); err != nil {
+		return
+	}
+	if doc.Proxies, err = getFiles(s, proxyDir); err != nil {
+		return
+	}
+
+	names, err := getdirOrEmpty(s, appsPath)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var app *exportApp
+
+		if app, err = exportApplication(s, name); err != nil {
+			return
+		}
+		doc.Apps = append(doc.Apps, app)
+	}
+
+	ids, err := getdirOrEmpty(s, instancesPath)
+	if err != nil {
+		return
+	}
+	sortInstanceIds(ids)
+
+	for _, id := range ids {
+		p := path.Join(instancesPath, id)
+		ins := &exportInstance{Id: id}
+
+		if ins.Object, _, err = s.get(p + "/object"); err != nil {
+			return
+		}
+		if ins.Start, err = getOptional(s, p+"/"+startPath); err != nil {
+			return
+		}
+		if ins.Status, err = getOptional(s, p+"/"+statusPath); err != nil {
+			return
+		}
+		if ins.Stop, err = getOptional(s, p+"/"+stopPath); err != nil {
+			return
+		}
+		if ins.History, err = getOptional(s, p+"/"+historyPath); err != nil {
+			return
+		}
+		if ins.Claims, err = getFiles(s, p+"/"+claimsPath); err != nil {
+			return
+		}
+		doc.Instances = append(doc.Instances, ins)
+	}
+
+	names, err = getdirOrEmpty(s, servicesPath)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		p := path.Join(servicesPath, name)
+		srv := &exportService{Name: name}
+
+		if srv.Registered, err = getOptional(s, p+"/registered"); err != nil {
+			return
+		}
+		if srv.Endpoints, err = getFiles(s, p+"/"+endpointsPath); err != nil {
+			return
+		}
+		doc.Services = append(doc.Services, srv)
+	}
+	return
+}
+
+func exportApplication(s Snapshot, name string) (app *exportApp, err error) {
+	p := path.Join(appsPath, name)
+	app = &exportApp{Name: name, Revisions: []*exportRevision{}, ProcTypes: []*exportProcType{}}
+
+	attrs, err := getOptional(s, p+"/attrs")
+	if err != nil {
+		return
+	}
+	if attrs != nil {
+		app.Attrs = json.RawMessage(*attrs)
+	}
+
+	if app.Registered, err = getOptional(s, p+"/registered"); err != nil {
+		return
+	}
+	if app.Head, err = getOptional(s, p+"/head"); err != nil {
+		return
+	}
+	if app.Env, err = getFiles(s, p+"/env"); err != nil {
+		return
+	}
+
+	refs, err := getdirOrEmpty(s, path.Join(p, revsPath))
+	if err != nil {
+		return
+	}
+	for _, ref := range refs {
+		rp := path.Join(p, revsPath, ref)
+		rev := &exportRevision{Ref: ref}
+
+		if rev.ArchiveUrl, _, err = s.get(rp + "/archive-url"); err != nil {
+			return
+		}
+		if rev.Registered, err = getOptional(s, rp+"/registered"); err != nil {
+			return
+		}
+		app.Revisions = append(app.Revisions, rev)
+	}
+
+	ptys, err := getdirOrEmpty(s, path.Join(p, procsPath))
+	if err != nil {
+		return
+	}
+	for _, pty := range ptys {
+		pp := path.Join(p, procsPath, pty)
+		proc := &exportProcType{Name: pty, Instances: map[string]map[string]string{}}
+
+		if proc.Port, _, err = s.get(pp + "/port"); err != nil {
+			return
+		}
+		if proc.Registered, err = getOptional(s, pp+"/registered"); err != nil {
+			return
+		}
+		if proc.Failed, err = getFiles(s, pp+"/"+failedPath); err != nil {
+			return
+		}
+		if proc.DesiredScale, err = getFiles(s, pp+"/"+desiredScalePath); err != nil {
+			return
+		}
+		if proc.Rollout, err = getOptional(s, pp+"/"+rolloutPath); err != nil {
+			return
+		}
+		if proc.Canary, err = getOptional(s, pp+"/"+canaryPath); err != nil {
+			return
+		}
+
+		var revs []string
+
+		if revs, err = getdirOrEmpty(s, path.Join(pp, instancesPath)); err != nil {
+			return
+		}
+		for _, rev := range revs {
+			if proc.Instances[rev], err = getFiles(s, path.Join(pp, instancesPath, rev)); err != nil {
+				return
+			}
+		}
+		app.ProcTypes = append(app.ProcTypes, proc)
+	}
+	return
+}
+
+// files returns all files described by the document, by path.
+func (doc *exportDoc) files() map[string]string {
+	files := map[string]string{}
+
+	setOptional := func(p string, v *string) {
+		if v != nil {
+			files[p] = *v
+		}
+	}
+	setAll := func(dir string, kvs map[string]string) {
+		for k, v := range kvs {
+			files[path.Join(dir, k)] = v
+		}
+	}
+
+	setOptional(schemaPath, doc.SchemaVersion)
+	setOptional(nextPortPath, doc.NextPort)
+	setAll(pmDir, doc.Pms)
+	setAll(proxyDir, doc.Proxies)
+
+	for _, app := range doc.Apps {
+		p := path.Join("/", appsPath, app.Name)
+
+		if app.Attrs != nil {
+			files[p+"/attrs"] = string(app.Attrs)
+		}
+		setOptional(p+"/registered", app.Registered)
+		setOptional(p+"/head", app.Head)
+		setAll(p+"/env", app.Env)
+
+		for _, rev := range app.Revisions {
+			rp := path.Join(p, revsPath, rev.Ref)
+
+			files[rp+"/archive-url"] = rev.ArchiveUrl
+			setOptional(rp+"/registered", rev.Registered)
+		}
+		for _, proc := range app.ProcTypes {
+			pp := path.Join(p, procsPath, proc.Name)
+
+			files[pp+"/port"] = proc.Port
+			setOptional(pp+"/registered", proc.Registered)
+			setAll(path.Join(pp, failedPath), proc.Failed)
+			setAll(path.Join(pp, desiredScalePath), proc.DesiredScale)
+			setOptional(pp+"/"+rolloutPath, proc.Rollout)
+			setOptional(pp+"/"+canaryPath, proc.Canary)
+
+			for rev, ids := range proc.Instances {
+				setAll(path.Join(pp, instancesPath, rev), ids)
+			}
+		}
+	}
+	for _, ins := range doc.Instances {
+		p := path.Join("/", instancesPath, ins.Id)
+
+		files[p+"/object"] = ins.Object
+		setOptional(p+"/"+startPath, ins.Start)
+		setOptional(p+"/"+statusPath, ins.Status)
+		setOptional(p+"/"+stopPath, ins.Stop)
+		setOptional(p+"/"+historyPath, ins.History)
+		setAll(path.Join(p, claimsPath), ins.Claims)
+	}
+	for _, srv := range doc.Services {
+		p := path.Join("/", servicesPath, srv.Name)
+
+		setOptional(p+"/registered", srv.Registered)
+		setAll(path.Join(p, endpointsPath), srv.Endpoints)
+	}
+	return files
+}
+
+// getOptional returns the value of the file at path,
+// or nil if it doesn't exist.
+func getOptional(s Snapshot, path string) (*string, error) {
+	val, _, err := s.get(path)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &val, nil
+}
+
+// getFiles returns the values of all files in the directory
+// at path, by name. Missing directories are returned as empty.
+func getFiles(s Snapshot, path string) (files map[string]string, err error) {
+	names, err := getdirOrEmpty(s, path)
+	if err != nil {
+		return
+	}
+	values, err := s.conn.GetMulti(path, names, s.Rev)
+	if err != nil {
+		return
+	}
+	files = map[string]string{}
+
+	for k, v := range values {
+		files[k] = string(v)
+	}
+	return
+}
+
+func sortedFileKeys(files map[string]string) (keys []string) {
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// sortInstanceIds sorts a list of instance ids numerically.
+func sortInstanceIds(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.ParseInt(ids[i], 10, 64)
+		b, _ := strconv.ParseInt(ids[j], 10, 64)
+		return a < b
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"path"
+	"testing"
+)
+
+func exportSetup(uri string) (s Snapshot) {
+	s, err := DialUri(uri, "/export-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+func TestExportImport(t *testing.T) {
+	s := exportSetup("mem:")
+
+	app := NewApp("exportcat", "git://exportcat.git", "stack", s)
+	app.Env["FOO"] = "bar"
+	app, err := app.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = app.SetHead("f00babe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := NewRevision(app, "f00babe", app.Dir.Snapshot)
+	rev.ArchiveUrl = "http://artifacts/exportcat/f00babe.img"
+	rev, err = rev.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pty, err := NewProcType(app, "web", rev.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = pty.Dir.Snapshot.SetDesiredScale(app.Name, rev.Ref, pty.Name, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance(app.Name, rev.Ref, pty.Name, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Started("10.0.0.1", 9999, "cat.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = ins.Heartbeat("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err := NewRollout(app.Name, pty.Name, "", rev.Ref, 1, ins.Dir.Snapshot).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = ro.Dir.Snapshot.RegisterPm("10.0.0.1", "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Export(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := exportSetup("mem:")
+
+	_, err = Import(dst, doc, false)
+	if err == nil || err.(*Error).Err != ErrKeyConflict {
+		t.Fatalf("expected import over an initialized coordinator to conflict, got %v", err)
+	}
+
+	dst, err = Import(dst, doc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app1, err := GetApp(dst, app.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app1.Head != app.Head || app1.RepoUrl != app.RepoUrl {
+		t.Errorf("app not restored correctly: %#v", app1)
+	}
+	if v, err := app1.GetEnvironmentVar("FOO"); err != nil || v != "bar" {
+		t.Errorf("env not restored correctly: %s %v", v, err)
+	}
+	rev1, err := GetRevision(dst, app1, rev.Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev1.ArchiveUrl != rev.ArchiveUrl {
+		t.Errorf("revision not restored correctly: %#v", rev1)
+	}
+	pty1, err := GetProcType(dst, app1, pty.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pty1.Port != pty.Port {
+		t.Errorf("proctype not restored correctly: %#v", pty1)
+	}
+	if scale, _, err := dst.GetDesiredScale(app.Name, rev.Ref, pty.Name); err != nil || scale != 1 {
+		t.Errorf("desired scale not restored correctly: %d %v", scale, err)
+	}
+	if ro1, err := GetRollout(dst, app.Name, pty.Name); err != nil || ro1.State != RolloutRunning || ro1.To != rev.Ref {
+		t.Errorf("rollout not restored correctly: %#v %v", ro1, err)
+	}
+	if exists, _, _ := dst.exists(path.Join(instancePath(ins.Id), leasePath)); exists {
+		t.Error("expected the lease not to be restored")
+	}
+	ins1, err := GetInstance(dst, ins.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins1.Status != InsStatusRunning || ins1.Host != ins.Host || ins1.Port != ins.Port {
+		t.Errorf("instance not restored correctly: %#v", ins1)
+	}
+	ids, err := pty1.InstanceIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("expected 1 instance id, got %v", ids)
+	}
+	pms, err := dst.GetPms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pms) != 1 || pms[0] != "10.0.0.1" {
+		t.Errorf("pms not restored correctly: %v", pms)
+	}
+
+	doc1, err := Export(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := Diff(s, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.IsEmpty() {
+		t.Errorf("expected no differences after import, got %s", cs)
+	}
+	if len(doc1) != len(doc) {
+		t.Errorf("expected re-export to match export")
+	}
+}
+
+func TestImportVersion(t *testing.T) {
+	s := exportSetup("mem:")
+
+	_, err := Import(s, []byte(`{"version": 0}`), true)
+	if err == nil {
+		t.Error("expected import of unknown version to fail")
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A GCPolicy tells GC which exited and failed instances to remove.
+type GCPolicy struct {
+	// KeepFailed is the number of failures kept per proctype. Older
+	// failures are removed along with their instances. Zero keeps
+	// all failures, so that they are only removed when asked for.
+	KeepFailed int
+
+	// MaxExitedAge is the age after which exited and lost instances
+	// are removed, based on the time they exited or were lost, or
+	// on the time they were last claimed for instances registered
+	// before histories were kept. Zero keeps all exited and lost
+	// instances.
+	MaxExitedAge time.Duration
+
+	// DryRun makes GC report the instances it would remove
+	// without removing them.
+	DryRun bool
+}
+
+// Garbage is an instance removed by GC, or which
+// would have been removed on a dry run.
+type Garbage struct {
+	Id     int64
+	Ref    string // app:proc@rev of the instance, if known
+	Status InsStatus
+	Reason string
+}
+
+func (g *Garbage) String() string {
+	return fmt.Sprintf("%d %s %s: %s", g.Id, g.Ref, g.Status, g.Reason)
+}
+
+// GC removes the exited, lost and failed instances which are no longer
+// retained by the policy, and returns what it removed.
+func GC(s Snapshot, p GCPolicy) (garbage []*Garbage, err error) {
+	if p.KeepFailed > 0 {
+		garbage, err = gcFailed(s, p)
+		if err != nil {
+			return
+		}
+	}
+	if p.MaxExitedAge > 0 {
+		g, err := gcExited(s, p, time.Now())
+		garbage = append(garbage, g...)
+		if err != nil {
+			return garbage, err
+		}
+	}
+	return
+}
+
+// failure is an entry of the failed instances of a proctype.
+type failure struct {
+	id   int64
+	path string
+	time time.Time
+	body string
+}
+
+func gcFailed(s Snapshot, p GCPolicy) (garbage []*Garbage, err error) {
+	apps, err := s.getdir(appsPath)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, app := range apps {
+		procs, err := s.getdir(path.Join(appsPath, app, procsPath))
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			return garbage, err
+		}
+		for _, proc := range procs {
+			g, err := gcProcFailed(s, p, path.Join(appsPath, app, procsPath, proc, failedPath))
+			garbage = append(garbage, g...)
+			if err != nil {
+				return garbage, err
+			}
+		}
+	}
+	return
+}
+
+func gcProcFailed(s Snapshot, p GCPolicy, dir string) (garbage []*Garbage, err error) {
+	ids, err := s.getdir(dir)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil || len(ids) <= p.KeepFailed {
+		return
+	}
+
+	failures := []*failure{}
+	for _, name := range ids {
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		f := &failure{id: id, path: path.Join(dir, name)}
+
+		if f.body, _, err = s.get(f.path); err != nil {
+			return nil, err
+		}
+		// Entries without a valid timestamp are considered oldest
+		f.time, _ = time.Parse(time.RFC3339, strings.SplitN(f.body, " ", 2)[0])
+
+		failures = append(failures, f)
+	}
+	// Most recent first
+	sort.Slice(failures, func(i, j int) bool {
+		if !failures[i].time.Equal(failures[j].time) {
+			return failures[i].time.After(failures[j].time)
+		}
+		return failures[i].id > failures[j].id
+	})
+	if len(failures) <= p.KeepFailed {
+		return nil, nil
+	}
+
+	for _, f := range failures[p.KeepFailed:] {
+		g := &Garbage{Id: f.id, Status: InsStatusFailed, Reason: fmt.Sprintf("more than %d failures: %s", p.KeepFailed, f.body)}
+		if ins, err := GetInstance(s, f.id); err == nil {
+			g.Ref = ins.RefString()
+		}
+		if !p.DryRun {
+			// The failure entry is removed last, so that
+			// it's found again if removing the instance fails.
+			if err = s.del(instancePath(f.id)); err != nil && !IsErrNoEnt(err) {
+				return
+			}
+			if err = s.del(f.path); err != nil {
+				return
+			}
+		}
+		garbage = append(garbage, g)
+	}
+	return garbage, nil
+}
+
+func gcExited(s Snapshot, p GCPolicy, now time.Time) (garbage []*Garbage, err error) {
+	ids, err := s.getdir(instancesPath)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, name := range ids {
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		ins, err := GetInstance(s, id)
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			return garbage, err
+		}
+		if ins.Status != InsStatusExited && ins.Status != InsStatusLost {
+			continue
+		}
+		since, err := ins.lastTransition(ins.Status)
+		if err == nil && since.IsZero() {
+			since, err = ins.lastClaimed()
+		}
+		if err != nil {
+			return garbage, err
+		}
+		if age := now.Sub(since); age > p.MaxExitedAge {
+			if !p.DryRun {
+				if err = ins.Dir.del("/"); err != nil {
+					return garbage, err
+				}
+			}
+			garbage = append(garbage, &Garbage{
+				Id:     id,
+				Ref:    ins.RefString(),
+				Status: ins.Status,
+				Reason: fmt.Sprintf("%s %s ago", ins.Status, age.Truncate(time.Second)),
+			})
+		}
+	}
+	return
+}
+
+// lastClaimed returns the time of the most recent claim of the instance.
+// Instances which were never claimed return the zero time.
+func (i *Instance) lastClaimed() (t time.Time, err error) {
+	hosts, err := i.Dir.Snapshot.getdir(i.Dir.prefix(claimsPath))
+	if IsErrNoEnt(err) {
+		return t, nil
+	} else if err != nil {
+		return
+	}
+	for _, host := range hosts {
+		val, _, err := i.Dir.get(path.Join(claimsPath, host))
+		if err != nil {
+			return t, err
+		}
+		if ct, e := time.Parse(time.RFC3339, val); e == nil && ct.After(t) {
+			t = ct
+		}
+	}
+	return
+}
+
+// A Collector runs GC periodically.
+type Collector struct {
+	// OnCollect is called with the instances removed by every
+	// run of GC which removed any.
+	OnCollect func(garbage []*Garbage)
+
+	// OnError is called when GC fails. If nil, errors are
+	// written to the log.
+	OnError func(err error)
+
+	snapshot Snapshot
+	policy   GCPolicy
+	interval time.Duration
+}
+
+// NewCollector returns a Collector running GC with the
+// given policy at every interval.
+func NewCollector(s Snapshot, p GCPolicy, interval time.Duration) *Collector {
+	return &Collector{snapshot: s, policy: p, interval: interval}
+}
+
+// Run runs GC right away and then at every interval, until
+// ctx is done. It returns ctx.Err(), or an error if the interval
+// isn't positive.
+func (c *Collector) Run(ctx context.Context) error {
+	return runEvery(ctx, c.interval, "gc", c.OnError, func() error {
+		garbage, err := GC(c.snapshot.FastForward(-1), c.policy)
+		if len(garbage) > 0 && c.OnCollect != nil {
+			c.OnCollect(garbage)
+		}
+		return err
+	})
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gcSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/gc-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+// gcInstance registers, claims and starts an instance, and
+// sets its claim time to the given time.
+func gcInstance(s Snapshot, claimed time.Time) *Instance {
+	ins, err := RegisterInstance("gccat", "f00", "web", s.FastForward(-1))
+	if err != nil {
+		panic(err)
+	}
+	if ins, err = ins.Claim("10.0.0.1"); err != nil {
+		panic(err)
+	}
+	if ins, err = ins.Started("10.0.0.1", 9000, "box"); err != nil {
+		panic(err)
+	}
+	rev, err := ins.Dir.set(claimsPath+"/10.0.0.1", claimed.UTC().Format(time.RFC3339))
+	if err != nil {
+		panic(err)
+	}
+	return ins.FastForward(rev)
+}
+
+// gcExitedAt exits the instance, and sets the time of
+// the exit in its history to the given time.
+func gcExitedAt(ins *Instance, exited time.Time) *Instance {
+	ins, err := gcStopped(ins).Exited("10.0.0.1")
+	if err != nil {
+		panic(err)
+	}
+	history, _, err := ins.Dir.get(historyPath)
+	if err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimSpace(history), "\n")
+	entry := strings.SplitN(lines[len(lines)-1], " ", 2)
+	lines[len(lines)-1] = exited.UTC().Format(time.RFC3339) + " " + entry[1]
+
+	rev, err := ins.Dir.set(historyPath, strings.Join(lines, "\n")+"\n")
+	if err != nil {
+		panic(err)
+	}
+	return ins.FastForward(rev)
+}
+
+// gcStopped stops the instance, so that it can exit.
+func gcStopped(ins *Instance) *Instance {
+	s, err := StopInstance(ins.Id, ins.Dir.Snapshot)
+	if err != nil {
+		panic(err)
+	}
+	return ins.FastForward(s.Rev)
+}
+
+func TestGCFailed(t *testing.T) {
+	s := gcSetup()
+	now := time.Now()
+
+	var failed []*Instance
+
+	for i := 0; i < 3; i++ {
+		ins, err := gcInstance(s, now).Failed("10.0.0.1", errors.New("oops"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Failures from oldest to most recent
+		if _, err = ins.Dir.Snapshot.set(ins.ptyFailedPath(), now.Add(time.Duration(i-3)*time.Hour).UTC().Format(time.RFC3339)+" oops"); err != nil {
+			t.Fatal(err)
+		}
+		failed = append(failed, ins)
+	}
+	s = s.FastForward(-1)
+
+	// The zero policy keeps all failures
+	garbage, err := GC(s, GCPolicy{})
+	if err != nil || len(garbage) != 0 {
+		t.Fatalf("expected no instances to be collected, got %v (%v)", garbage, err)
+	}
+
+	garbage, err = GC(s, GCPolicy{KeepFailed: 1, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(garbage) != 2 {
+		t.Fatalf("expected 2 instances to be collected, got %v", garbage)
+	}
+	if exists, _, _ := s.FastForward(-1).exists(failed[0].Dir.Name); !exists {
+		t.Error("expected dry run not to remove anything")
+	}
+
+	garbage, err = GC(s, GCPolicy{KeepFailed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(garbage) != 2 || garbage[0].Ref != "gccat:web@f00" {
+		t.Fatalf("expected 2 instances to be collected, got %v", garbage)
+	}
+	s = s.FastForward(-1)
+
+	for i, ins := range failed {
+		kept := i == 2
+		if exists, _, _ := s.exists(ins.Dir.Name); exists != kept {
+			t.Errorf("expected instance %d to be kept: %t", i, kept)
+		}
+		if exists, _, _ := s.exists(ins.ptyFailedPath()); exists != kept {
+			t.Errorf("expected failure %d to be kept: %t", i, kept)
+		}
+	}
+}
+
+func TestGCExited(t *testing.T) {
+	s := gcSetup()
+	now := time.Now()
+
+	old := gcExitedAt(gcInstance(s, now.Add(-3*time.Hour)), now.Add(-2*time.Hour))
+	recent := gcExitedAt(gcInstance(s, now.Add(-time.Minute)), now.Add(-time.Minute))
+	// Claimed long ago, but only exited now
+	longRunning := gcExitedAt(gcInstance(s, now.Add(-3*time.Hour)), now)
+	running := gcInstance(s, now.Add(-2*time.Hour))
+
+	garbage, err := GC(s.FastForward(-1), GCPolicy{MaxExitedAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(garbage) != 1 || garbage[0].Id != old.Id || garbage[0].Status != InsStatusExited {
+		t.Fatalf("expected instance %d to be collected, got %v", old.Id, garbage)
+	}
+	s = s.FastForward(-1)
+
+	for _, ins := range []*Instance{recent, longRunning, running} {
+		if exists, _, _ := s.exists(ins.Dir.Name); !exists {
+			t.Errorf("expected instance %d to be kept", ins.Id)
+		}
+	}
+	if exists, _, _ := s.exists(old.Dir.Name); exists {
+		t.Errorf("expected instance %d to be removed", old.Id)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	s := gcSetup()
+
+	gcExitedAt(gcInstance(s, time.Now().Add(-2*time.Hour)), time.Now().Add(-2*time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	collected := make(chan []*Garbage, 1)
+
+	c := NewCollector(s, GCPolicy{MaxExitedAge: time.Hour}, time.Hour)
+	c.OnCollect = func(garbage []*Garbage) {
+		collected <- garbage
+	}
+	c.OnError = func(err error) {
+		t.Error(err)
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- c.Run(ctx)
+	}()
+
+	select {
+	case garbage := <-collected:
+		if len(garbage) != 1 {
+			t.Errorf("expected 1 instance to be collected, got %v", garbage)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected collector to run")
+	}
+
+	cancel()
+	if err := <-errch; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
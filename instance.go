@@ -6,8 +6,8 @@
 package visor
 
 import (
+	"context"
 	"fmt"
-	"github.com/soundcloud/doozer"
 	"path"
 	"strconv"
 	"strings"
@@ -30,6 +30,7 @@ const (
 
 	InsStatusFailed = "failed"
 	InsStatusExited = "exited"
+	InsStatusLost   = "lost"
 )
 
 // Instance represents application instances.
@@ -89,7 +90,8 @@ func GetInstance(s Snapshot, id int64) (ins *Instance, err error) {
 		return
 	}
 
-	if status == InsStatusRunning {
+	switch status {
+	case InsStatusPending, InsStatusClaimed, InsStatusRunning:
 		_, _, err := s.get(p + "/stop")
 		if err == nil {
 			status = InsStatusStopping
@@ -144,8 +146,9 @@ func RegisterInstance(app string, rev string, pty string, s Snapshot) (ins *Inst
 	//
 	//   instances/
 	//       6868/
-	// +         object = <app> <rev> <proc>
-	// +         start  =
+	// +         history = 2012-07-19T16:41:05Z - pending
+	// +         object  = <app> <rev> <proc>
+	// +         start   =
 	//
 	//   apps/<app>/procs/<proc>/instances/<rev>
 	// +     6868 = 2012-07-19 16:41 UTC
@@ -163,23 +166,34 @@ func RegisterInstance(app string, rev string, pty string, s Snapshot) (ins *Inst
 		Dir:          dir{s, instancePath(id)},
 	}
 
-	_, err = createFile(s, ins.Dir.prefix("object"), ins.objectArray(), new(listCodec))
+	// Imported instances keep their ids, which can be handed out again
+	exists, _, err := s.conn.Exists(ins.Dir.prefix("object"))
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.set(ins.ptyInstancesPath(), timestamp())
-	if err != nil {
-		return
+	if exists {
+		return nil, NewError(ErrKeyConflict, fmt.Sprintf("instance %d already exists", id))
 	}
-	s1, err := createFile(s, ins.Dir.prefix(startPath), "", new(stringCodec))
+
+	t := s.txn()
+	t.set(ins.Dir.prefix(historyPath), historyEntry("", InsStatusPending, ""))
+	t.setFile(ins.Dir.prefix("object"), ins.objectArray(), new(listCodec))
+	t.set(ins.ptyInstancesPath(), timestamp())
+	t.set(ins.Dir.prefix(startPath), "")
+
+	newrev, err := t.commit()
 	if err != nil {
 		return nil, err
 	}
-	ins = ins.FastForward(s1.Snapshot.Rev)
+	ins = ins.FastForward(newrev)
 
 	return
 }
 
+// StopInstance asks the process manager running the instance to stop
+// it. Pending instances are stopped before being claimed. It fails with
+// ErrInvalidState if the instance is stopping or done already at the
+// latest revision.
 func StopInstance(id int64, s Snapshot) (s1 Snapshot, err error) {
 	//
 	//   instances/
@@ -187,9 +201,17 @@ func StopInstance(id int64, s Snapshot) (s1 Snapshot, err error) {
 	//           ...
 	// +         stop =
 	//
-	// TODO Check that instance is started
-	d := dir{s, instancePath(id)}
-	rev, err := d.set("stop", "")
+	ins, err := GetInstance(s.FastForward(-1), id)
+	if err != nil {
+		return
+	}
+	t := ins.Dir.Snapshot.txn()
+	if err = ins.transition(t, InsStatusStopping, ""); err != nil {
+		return
+	}
+	t.set(ins.Dir.prefix(stopPath), "")
+
+	rev, err := t.commit()
 	if err != nil {
 		return
 	}
@@ -221,7 +243,7 @@ func (i *Instance) Claims() (claims []string, err error) {
 		return
 	}
 	claims, err = i.Dir.Snapshot.conn.Getdir(i.Dir.prefix("claims"), rev)
-	if err, ok := err.(*doozer.Error); ok && err.Err == doozer.ErrNoEnt {
+	if IsErrNoEnt(err) {
 		claims = []string{}
 		err = nil
 	}
@@ -239,21 +261,22 @@ func (i *Instance) Claim(host string) (*Instance, error) {
 	// -         start  =
 	// +         start  = 10.0.0.1
 	//
-	val, rev, err := i.Dir.get(startPath)
+	val, _, err := i.Dir.get(startPath)
 	if err != nil {
 		return nil, err
 	}
 	if val != "" {
 		return nil, ErrInsClaimed
 	}
-	d := i.Dir.fastForward(rev)
 
-	_, err = d.set(startPath, host)
-	if err != nil {
-		return i, err
+	t := i.Dir.Snapshot.txn()
+	if err = i.transition(t, InsStatusClaimed, host); err != nil {
+		return nil, err
 	}
+	t.set(i.Dir.prefix(startPath), host)
+	t.set(i.claimPath(host), timestamp())
 
-	rev, err = i.claimDir().fastForward(rev).set(host, timestamp())
+	rev, err := t.commit()
 	if err != nil {
 		return i, err
 	}
@@ -278,11 +301,19 @@ func (i *Instance) Exited(host string) (i1 *Instance, err error) {
 	if err = i.verifyClaimer(host); err != nil {
 		return
 	}
-	i1, err = i.updateStatus(InsStatusExited)
+	t := i.Dir.Snapshot.txn()
+	if err = i.transition(t, InsStatusExited, host); err != nil {
+		return
+	}
+	t.set(i.Dir.prefix(statusPath), string(InsStatusExited))
+	t.del(i.ptyInstancesPath())
+
+	rev, err := t.commit()
 	if err != nil {
 		return nil, err
 	}
-	err = i.Dir.Snapshot.del(i.ptyInstancesPath())
+	i.Status = InsStatusExited
+	i1 = i.FastForward(rev)
 
 	return
 }
@@ -313,26 +344,22 @@ func (i *Instance) Started(host string, port int, hostname string) (i1 *Instance
 	if err = i.verifyClaimer(host); err != nil {
 		return
 	}
-	i1 = i.FastForward(i.Dir.Snapshot.Rev) // Create a copy
-	i1.started(host, port, hostname)
-
-	f, err := createFile(i1.Dir.Snapshot, i1.Dir.prefix(startPath), i1.startArray(), new(listCodec))
-	if err != nil {
+	t := i.Dir.Snapshot.txn()
+	if err = i.transition(t, InsStatusRunning, host); err != nil {
 		return
 	}
-	i1 = i1.FastForward(f.FileRev)
+	i1 = i.FastForward(i.Dir.Snapshot.Rev) // Create a copy
+	i1.started(host, port, hostname)
 
-	return
-}
+	t.setFile(i1.Dir.prefix(startPath), i1.startArray(), new(listCodec))
 
-func (i *Instance) updateStatus(s InsStatus) (i1 *Instance, err error) {
-	rev, err := i.Dir.set("status", string(s))
+	rev, err := t.commit()
 	if err != nil {
-		return
+		return nil, err
 	}
-	i.Status = s
+	i1 = i1.FastForward(rev)
 
-	return i.FastForward(rev), err
+	return
 }
 
 func (i *Instance) getClaimer() (*string, error) {
@@ -351,10 +378,6 @@ func (i *Instance) getClaimer() (*string, error) {
 	return &fields[0], nil
 }
 
-func (i *Instance) setClaimer(claimer string) (rev int64, err error) {
-	return i.Dir.set(startPath, claimer)
-}
-
 // Unclaim removes the lock applied by Claim of the Ticket.
 func (i *Instance) Unclaim(host string) (i1 *Instance, err error) {
 	//
@@ -367,7 +390,13 @@ func (i *Instance) Unclaim(host string) (i1 *Instance, err error) {
 		return
 	}
 
-	rev, err := i.setClaimer("")
+	t := i.Dir.Snapshot.txn()
+	if err = i.transition(t, InsStatusPending, host); err != nil {
+		return
+	}
+	t.set(i.Dir.prefix(startPath), "")
+
+	rev, err := t.commit()
 	if err != nil {
 		return
 	}
@@ -390,29 +419,47 @@ func (i *Instance) Failed(host string, reason error) (i1 *Instance, err error) {
 	if err = i.verifyClaimer(host); err != nil {
 		return
 	}
-	_, err = i.updateStatus(InsStatusFailed)
-	if err != nil {
+	t := i.Dir.Snapshot.txn()
+	if err = i.transition(t, InsStatusFailed, host); err != nil {
 		return
 	}
-	s, err := i.Dir.Snapshot.set(i.ptyFailedPath(), timestamp()+" "+reason.Error())
-	if err != nil {
-		return
-	}
-	err = i.Dir.Snapshot.del(i.ptyInstancesPath())
+	t.set(i.Dir.prefix(statusPath), string(InsStatusFailed))
+	t.set(i.ptyFailedPath(), timestamp()+" "+reason.Error())
+	t.del(i.ptyInstancesPath())
+
+	rev, err := t.commit()
 	if err != nil {
 		return
 	}
-	i1 = i.FastForward(s.Rev)
+	i.Status = InsStatusFailed
+	i1 = i.FastForward(rev)
 
 	return
 }
 
 func WatchInstanceStart(s Snapshot, listener chan *Instance, errors chan error) {
+	if err := watchInstanceStart(context.Background(), s, listener); err != nil {
+		errors <- err
+	}
+}
+
+// WatchInstanceStartContext is like WatchInstanceStart, but returns
+// on error or once ctx is done, in which case ctx.Err() is returned.
+// The listener channel is closed on return.
+func WatchInstanceStartContext(ctx context.Context, s Snapshot, listener chan *Instance) error {
+	defer close(listener)
+	return watchInstanceStart(ctx, s, listener)
+}
+
+func watchInstanceStart(ctx context.Context, s Snapshot, listener chan *Instance) error {
 	// instances/*/start =
 	rev := s.Rev
 
 	for {
-		ev, err := s.conn.Wait(path.Join(instancesPath, "*", startPath), rev+1)
+		ev, err := s.conn.WaitContext(ctx, path.Join(instancesPath, "*", startPath), rev+1)
+		if err != nil {
+			return err
+		}
 		rev = ev.Rev
 
 		if !ev.IsSet() || string(ev.Body) != "" {
@@ -422,20 +469,29 @@ func WatchInstanceStart(s Snapshot, listener chan *Instance, errors chan error)
 
 		id, err := strconv.ParseInt(idstr, 0, 64)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		ins, err := GetInstance(s.FastForward(rev), id)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		select {
+		case listener <- ins:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		listener <- ins
 	}
 }
 
 func (i *Instance) WaitStop() (i1 *Instance, err error) {
+	return i.WaitStopContext(context.Background())
+}
+
+// WaitStopContext is like WaitStop, but returns ctx.Err() once ctx is done.
+func (i *Instance) WaitStopContext(ctx context.Context) (i1 *Instance, err error) {
 	p := path.Join(instancesPath, strconv.FormatInt(i.Id, 10), stopPath)
 
-	ev, err := i.Dir.Snapshot.conn.Wait(p, i.Dir.Snapshot.Rev+1)
+	ev, err := i.Dir.Snapshot.conn.WaitContext(ctx, p, i.Dir.Snapshot.Rev+1)
 	if err != nil {
 		return
 	}
@@ -445,8 +501,13 @@ func (i *Instance) WaitStop() (i1 *Instance, err error) {
 }
 
 func (i *Instance) WaitStatus() (i1 *Instance, err error) {
+	return i.WaitStatusContext(context.Background())
+}
+
+// WaitStatusContext is like WaitStatus, but returns ctx.Err() once ctx is done.
+func (i *Instance) WaitStatusContext(ctx context.Context) (i1 *Instance, err error) {
 	p := path.Join(instancesPath, strconv.FormatInt(i.Id, 10), statusPath)
-	ev, err := i.Dir.Snapshot.conn.Wait(p, i.Dir.Snapshot.Rev+1)
+	ev, err := i.Dir.Snapshot.conn.WaitContext(ctx, p, i.Dir.Snapshot.Rev+1)
 	if err != nil {
 		return
 	}
@@ -457,16 +518,26 @@ func (i *Instance) WaitStatus() (i1 *Instance, err error) {
 }
 
 func (i *Instance) WaitClaimed() (i1 *Instance, err error) {
-	return i.waitStartPathStatus(InsStatusClaimed)
+	return i.waitStartPathStatus(context.Background(), InsStatusClaimed)
+}
+
+// WaitClaimedContext is like WaitClaimed, but returns ctx.Err() once ctx is done.
+func (i *Instance) WaitClaimedContext(ctx context.Context) (i1 *Instance, err error) {
+	return i.waitStartPathStatus(ctx, InsStatusClaimed)
 }
 
 func (i *Instance) WaitStarted() (i1 *Instance, err error) {
-	return i.waitStartPathStatus(InsStatusRunning)
+	return i.waitStartPathStatus(context.Background(), InsStatusRunning)
+}
+
+// WaitStartedContext is like WaitStarted, but returns ctx.Err() once ctx is done.
+func (i *Instance) WaitStartedContext(ctx context.Context) (i1 *Instance, err error) {
+	return i.waitStartPathStatus(ctx, InsStatusRunning)
 }
 
-func (i *Instance) waitStartPathStatus(s InsStatus) (i1 *Instance, err error) {
+func (i *Instance) waitStartPathStatus(ctx context.Context, s InsStatus) (i1 *Instance, err error) {
 	for {
-		i, err = i.waitStartPath()
+		i, err = i.waitStartPath(ctx)
 		if err != nil {
 			return i, err
 		}
@@ -477,10 +548,10 @@ func (i *Instance) waitStartPathStatus(s InsStatus) (i1 *Instance, err error) {
 	return i, nil
 }
 
-func (i *Instance) waitStartPath() (i1 *Instance, err error) {
+func (i *Instance) waitStartPath(ctx context.Context) (i1 *Instance, err error) {
 	p := path.Join(instancesPath, strconv.FormatInt(i.Id, 10), startPath)
 
-	ev, err := i.Dir.Snapshot.conn.Wait(p, i.Dir.Snapshot.Rev+1)
+	ev, err := i.Dir.Snapshot.conn.WaitContext(ctx, p, i.Dir.Snapshot.Rev+1)
 	if err != nil {
 		return
 	}
@@ -6,13 +6,15 @@
 package visor
 
 import (
+	"context"
 	"errors"
+	"path"
 	"testing"
 	"time"
 )
 
 func instanceSetup() (s Snapshot) {
-	s, err := Dial(DefaultAddr, "/instance-test")
+	s, err := testDial("/instance-test")
 	if err != nil {
 		panic(err)
 	}
@@ -67,6 +69,30 @@ func TestInstanceRegisterAndGet(t *testing.T) {
 	}
 }
 
+func TestInstanceRegisterIdConflict(t *testing.T) {
+	s := instanceSetup()
+
+	// An imported instance with the next id
+	id := s.Rev + 2
+	s, err := s.set(path.Join(instancePath(id), "object"), "cat 128af9 web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = RegisterInstance("dog", "128af9", "web", s)
+	if e, ok := err.(*Error); !ok || e.Err != ErrKeyConflict {
+		t.Fatalf("expected ErrKeyConflict, got %v", err)
+	}
+	ins, err := GetInstance(s.FastForward(-1), id)
+	if err != nil || ins.AppName != "cat" {
+		t.Errorf("expected imported instance to be kept, got %v (%v)", ins, err)
+	}
+
+	if _, err = RegisterInstance("dog", "128af9", "web", s.FastForward(-1)); err != nil {
+		t.Errorf("expected the next id to be free, got %v", err)
+	}
+}
+
 func TestInstanceClaiming(t *testing.T) {
 	host := "10.0.0.1"
 	s := instanceSetup()
@@ -240,6 +266,10 @@ func TestInstanceExited(t *testing.T) {
 		t.Fatal(err)
 	}
 	testInstanceStatus(t, ins.Id, InsStatusExited, ins3.Dir.Snapshot)
+
+	if scale, _, err := ins3.Dir.Snapshot.GetScale("rat-cat", "128af9", "web"); err != nil || scale != 0 {
+		t.Errorf("expected exited instance not to be counted at its snapshot, got scale %d (%v)", scale, err)
+	}
 }
 
 func TestInstanceFailed(t *testing.T) {
@@ -257,6 +287,10 @@ func TestInstanceFailed(t *testing.T) {
 	}
 	testInstanceStatus(t, ins.Id, InsStatusFailed, ins1.Dir.Snapshot)
 
+	if scale, _, err := ins1.Dir.Snapshot.GetScale("fat-cat", "128af9", "web"); err != nil || scale != 0 {
+		t.Errorf("expected failed instance not to be counted at its snapshot, got scale %d (%v)", scale, err)
+	}
+
 	_, err = ins.Failed("9.9.9.9", errors.New("no reason."))
 	if err != ErrUnauthorized {
 		t.Error("expected command to fail")
@@ -395,3 +429,21 @@ func testInstanceStatus(t *testing.T, id int64, status InsStatus, s Snapshot) {
 		t.Errorf("expected instance status to be '%s' got '%s'", status, ins.Status)
 	}
 }
+
+func TestInstanceWaitContextDeadline(t *testing.T) {
+	s, err := DialUri("mem:", "/instance-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance("deadcat", "128af9", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = ins.WaitStartedContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
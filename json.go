@@ -0,0 +1,425 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// The JSON encoding of the registry types holds their fields and
+// the revision of their snapshot, but not the coordinator connection.
+// Decoded values are thus detached: they can be inspected, but must
+// be fetched again from a connected Snapshot before being modified.
+// Parent objects, such as the App of a Revision, are encoded by name.
+
+// SourceType identifies the type of the source of an Event
+// in its JSON encoding.
+type SourceType string
+
+const (
+	SrcApp      = SourceType("app")
+	SrcRevision = SourceType("revision")
+	SrcProcType = SourceType("proctype")
+	SrcInstance = SourceType("instance")
+	SrcService  = SourceType("service")
+	SrcEndpoint = SourceType("endpoint")
+	SrcPm       = SourceType("pm")
+	SrcProxy    = SourceType("proxy")
+)
+
+type appJSON struct {
+	Name       string `json:"name"`
+	RepoUrl    string `json:"repo-url"`
+	Stack      string `json:"stack"`
+	Head       string `json:"head"`
+	Env        Env    `json:"env"`
+	DeployType string `json:"deploy-type"`
+	KeepRevs   int    `json:"keep-revisions,omitempty"`
+	Rev        int64  `json:"rev"`
+}
+
+type revisionJSON struct {
+	App        string `json:"app"`
+	Ref        string `json:"ref"`
+	ArchiveUrl string `json:"archive-url"`
+	Rev        int64  `json:"rev"`
+}
+
+type procTypeJSON struct {
+	App  string `json:"app"`
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	Rev  int64  `json:"rev"`
+}
+
+type instanceJSON struct {
+	Id       int64     `json:"id"`
+	App      string    `json:"app"`
+	Revision string    `json:"revision"`
+	Proctype string    `json:"proctype"`
+	Ip       string    `json:"ip"`
+	Port     int       `json:"port"`
+	Host     string    `json:"host"`
+	Status   InsStatus `json:"status"`
+	Rev      int64     `json:"rev"`
+}
+
+type serviceJSON struct {
+	Name string `json:"name"`
+	Rev  int64  `json:"rev"`
+}
+
+type endpointJSON struct {
+	Service  string `json:"service"`
+	Addr     string `json:"addr"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority"`
+	Target   string `json:"target"`
+	Weight   int    `json:"weight"`
+	Rev      int64  `json:"rev"`
+}
+
+type pmJSON struct {
+	Host       string `json:"host"`
+	Version    string `json:"version"`
+	Registered string `json:"registered"`
+	Rev        int64  `json:"rev"`
+}
+
+type proxyJSON struct {
+	Host       string `json:"host"`
+	Registered string `json:"registered"`
+	Rev        int64  `json:"rev"`
+}
+
+type eventJSON struct {
+	Type       EventType       `json:"type"`
+	Rev        int64           `json:"rev"`
+	Path       string          `json:"path"`
+	Body       string          `json:"body"`
+	App        *string         `json:"app,omitempty"`
+	Revision   *string         `json:"revision,omitempty"`
+	Proctype   *string         `json:"proctype,omitempty"`
+	Instance   *string         `json:"instance,omitempty"`
+	Service    *string         `json:"service,omitempty"`
+	Endpoint   *string         `json:"endpoint,omitempty"`
+	Env        *string         `json:"env,omitempty"`
+	Host       *string         `json:"host,omitempty"`
+	SourceType SourceType      `json:"source-type,omitempty"`
+	Source     json.RawMessage `json:"source,omitempty"`
+}
+
+// detached returns a snapshot at rev without a connection.
+func detached(rev int64) Snapshot {
+	return Snapshot{Rev: rev}
+}
+
+func (a *App) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&appJSON{
+		Name:       a.Name,
+		RepoUrl:    a.RepoUrl,
+		Stack:      a.Stack,
+		Head:       a.Head,
+		Env:        a.Env,
+		DeployType: a.DeployType,
+		KeepRevs:   a.KeepRevisions,
+		Rev:        a.Dir.Snapshot.Rev,
+	})
+}
+
+func (a *App) UnmarshalJSON(data []byte) error {
+	v := &appJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*a = *NewApp(v.Name, v.RepoUrl, v.Stack, detached(v.Rev))
+	a.Head = v.Head
+	a.DeployType = v.DeployType
+	a.KeepRevisions = v.KeepRevs
+	if v.Env != nil {
+		a.Env = v.Env
+	}
+	return nil
+}
+
+func (r *Revision) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&revisionJSON{
+		App:        appName(r.App),
+		Ref:        r.Ref,
+		ArchiveUrl: r.ArchiveUrl,
+		Rev:        r.Dir.Snapshot.Rev,
+	})
+}
+
+func (r *Revision) UnmarshalJSON(data []byte) error {
+	v := &revisionJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	s := detached(v.Rev)
+	*r = *NewRevision(NewApp(v.App, "", "", s), v.Ref, s)
+	r.ArchiveUrl = v.ArchiveUrl
+	return nil
+}
+
+func (p *ProcType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&procTypeJSON{
+		App:  appName(p.App),
+		Name: p.Name,
+		Port: p.Port,
+		Rev:  p.Dir.Snapshot.Rev,
+	})
+}
+
+func (p *ProcType) UnmarshalJSON(data []byte) error {
+	v := &procTypeJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	s := detached(v.Rev)
+	*p = *NewProcType(NewApp(v.App, "", "", s), v.Name, s)
+	p.Port = v.Port
+	return nil
+}
+
+func (i *Instance) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&instanceJSON{
+		Id:       i.Id,
+		App:      i.AppName,
+		Revision: i.RevisionName,
+		Proctype: i.ProcessName,
+		Ip:       i.Ip,
+		Port:     i.Port,
+		Host:     i.Host,
+		Status:   i.Status,
+		Rev:      i.Dir.Snapshot.Rev,
+	})
+}
+
+func (i *Instance) UnmarshalJSON(data []byte) error {
+	v := &instanceJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*i = Instance{
+		Dir:          dir{detached(v.Rev), instancePath(v.Id)},
+		Id:           v.Id,
+		AppName:      v.App,
+		RevisionName: v.Revision,
+		ProcessName:  v.Proctype,
+		Ip:           v.Ip,
+		Port:         v.Port,
+		Host:         v.Host,
+		Status:       v.Status,
+	}
+	return nil
+}
+
+func (s *Service) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&serviceJSON{Name: s.Name, Rev: s.Dir.Snapshot.Rev})
+}
+
+func (s *Service) UnmarshalJSON(data []byte) error {
+	v := &serviceJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*s = *NewService(v.Name, detached(v.Rev))
+	return nil
+}
+
+func (e *Endpoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&endpointJSON{
+		Service:  serviceName(e.Service),
+		Addr:     e.Addr,
+		IP:       e.IP,
+		Port:     e.Port,
+		Priority: e.Priority,
+		Target:   e.Target,
+		Weight:   e.Weight,
+		Rev:      e.Dir.Snapshot.Rev,
+	})
+}
+
+func (e *Endpoint) UnmarshalJSON(data []byte) error {
+	v := &endpointJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	s := detached(v.Rev)
+	srv := NewService(v.Service, s)
+
+	*e = Endpoint{
+		Service:  srv,
+		Addr:     v.Addr,
+		IP:       v.IP,
+		Port:     v.Port,
+		Priority: v.Priority,
+		Target:   v.Target,
+		Weight:   v.Weight,
+	}
+	e.Dir = dir{s, srv.Dir.prefix(endpointsPath, e.Id())}
+	return nil
+}
+
+func appName(app *App) string {
+	if app == nil {
+		return ""
+	}
+	return app.Name
+}
+
+func serviceName(srv *Service) string {
+	if srv == nil {
+		return ""
+	}
+	return srv.Name
+}
+
+func (p *Pm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&pmJSON{
+		Host:       p.Host,
+		Version:    p.Version,
+		Registered: p.Registered,
+		Rev:        p.Dir.Snapshot.Rev,
+	})
+}
+
+func (p *Pm) UnmarshalJSON(data []byte) error {
+	v := &pmJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*p = Pm{Dir: dir{detached(v.Rev), path.Join(pmDir, v.Host)}, Host: v.Host, Version: v.Version, Registered: v.Registered}
+	return nil
+}
+
+func (p *Proxy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&proxyJSON{
+		Host:       p.Host,
+		Registered: p.Registered,
+		Rev:        p.Dir.Snapshot.Rev,
+	})
+}
+
+func (p *Proxy) UnmarshalJSON(data []byte) error {
+	v := &proxyJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	*p = Proxy{Dir: dir{detached(v.Rev), path.Join(proxyDir, v.Host)}, Host: v.Host, Registered: v.Registered}
+	return nil
+}
+
+// SourceType returns the type of the event source,
+// or an empty string if the event has no source.
+func (ev *Event) SourceType() SourceType {
+	switch ev.Source.(type) {
+	case *App:
+		return SrcApp
+	case *Revision:
+		return SrcRevision
+	case *ProcType:
+		return SrcProcType
+	case *Instance:
+		return SrcInstance
+	case *Service:
+		return SrcService
+	case *Endpoint:
+		return SrcEndpoint
+	case *Pm:
+		return SrcPm
+	case *Proxy:
+		return SrcProxy
+	}
+	return ""
+}
+
+func (ev *Event) MarshalJSON() (data []byte, err error) {
+	v := &eventJSON{
+		Type:       ev.Type,
+		Rev:        ev.Rev,
+		Body:       ev.Body,
+		App:        ev.Path.App,
+		Revision:   ev.Path.Revision,
+		Proctype:   ev.Path.Proctype,
+		Instance:   ev.Path.Instance,
+		Service:    ev.Path.Service,
+		Endpoint:   ev.Path.Endpoint,
+		Env:        ev.Path.Env,
+		Host:       ev.Path.Host,
+		SourceType: ev.SourceType(),
+	}
+	if ev.raw != nil {
+		v.Path = ev.raw.Path
+	}
+	if v.SourceType != "" {
+		if v.Source, err = json.Marshal(ev.Source); err != nil {
+			return
+		}
+	}
+	return json.Marshal(v)
+}
+
+func (ev *Event) UnmarshalJSON(data []byte) error {
+	v := &eventJSON{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	var source snapshotable
+
+	switch v.SourceType {
+	case "":
+	case SrcApp:
+		source = &App{}
+	case SrcRevision:
+		source = &Revision{}
+	case SrcProcType:
+		source = &ProcType{}
+	case SrcInstance:
+		source = &Instance{}
+	case SrcService:
+		source = &Service{}
+	case SrcEndpoint:
+		source = &Endpoint{}
+	case SrcPm:
+		source = &Pm{}
+	case SrcProxy:
+		source = &Proxy{}
+	default:
+		return fmt.Errorf("unknown event source type '%s'", v.SourceType)
+	}
+	if source != nil {
+		if err := json.Unmarshal(v.Source, source); err != nil {
+			return err
+		}
+	}
+
+	*ev = Event{
+		Type:   v.Type,
+		Body:   v.Body,
+		Source: source,
+		Path: EventData{
+			App:      v.App,
+			Endpoint: v.Endpoint,
+			Env:      v.Env,
+			Host:     v.Host,
+			Instance: v.Instance,
+			Proctype: v.Proctype,
+			Revision: v.Revision,
+			Service:  v.Service,
+		},
+		Rev: v.Rev,
+	}
+	if v.Path != "" {
+		ev.raw = &BackendEvent{Rev: v.Rev, Path: path.Clean(v.Path), Body: []byte(v.Body)}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func jsonSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/json-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+// roundTrip encodes src and decodes the result into dst,
+// returning the decoded JSON object.
+func roundTrip(src, dst interface{}, t *testing.T) map[string]interface{} {
+	data, err := json.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, dst); err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{}
+	if err = json.Unmarshal(data, &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestJSONRegistryTypes(t *testing.T) {
+	s := jsonSetup()
+
+	app, err := NewApp("jsoncat", "git://jsoncat", "stack", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = app.SetEnvironmentVar("MEOW", "loud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = GetApp(app.Dir.Snapshot, app.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Env = Env{"MEOW": "loud"}
+
+	a := &App{}
+	obj := roundTrip(app, a, t)
+	if obj["rev"] != float64(app.Dir.Snapshot.Rev) || obj["repo-url"] != "git://jsoncat" {
+		t.Errorf("unexpected encoding %v", obj)
+	}
+	if a.Name != app.Name || a.Stack != app.Stack || a.DeployType != app.DeployType || a.Env["MEOW"] != "loud" {
+		t.Errorf("app doesn't match: %#v", a)
+	}
+	if a.Dir.Name != app.Dir.Name || a.Dir.Snapshot.Rev != app.Dir.Snapshot.Rev {
+		t.Errorf("app dir doesn't match: %#v", a.Dir)
+	}
+
+	rev, err := NewRevision(app, "f00", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev.ArchiveUrl = "http://archive/f00.tgz"
+	r := &Revision{}
+	roundTrip(rev, r, t)
+	if r.Ref != "f00" || r.ArchiveUrl != rev.ArchiveUrl || r.App.Name != app.Name || r.Dir.Name != rev.Dir.Name {
+		t.Errorf("revision doesn't match: %#v", r)
+	}
+
+	pty, err := NewProcType(app, "web", rev.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ProcType{}
+	roundTrip(pty, p, t)
+	if p.Name != "web" || p.Port != pty.Port || p.App.Name != app.Name || p.Dir.Name != pty.Dir.Name {
+		t.Errorf("proctype doesn't match: %#v", p)
+	}
+
+	ins, err := RegisterInstance(app.Name, "f00", "web", pty.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &Instance{}
+	roundTrip(ins, i, t)
+	i.Dir.Snapshot = ins.Dir.Snapshot
+	if !reflect.DeepEqual(i, ins) {
+		t.Errorf("instance doesn't match: %#v != %#v", i, ins)
+	}
+
+	srv := NewService("jsonsrv", s)
+	sv := &Service{}
+	roundTrip(srv, sv, t)
+	if sv.Name != srv.Name || sv.Dir.Name != srv.Dir.Name {
+		t.Errorf("service doesn't match: %#v", sv)
+	}
+
+	ep, err := NewEndpoint(srv, "10.0.0.1", 8000, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.Service = srv
+	ep.Weight = 3
+	e := &Endpoint{}
+	roundTrip(ep, e, t)
+	if e.Id() != ep.Id() || e.Weight != 3 || e.Service.Name != srv.Name || e.Dir.Name != ep.Dir.Name {
+		t.Errorf("endpoint doesn't match: %#v", e)
+	}
+
+	s, err = s.RegisterPm("10.0.0.1", "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := GetPm(s, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm1 := &Pm{}
+	roundTrip(pm, pm1, t)
+	if pm1.Host != pm.Host || pm1.Version != "0.1.0" || pm1.Registered != pm.Registered || pm1.Dir.Name != pm.Dir.Name {
+		t.Errorf("pm doesn't match: %#v", pm1)
+	}
+}
+
+func TestJSONEvent(t *testing.T) {
+	s := jsonSetup()
+	l := make(chan *Event)
+
+	go WatchEvent(s, l)
+
+	_, err := RegisterInstance("jsonmouse", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvInsReg, &Instance{}, l, t)
+
+	decoded := &Event{}
+	obj := roundTrip(ev, decoded, t)
+
+	if obj["source-type"] != string(SrcInstance) || obj["path"] != ev.raw.Path {
+		t.Errorf("unexpected encoding %v", obj)
+	}
+	if decoded.Type != ev.Type || decoded.Rev != ev.Rev || *decoded.Path.Instance != *ev.Path.Instance {
+		t.Errorf("event doesn't match: %#v", decoded)
+	}
+	ins, ok := decoded.Source.(*Instance)
+	if !ok {
+		t.Fatalf("expected *Instance source, got %#v", decoded.Source)
+	}
+	if ins.Id != ev.Source.(*Instance).Id || ins.AppName != "jsonmouse" {
+		t.Errorf("source doesn't match: %#v", ins)
+	}
+
+	unreg := &Event{Type: EvSrvUnreg}
+	if data, err := json.Marshal(unreg); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Source != nil || decoded.SourceType() != "" {
+		t.Errorf("expected event without source, got %#v", decoded.Source)
+	}
+
+	if err = json.Unmarshal([]byte(`{"type":"app-register","source-type":"cow","source":{}}`), decoded); err == nil {
+		t.Error("expected error for unknown source type")
+	}
+}
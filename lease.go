@@ -0,0 +1,183 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const leasePath = "lease"
+
+// DefaultLeaseTTL is the time after which the lease of an instance
+// which didn't heartbeat expires.
+const DefaultLeaseTTL = 30 * time.Second
+
+// Heartbeat tells the coordinator that the instance is alive, by
+// renewing its lease. Only the host which claimed the instance can
+// heartbeat, and only while the instance is claimed or running.
+func (i *Instance) Heartbeat(host string) (i1 *Instance, err error) {
+	//
+	//   instances/
+	//       6868/
+	//           ...
+	// +         lease = 2012-07-19T16:41:05Z 10.0.0.1
+	//
+	if err = i.verifyClaimer(host); err != nil {
+		return
+	}
+	s := i.Dir.Snapshot.FastForward(-1)
+
+	status, _, err := s.get(i.Dir.prefix(statusPath))
+	if err != nil && !IsErrNoEnt(err) {
+		return
+	}
+	switch InsStatus(status) {
+	case InsStatusFailed, InsStatusExited, InsStatusLost:
+		return nil, NewError(ErrInvalidState, fmt.Sprintf("instance %d is %s", i.Id, status))
+	}
+
+	s, err = s.set(i.Dir.prefix(leasePath), timestamp()+" "+host)
+	if err != nil {
+		return
+	}
+	i1 = i.FastForward(s.Rev)
+
+	return
+}
+
+// lastHeartbeat returns the time of the last heartbeat of the
+// instance, or the zero time if it never sent one.
+func (i *Instance) lastHeartbeat() (t time.Time, err error) {
+	val, _, err := i.Dir.get(leasePath)
+	if IsErrNoEnt(err) {
+		return t, nil
+	} else if err != nil {
+		return
+	}
+	t, err = time.Parse(time.RFC3339, strings.SplitN(val, " ", 2)[0])
+	if err != nil {
+		return t, fmt.Errorf("invalid lease of instance %d: %s", i.Id, val)
+	}
+	return
+}
+
+// Reap marks the claimed, running and stopping instances whose lease
+// expired more than ttl ago as lost, and removes them from the
+// instances of their proctype. The lease of instances which never
+// sent a heartbeat starts with their last claim, so that instances
+// whose process manager died before the first heartbeat get lost too.
+// It returns the instances it marked as lost.
+func Reap(s Snapshot, ttl time.Duration) (lost []*Instance, err error) {
+	return reap(s, ttl, time.Now())
+}
+
+func reap(s Snapshot, ttl time.Duration, now time.Time) (lost []*Instance, err error) {
+	ids, err := s.getdir(instancesPath)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, name := range ids {
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		ins, err := GetInstance(s, id)
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			return lost, err
+		}
+		switch ins.Status {
+		case InsStatusClaimed, InsStatusRunning, InsStatusStopping:
+		default:
+			continue
+		}
+		beat, err := ins.lastHeartbeat()
+		if err != nil {
+			return lost, err
+		}
+		if beat.IsZero() {
+			if beat, err = ins.lastClaimed(); err != nil {
+				return lost, err
+			}
+		}
+		if beat.IsZero() || now.Sub(beat) <= ttl {
+			continue
+		}
+
+		ins, err = ins.markLost()
+		if IsErrRevMismatch(err) {
+			// Heartbeat after s was taken
+			continue
+		} else if err != nil {
+			return lost, err
+		}
+		lost = append(lost, ins)
+	}
+	return
+}
+
+// markLost sets the status of the instance to lost and unlists it. It
+// fails with ErrRevMismatch if the instance sent a heartbeat since the
+// revision of its snapshot.
+func (i *Instance) markLost() (i1 *Instance, err error) {
+	t := i.Dir.Snapshot.txn()
+	if err = i.transition(t, InsStatusLost, ""); err != nil {
+		return
+	}
+	t.del(i.Dir.prefix(leasePath))
+	t.set(i.Dir.prefix(statusPath), string(InsStatusLost))
+	t.del(i.ptyInstancesPath())
+
+	rev, err := t.commit()
+	if err != nil {
+		return
+	}
+	i1 = i.FastForward(rev)
+	i1.Status = InsStatusLost
+
+	return
+}
+
+// A Reaper runs Reap periodically.
+type Reaper struct {
+	// OnLost is called with the instances marked as lost
+	// by every run of Reap which found any.
+	OnLost func(lost []*Instance)
+
+	// OnError is called when Reap fails. If nil, errors
+	// are written to the log.
+	OnError func(err error)
+
+	snapshot Snapshot
+	ttl      time.Duration
+	interval time.Duration
+}
+
+// NewReaper returns a Reaper marking instances as lost once
+// their lease is older than ttl, checking at every interval.
+func NewReaper(s Snapshot, ttl, interval time.Duration) *Reaper {
+	return &Reaper{snapshot: s, ttl: ttl, interval: interval}
+}
+
+// Run runs Reap right away and then at every interval, until
+// ctx is done. It returns ctx.Err(), or an error if the interval
+// isn't positive.
+func (r *Reaper) Run(ctx context.Context) error {
+	return runEvery(ctx, r.interval, "reap", r.OnError, func() error {
+		lost, err := Reap(r.snapshot.FastForward(-1), r.ttl)
+		if len(lost) > 0 && r.OnLost != nil {
+			r.OnLost(lost)
+		}
+		return err
+	})
+}
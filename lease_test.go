@@ -0,0 +1,135 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+	"time"
+)
+
+func leaseSetup(t *testing.T) (ins *Instance) {
+	s, err := DialUri("mem:", "/lease-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err = RegisterInstance("leasecat", "r1", "web", s.FastForward(rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Started("10.0.0.1", 9000, "box"); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestInstanceHeartbeat(t *testing.T) {
+	ins := leaseSetup(t)
+
+	if _, err := ins.Heartbeat("10.0.0.2"); err != ErrUnauthorized {
+		t.Errorf("expected heartbeat of another host to be refused, got %v", err)
+	}
+	ins, err := ins.Heartbeat("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beat, err := ins.lastHeartbeat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(beat) > time.Minute {
+		t.Errorf("expected lease to be renewed, got %s", beat)
+	}
+}
+
+func TestReap(t *testing.T) {
+	ins := leaseSetup(t)
+	s := ins.Dir.Snapshot
+
+	// Instances without a lease are left alone until their claim expires
+	lost, err := reap(s, time.Minute, time.Now())
+	if err != nil || len(lost) != 0 {
+		t.Fatalf("expected no lost instances, got %v (%v)", lost, err)
+	}
+
+	if ins, err = ins.Heartbeat("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	s = ins.Dir.Snapshot
+
+	lost, err = reap(s, time.Minute, time.Now())
+	if err != nil || len(lost) != 0 {
+		t.Fatalf("expected no lost instances, got %v (%v)", lost, err)
+	}
+	lost, err = reap(s, time.Minute, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lost) != 1 || lost[0].Id != ins.Id || lost[0].Status != InsStatusLost {
+		t.Fatalf("expected instance to be lost, got %v", lost)
+	}
+
+	s = s.FastForward(-1)
+	ins, err = GetInstance(s, ins.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins.Status != InsStatusLost {
+		t.Errorf("expected status %s, got %s", InsStatusLost, ins.Status)
+	}
+	if scale, _, _ := s.GetScale("leasecat", "r1", "web"); scale != 0 {
+		t.Errorf("expected lost instance not to be counted, got scale %d", scale)
+	}
+	if _, err = ins.Heartbeat("10.0.0.1"); err == nil {
+		t.Error("expected heartbeat of a lost instance to be refused")
+	}
+}
+
+func TestReapWithoutHeartbeat(t *testing.T) {
+	ins := leaseSetup(t)
+	s := ins.Dir.Snapshot
+
+	pending, err := RegisterInstance("leasecat", "r1", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = pending.Dir.Snapshot
+
+	// The claim of the instance is older than the ttl
+	lost, err := reap(s, time.Minute, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lost) != 1 || lost[0].Id != ins.Id || lost[0].Status != InsStatusLost {
+		t.Fatalf("expected the instance which never sent a heartbeat to be lost, got %v", lost)
+	}
+	testInstanceStatus(t, pending.Id, InsStatusPending, s.FastForward(-1))
+}
+
+func TestReapHeartbeatRace(t *testing.T) {
+	ins := leaseSetup(t)
+
+	ins, err := ins.Heartbeat("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := ins.Dir.Snapshot
+
+	// A heartbeat after the snapshot the reaper looks at
+	if _, err = ins.Heartbeat("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	lost, err := reap(s, time.Minute, time.Now().Add(time.Hour))
+	if err != nil || len(lost) != 0 {
+		t.Errorf("expected renewed instance not to be lost, got %v (%v)", lost, err)
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	memScheme = "mem"
+	memDirRev = -2
+)
+
+var (
+	memStoresMu sync.Mutex
+	memStores   = map[string]*memStore{}
+)
+
+// memStore is an in-process, fully revisioned coordinator store
+// following doozer semantics. Mutations are recorded, so that reads
+// at older revisions and waits on past changes are possible. If
+// history is set, only the given number of revisions is kept.
+type memStore struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	rev     int64
+	oldest  int64
+	history int64
+	files   map[string][]memFile
+	log     []BackendEvent
+}
+
+// memFile is the state of a file as of a given revision.
+type memFile struct {
+	rev  int64
+	body []byte
+	del  bool
+}
+
+// memBackend is a Backend connected to a memStore.
+type memBackend struct {
+	store  *memStore
+	closed bool
+}
+
+// NewMemBackend returns a Backend backed by a new, empty in-memory store.
+func NewMemBackend() Backend {
+	return &memBackend{store: newMemStore()}
+}
+
+// dialMemUri returns a Backend for uris of the form "mem:" or "mem:<name>".
+// Named stores are shared by all backends dialed with the same name,
+// while every unnamed uri creates a new store. The number of revisions
+// kept by a new store can be limited with the history parameter,
+// as in "mem:?history=1000".
+func dialMemUri(uri string) (Backend, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	name := u.Opaque
+	if name == "" {
+		name = u.Host
+	}
+
+	var history int64
+
+	if h := u.Query().Get("history"); h != "" {
+		history, err = strconv.ParseInt(h, 10, 64)
+		if err != nil || history < 1 {
+			return nil, fmt.Errorf("invalid history '%s' in %s", h, uri)
+		}
+	}
+
+	if name == "" {
+		store := newMemStore()
+		store.history = history
+		return &memBackend{store: store}, nil
+	}
+
+	memStoresMu.Lock()
+	defer memStoresMu.Unlock()
+
+	store, ok := memStores[name]
+	if !ok {
+		store = newMemStore()
+		store.history = history
+		memStores[name] = store
+	}
+	return &memBackend{store: store}, nil
+}
+
+func newMemStore() *memStore {
+	s := &memStore{files: map[string][]memFile{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (b *memBackend) Get(path string, rev *int64) ([]byte, int64, error) {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, err := s.at(rev)
+	if err != nil {
+		return nil, 0, err
+	}
+	if f, ok := s.file(path, at); ok {
+		return f.body, f.rev, nil
+	}
+	if s.isDir(path, at) {
+		return nil, memDirRev, nil
+	}
+	return nil, 0, nil
+}
+
+func (b *memBackend) Set(path string, rev int64, value []byte) (int64, error) {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isDir(path, s.rev) {
+		return 0, fmt.Errorf("%s is a directory", path)
+	}
+	for p := parentPath(path); p != "/"; p = parentPath(p) {
+		if _, ok := s.file(p, s.rev); ok {
+			return 0, fmt.Errorf("%s is not a directory", p)
+		}
+	}
+	if f, ok := s.file(path, s.rev); ok && rev != -1 && f.rev > rev {
+		return 0, NewError(ErrRevMismatch, fmt.Sprintf("file %s is at %d, expected %d", path, f.rev, rev))
+	}
+
+	body := make([]byte, len(value))
+	copy(body, value)
+
+	return s.mutate(path, body, false), nil
+}
+
+func (b *memBackend) Del(path string, rev int64) error {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.file(path, s.rev)
+	if !ok {
+		if s.isDir(path, s.rev) {
+			return fmt.Errorf("%s is a directory", path)
+		}
+		// Like doozer, deleting a missing file is not an error.
+		return nil
+	}
+	if rev != -1 && f.rev > rev {
+		return NewError(ErrRevMismatch, fmt.Sprintf("file %s is at %d, expected %d", path, f.rev, rev))
+	}
+	s.mutate(path, nil, true)
+
+	return nil
+}
+
+func (b *memBackend) Stat(path string, rev *int64) (int, int64, error) {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, err := s.at(rev)
+	if err != nil {
+		return 0, 0, err
+	}
+	if f, ok := s.file(path, at); ok {
+		return len(f.body), f.rev, nil
+	}
+	if names := s.children(path, at); len(names) > 0 {
+		return len(names), memDirRev, nil
+	}
+	return 0, 0, nil
+}
+
+func (b *memBackend) Getdir(path string, rev int64, offset, limit int) ([]string, error) {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, err := s.at(&rev)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.file(path, at); ok {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+	names := s.children(path, at)
+	if len(names) == 0 {
+		return nil, NewError(ErrNoEnt, fmt.Sprintf(`dir "%s" not found at %d`, path, at))
+	}
+	if offset < 0 || offset >= len(names) {
+		return nil, fmt.Errorf("offset %d out of range for %s", offset, path)
+	}
+	names = names[offset:]
+	if limit > 0 && limit < len(names) {
+		names = names[:limit]
+	}
+	return names, nil
+}
+
+func (b *memBackend) Wait(glob string, rev int64) (BackendEvent, error) {
+	return b.WaitContext(context.Background(), glob, rev)
+}
+
+func (b *memBackend) WaitContext(ctx context.Context, glob string, rev int64) (BackendEvent, error) {
+	s := b.store
+
+	re, err := globRegexp(glob)
+	if err != nil {
+		return BackendEvent{}, err
+	}
+
+	if ctx.Done() != nil {
+		stop := make(chan bool)
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.mu.Lock()
+				s.cond.Broadcast()
+				s.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if b.closed {
+			return BackendEvent{}, errors.New("connection closed")
+		}
+		if err := ctx.Err(); err != nil {
+			return BackendEvent{}, err
+		}
+		if rev < s.oldest {
+			return BackendEvent{}, s.errTooOld(rev)
+		}
+
+		// The log may have been compacted while waiting,
+		// so the position is looked up on every iteration.
+		i := sort.Search(len(s.log), func(i int) bool { return s.log[i].Rev >= rev })
+		for ; i < len(s.log); i++ {
+			if re.MatchString(s.log[i].Path) {
+				return s.log[i], nil
+			}
+		}
+		if len(s.log) > 0 {
+			rev = s.log[len(s.log)-1].Rev + 1
+		}
+		s.cond.Wait()
+	}
+}
+
+func (b *memBackend) Rev() (int64, error) {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rev, nil
+}
+
+func (b *memBackend) Close() {
+	s := b.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b.closed = true
+	s.cond.Broadcast()
+}
+
+// mutate records a new state for path and advances the store revision.
+// The caller must hold s.mu.
+func (s *memStore) mutate(path string, body []byte, del bool) int64 {
+	s.rev++
+	s.files[path] = append(s.files[path], memFile{rev: s.rev, body: body, del: del})
+	s.log = append(s.log, BackendEvent{Rev: s.rev, Path: path, Body: body, Del: del})
+
+	if s.history > 0 && s.rev-s.oldest > s.history {
+		s.compact(s.rev - s.history)
+	}
+	s.cond.Broadcast()
+
+	return s.rev
+}
+
+// compact discards the history before rev. The state of the
+// store at rev and all later revisions is kept.
+// The caller must hold s.mu.
+func (s *memStore) compact(rev int64) {
+	for path, history := range s.files {
+		i := sort.Search(len(history), func(i int) bool { return history[i].rev > rev })
+		if i > 0 {
+			i--
+		}
+		if i == len(history)-1 && history[i].del {
+			delete(s.files, path)
+		} else {
+			s.files[path] = history[i:]
+		}
+	}
+	i := sort.Search(len(s.log), func(i int) bool { return s.log[i].Rev >= rev })
+	s.log = s.log[i:]
+	s.oldest = rev
+}
+
+// at returns the revision a read should be performed at. Revisions
+// ahead of the store are read at the latest revision.
+func (s *memStore) at(rev *int64) (int64, error) {
+	if rev == nil || *rev > s.rev {
+		return s.rev, nil
+	}
+	if *rev < s.oldest {
+		return 0, s.errTooOld(*rev)
+	}
+	return *rev, nil
+}
+
+func (s *memStore) errTooOld(rev int64) error {
+	return NewError(ErrRevTooOld, fmt.Sprintf("%s: %d is before %d", ErrRevTooOld.Error(), rev, s.oldest))
+}
+
+// file returns the state of the file at path as of rev,
+// if it existed at that revision.
+func (s *memStore) file(path string, rev int64) (f memFile, ok bool) {
+	history := s.files[path]
+	i := sort.Search(len(history), func(i int) bool { return history[i].rev > rev })
+	if i == 0 || history[i-1].del {
+		return
+	}
+	return history[i-1], true
+}
+
+func (s *memStore) isDir(path string, rev int64) bool {
+	return len(s.children(path, rev)) > 0
+}
+
+// children returns the sorted names of all entries directly
+// below path which exist at rev.
+func (s *memStore) children(path string, rev int64) (names []string) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	seen := map[string]bool{}
+
+	for p := range s.files {
+		if !strings.HasPrefix(p, prefix) || p == prefix {
+			continue
+		}
+		if _, ok := s.file(p, rev); !ok {
+			continue
+		}
+		name := strings.SplitN(p[len(prefix):], "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func parentPath(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// globRegexp translates a doozer glob into a regular expression.
+// '*' matches any sequence of characters within a path component,
+// '**' matches any sequence of characters including '/'.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var pat string
+
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], doozerGlobPlural):
+			pat += ".*"
+			i++
+		case glob[i] == '*':
+			pat += "[^/]*"
+		case glob[i] == '?':
+			pat += "[^/]"
+		default:
+			pat += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+	return regexp.Compile("^" + pat + "$")
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+	"time"
+)
+
+func memSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/mem-test")
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func TestMemRevisions(t *testing.T) {
+	s := memSetup()
+	c := s.conn
+
+	rev1, err := c.Set("key", -1, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev2, err := c.Set("key", rev1, []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev2 <= rev1 {
+		t.Errorf("expected revisions to increase, got %d after %d", rev2, rev1)
+	}
+
+	_, err = c.Set("key", rev1, []byte("three"))
+	if err == nil || err.(*Error).Err != ErrRevMismatch {
+		t.Errorf("expected set at old revision to fail, got %v", err)
+	}
+
+	val, _, err := c.Get("key", &rev1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "one" {
+		t.Errorf("expected value at %d to be 'one', got '%s'", rev1, val)
+	}
+
+	val, _, err = c.Get("key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "two" {
+		t.Errorf("expected latest value to be 'two', got '%s'", val)
+	}
+}
+
+func TestMemDirectories(t *testing.T) {
+	s := memSetup()
+	c := s.conn
+
+	_, err := c.Set("dir/a", -1, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := c.Set("dir/b/c", -1, []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, dirrev, err := c.Stat("dir", &rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirrev >= 0 {
+		t.Errorf("expected negative dir revision, got %d", dirrev)
+	}
+	if size != 2 {
+		t.Errorf("expected 2 entries, got %d", size)
+	}
+
+	names, err := c.Getdir("dir", rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("unexpected dir entries %#v", names)
+	}
+
+	if _, err = c.Set("dir/a/d", -1, []byte("d")); err == nil {
+		t.Error("expected set below a file to fail")
+	}
+
+	if err = c.Del("dir", rev); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _, _ := c.Exists("dir"); exists {
+		t.Error("expected dir to be deleted")
+	}
+	if _, err = c.Getdir("dir", rev); err != nil {
+		t.Errorf("expected dir to exist at %d: %s", rev, err)
+	}
+}
+
+func TestMemWait(t *testing.T) {
+	s := memSetup()
+	c := s.conn
+
+	rev, err := c.Set("apps/cat/registered", -1, []byte("now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Set("apps/cat/revs/f00/registered", -1, []byte("now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err := c.Wait("apps/*/registered", rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Rev != rev || ev.Path != "/apps/cat/registered" {
+		t.Errorf("unexpected event %#v", ev)
+	}
+
+	ev, err = c.Wait("apps/**", rev+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Path != "/apps/cat/revs/f00/registered" {
+		t.Errorf("unexpected event %#v", ev)
+	}
+
+	ch := make(chan BackendEvent)
+	go func() {
+		ev, _ := c.Wait("apps/*/registered", ev.Rev+1)
+		ch <- ev
+	}()
+
+	if err = c.Del("apps/cat/registered", ev.Rev); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev = <-ch:
+		if !ev.IsDel() {
+			t.Errorf("expected delete event, got %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected event, got timeout")
+	}
+}
+
+func TestMemHistory(t *testing.T) {
+	s, err := DialUri("mem:?history=2", "/mem-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.conn
+
+	rev, err := c.Set("key", -1, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = c.Set("other", -1, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err = c.Get("key", &rev); !IsErrRevTooOld(err) {
+		t.Errorf("expected ErrRevTooOld, got %v", err)
+	}
+	if _, err = c.Wait("key", rev); !IsErrRevTooOld(err) {
+		t.Errorf("expected ErrRevTooOld, got %v", err)
+	}
+
+	val, _, err := c.Get("key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "one" {
+		t.Errorf("expected compacted file to be kept, got '%s'", val)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// migrationPath holds the progress of the migration being applied, as
+// "<from> <to> <time>". It sits next to schemaPath, which is a file
+// holding the schema version.
+const migrationPath = "/internal/migration"
+
+// A Migration upgrades the coordinator schema from version From to From+1.
+type Migration struct {
+	From        int
+	Description string
+
+	// Plan returns the operations needed to migrate the coordinator
+	// at the given snapshot. As an interrupted migration is planned
+	// again on the next run, plans must only depend on the state
+	// of the coordinator.
+	Plan func(s Snapshot) ([]*MigrationOp, error)
+}
+
+// A MigrationOp is a single change to the coordinator. If Del
+// is true, the file or directory at Path is deleted, otherwise
+// the file at Path is set to Value.
+type MigrationOp struct {
+	Path  string
+	Value string
+	Del   bool
+}
+
+// A MigrationResult holds the operations planned and, unless
+// migrating in dry-run mode, applied by a Migration. Resumed is
+// true if a previous run of the migration was interrupted.
+type MigrationResult struct {
+	Migration *Migration
+	Ops       []*MigrationOp
+	Resumed   bool
+}
+
+var migrations = map[int]*Migration{
+	2: {
+		From:        2,
+		Description: "remove proctype instance entries of the layout without revisions",
+		Plan:        planRevisionedInstances,
+	},
+}
+
+// RegisterMigration adds a Migration to the list of migrations
+// applied by Migrate, replacing any migration from the same version.
+func RegisterMigration(m *Migration) {
+	migrations[m.From] = m
+}
+
+// Migrate upgrades the coordinator schema to SchemaVersion by applying
+// the registered migrations in order, and returns a snapshot of the
+// coordinator after the migration along with the operations performed.
+//
+// While a migration is applied, its progress is recorded in the
+// coordinator, and the schema version is advanced after each
+// migration has been applied. A migration found in progress was
+// interrupted: it is planned again and reported as resumed. In
+// dry-run mode, nothing is written and every migration is planned
+// against the current coordinator state, as if the previous
+// migrations had no effect.
+func Migrate(s Snapshot, dryRun bool) (Snapshot, []*MigrationResult, error) {
+	results := []*MigrationResult{}
+
+	s = s.FastForward(-1)
+
+	version, err := getSchemaVersion(s)
+	if err != nil {
+		return s, nil, err
+	}
+	if version > SchemaVersion {
+		return s, nil, ErrSchemaMism
+	}
+
+	interrupted, err := getMigrationProgress(s)
+	if err != nil {
+		return s, nil, err
+	}
+	if interrupted >= 0 && interrupted < version && !dryRun {
+		// Interrupted after the schema version was advanced
+		if err = s.del(migrationPath); err != nil {
+			return s, nil, err
+		}
+		s = s.FastForward(-1)
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return s, results, fmt.Errorf("no migration from schema version %d to %d", v, v+1)
+		}
+
+		ops, err := m.Plan(s)
+		if err != nil {
+			return s, results, err
+		}
+		results = append(results, &MigrationResult{m, ops, v == interrupted})
+
+		if dryRun {
+			continue
+		}
+
+		s, err = applyMigration(s, m, ops)
+		if err != nil {
+			return s, results, err
+		}
+	}
+	return s, results, nil
+}
+
+func applyMigration(s Snapshot, m *Migration, ops []*MigrationOp) (Snapshot, error) {
+	s, err := s.set(migrationPath, fmt.Sprintf("%d %d %s", m.From, m.From+1, timestamp()))
+	if err != nil {
+		return s, err
+	}
+
+	for _, op := range ops {
+		if op.Del {
+			err = s.del(op.Path)
+			if IsErrNoEnt(err) {
+				err = nil
+			}
+			s = s.FastForward(-1)
+		} else {
+			s, err = s.FastForward(-1).setBytes(op.Path, []byte(op.Value))
+		}
+		if err != nil {
+			return s, fmt.Errorf("migration from schema version %d failed on %s: %s", m.From, op, err)
+		}
+	}
+
+	s, err = SetSchemaVersion(s.FastForward(-1), m.From+1)
+	if err != nil {
+		return s, err
+	}
+	err = s.del(migrationPath)
+	if err != nil {
+		return s, err
+	}
+	return s.FastForward(-1), nil
+}
+
+// getMigrationProgress returns the schema version the migration in
+// progress started from, or -1 if no migration is in progress.
+func getMigrationProgress(s Snapshot) (from int, err error) {
+	val, _, err := s.get(migrationPath)
+	if IsErrNoEnt(err) {
+		return -1, nil
+	} else if err != nil {
+		return
+	}
+	from, err = strconv.Atoi(strings.SplitN(val, " ", 2)[0])
+	if err != nil {
+		return -1, fmt.Errorf("invalid migration progress: %s", val)
+	}
+	return
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("Migration<%d-%d>{%s}", m.From, m.From+1, m.Description)
+}
+
+func (op *MigrationOp) String() string {
+	if op.Del {
+		return fmt.Sprintf("del %s", op.Path)
+	}
+	return fmt.Sprintf("set %s = %s", op.Path, op.Value)
+}
+
+func (r *MigrationResult) String() string {
+	ops := make([]string, len(r.Ops))
+	for i, op := range r.Ops {
+		ops[i] = op.String()
+	}
+	str := fmt.Sprintf("%s [%s]", r.Migration, strings.Join(ops, ", "))
+	if r.Resumed {
+		str += " (resumed)"
+	}
+	return str
+}
+
+// planRevisionedInstances migrates from schema version 2 to 3. Proctype
+// instances used to be stored as files directly under
+//
+//	apps/<app>/procs/<proc>/instances/<id>
+//
+// while they are now grouped by revision, as in
+//
+//	apps/<app>/procs/<proc>/instances/<rev>/<id>
+//
+// The old entries are removed.
+func planRevisionedInstances(s Snapshot) (ops []*MigrationOp, err error) {
+	apps, err := getdirOrEmpty(s, appsPath)
+	if err != nil {
+		return
+	}
+	for _, app := range apps {
+		var procs []string
+
+		procs, err = getdirOrEmpty(s, path.Join(appsPath, app, procsPath))
+		if err != nil {
+			return
+		}
+		for _, proc := range procs {
+			var entries []string
+
+			p := path.Join(appsPath, app, procsPath, proc, instancesPath)
+
+			entries, err = getdirOrEmpty(s, p)
+			if err != nil {
+				return
+			}
+			for _, entry := range entries {
+				var rev int64
+
+				_, rev, err = s.conn.Stat(path.Join(p, entry), &s.Rev)
+				if err != nil {
+					return
+				}
+				if rev > 0 {
+					ops = append(ops, &MigrationOp{Path: path.Join("/", p, entry), Del: true})
+				}
+			}
+		}
+	}
+	return
+}
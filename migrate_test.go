@@ -0,0 +1,150 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"testing"
+)
+
+func migrateSetup(version int) (s Snapshot) {
+	s, err := DialUri("mem:", "/migrate-test")
+	if err != nil {
+		panic(err)
+	}
+	s, err = SetSchemaVersion(s, version)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func TestMigrateRevisionedInstances(t *testing.T) {
+	s := migrateSetup(2)
+	old := "/apps/cat/procs/web/instances/23"
+	cur := "/apps/cat/procs/web/instances/f00babe/42"
+
+	s, err := s.set(old, timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.set(cur, timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, results, err := Migrate(s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != SchemaVersion-2 {
+		t.Fatalf("expected %d migrations, got %v", SchemaVersion-2, results)
+	}
+	ops := results[0].Ops
+	if len(ops) != 1 || !ops[0].Del || ops[0].Path != old {
+		t.Errorf("unexpected migration plan %s", results[0])
+	}
+	if exists, _, _ := s.conn.Exists(old); !exists {
+		t.Error("dry-run migration changed the coordinator")
+	}
+
+	s, _, err = Migrate(s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _, _ := s.exists(old); exists {
+		t.Errorf("expected %s to be removed", old)
+	}
+	if exists, _, _ := s.exists(cur); !exists {
+		t.Errorf("expected %s to be kept", cur)
+	}
+	if exists, _, _ := s.exists(migrationPath); exists {
+		t.Error("expected migration progress to be cleared")
+	}
+	if _, err = VerifySchema(s); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	s := migrateSetup(SchemaVersion + 1)
+
+	if _, _, err := Migrate(s, false); err != ErrSchemaMism {
+		t.Errorf("expected ErrSchemaMism, got %v", err)
+	}
+}
+
+func TestInitMigrates(t *testing.T) {
+	s := migrateSetup(2)
+
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifySchema(s.FastForward(rev)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	s := migrateSetup(2)
+	done := "/apps/cat/procs/web/instances/23"
+	left := "/apps/cat/procs/web/instances/24"
+
+	// The migration failed after removing the first entry
+	s, err := s.set(left, timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.set(migrationPath, "2 3 "+timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, results, err := Migrate(s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || !results[0].Resumed {
+		t.Fatalf("expected the migration to be reported as resumed, got %v", results)
+	}
+
+	s, results, err = Migrate(s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := results[0].Ops; !results[0].Resumed || len(ops) != 1 || ops[0].Path != left {
+		t.Errorf("unexpected migration %s", results[0])
+	}
+	for _, p := range []string{done, left, migrationPath} {
+		if exists, _, _ := s.exists(p); exists {
+			t.Errorf("expected %s to be removed", p)
+		}
+	}
+	if _, err = VerifySchema(s); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateInterruptedAfterVersion(t *testing.T) {
+	s := migrateSetup(SchemaVersion)
+
+	// The migration failed after advancing the schema version
+	s, err := s.set(migrationPath, fmt.Sprintf("%d %d %s", SchemaVersion-1, SchemaVersion, timestamp()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, results, err := Migrate(s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("expected no migrations, got %v", results)
+	}
+	if exists, _, _ := s.exists(migrationPath); exists {
+		t.Error("expected migration progress to be cleared")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// runEvery runs fn right away and then at every interval, until ctx is
+// done, and returns ctx.Err(). Errors of fn are passed to onError, or
+// written to the log if it is nil. If the interval isn't positive, it
+// returns an error without running fn.
+func runEvery(ctx context.Context, interval time.Duration, name string, onError func(error), fn func() error) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid %s interval: %s", name, interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fn(); err != nil {
+			if onError != nil {
+				onError(err)
+			} else {
+				log.Printf("%s failed: %s", name, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	errs := []error{}
+
+	err := runEvery(ctx, time.Millisecond, "test", func(err error) { errs = append(errs, err) }, func() error {
+		if runs++; runs == 3 {
+			cancel()
+		}
+		return errors.New("oops")
+	})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if runs != 3 || len(errs) != 3 {
+		t.Errorf("expected 3 runs and errors, got %d and %d", runs, len(errs))
+	}
+}
+
+func TestRunEveryInvalidInterval(t *testing.T) {
+	s, err := DialUri("mem:", "/periodic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := map[string]func(context.Context) error{
+		"reaper":     NewReaper(s, time.Minute, 0).Run,
+		"reconciler": NewReconciler(s, -time.Second).Run,
+		"collector":  NewCollector(s, GCPolicy{}, 0).Run,
+	}
+	for name, run := range runs {
+		if err := run(context.Background()); err == nil || err == context.Canceled {
+			t.Errorf("expected an error for the interval of the %s, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A Pm is a process manager registered with RegisterPm.
+type Pm struct {
+	Dir        dir
+	Host       string
+	Version    string
+	Registered string
+}
+
+// A Proxy is a proxy registered with RegisterProxy.
+type Proxy struct {
+	Dir        dir
+	Host       string
+	Registered string
+}
+
+// GetPm returns the process manager registered for host.
+func GetPm(s Snapshot, host string) (pm *Pm, err error) {
+	//
+	//   pms/
+	//       10.0.0.1 = 2012-07-19T16:41:05Z 0.1.0
+	//
+	val, _, err := s.get(path.Join(pmDir, host))
+	if err != nil {
+		return
+	}
+	fields := strings.SplitN(val, " ", 2)
+
+	pm = &Pm{Dir: dir{s, path.Join(pmDir, host)}, Host: host, Registered: fields[0]}
+	if len(fields) > 1 {
+		pm.Version = fields[1]
+	}
+	return
+}
+
+// GetProxy returns the proxy registered for host.
+func GetProxy(s Snapshot, host string) (proxy *Proxy, err error) {
+	//
+	//   proxies/
+	//       10.0.0.1 = 2012-07-19T16:41:05Z
+	//
+	val, _, err := s.get(path.Join(proxyDir, host))
+	if err != nil {
+		return
+	}
+	return &Proxy{Dir: dir{s, path.Join(proxyDir, host)}, Host: host, Registered: val}, nil
+}
+
+func (p *Pm) createSnapshot(rev int64) snapshotable {
+	tmp := *p
+	tmp.Dir.Snapshot = Snapshot{rev, p.Dir.Snapshot.conn}
+	return &tmp
+}
+
+func (p *Pm) String() string {
+	return fmt.Sprintf("Pm<%s>{version: %s}", p.Host, p.Version)
+}
+
+func (p *Proxy) createSnapshot(rev int64) snapshotable {
+	tmp := *p
+	tmp.Dir.Snapshot = Snapshot{rev, p.Dir.Snapshot.conn}
+	return &tmp
+}
+
+func (p *Proxy) String() string {
+	return fmt.Sprintf("Proxy<%s>", p.Host)
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+)
+
+func pmSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/pm-test")
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func TestGetPm(t *testing.T) {
+	s := pmSetup()
+
+	if _, err := GetPm(s, "10.0.0.1"); !IsErrNoEnt(err) {
+		t.Errorf("expected ErrNoEnt, got %v", err)
+	}
+	s, err := s.RegisterPm("10.0.0.1", "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := GetPm(s, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm.Host != "10.0.0.1" || pm.Version != "0.1.0" || pm.Registered == "" {
+		t.Errorf("unexpected pm %#v", pm)
+	}
+}
+
+func TestGetProxy(t *testing.T) {
+	s := pmSetup()
+
+	s, err := s.RegisterProxy("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := GetProxy(s, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Host != "10.0.0.2" || proxy.Registered == "" {
+		t.Errorf("unexpected proxy %#v", proxy)
+	}
+}
@@ -103,10 +103,6 @@ func (p *ProcType) NumInstances() (int, error) {
 	total := 0
 
 	for _, rev := range revs {
-		// TODO: remove this once all old instances are cleaned up
-		if len(rev) != 7 {
-			continue
-		}
 		size, _, err := p.Dir.Snapshot.conn.Stat(p.Dir.prefix("instances", rev), &p.Dir.Snapshot.Rev)
 		if err != nil {
 			return -1, err
@@ -122,11 +118,6 @@ func (p *ProcType) InstanceIds() (ids []string, err error) {
 		return
 	}
 	for _, rev := range revs {
-		// TODO: remove this once all old instances are cleaned up
-		if len(rev) != 7 {
-			continue
-		}
-
 		iids, e := p.Dir.Snapshot.getdir(p.Dir.prefix("instances", rev))
 		if e != nil {
 			return nil, e
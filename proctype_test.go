@@ -11,7 +11,7 @@ import (
 )
 
 func proctypeSetup(appid string) (s Snapshot, app *App) {
-	s, err := Dial(DefaultAddr, "/proctype-test")
+	s, err := testDial("/proctype-test")
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,239 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+)
+
+const desiredScalePath = "desired-scale"
+
+// SetDesiredScale records the number of instances app:pty@rev should
+// have. Instances which fail or get lost are replaced by a Reconciler
+// until the proctype runs that many instances again.
+func (s Snapshot) SetDesiredScale(app, rev, pty string, scale int) (s1 Snapshot, err error) {
+	//
+	//   apps/<app>/procs/<proc>/
+	//       desired-scale/
+	// +         <rev> = 3
+	//
+	if scale < 0 {
+		return s, fmt.Errorf("desired scale of %s:%s@%s can't be negative", app, pty, rev)
+	}
+	exists, _, err := s.conn.Exists(path.Join(appsPath, app, revsPath, rev))
+	if err != nil {
+		return s, err
+	} else if !exists {
+		return s, NewError(ErrNoEnt, fmt.Sprintf("%s@%s not found", app, rev))
+	}
+	exists, _, err = s.conn.Exists(path.Join(appsPath, app, procsPath, pty))
+	if err != nil {
+		return s, err
+	} else if !exists {
+		return s, NewError(ErrNoEnt, fmt.Sprintf("proc '%s' doesn't exist", pty))
+	}
+
+	f, err := createFile(s, desiredScaleFilePath(app, rev, pty), scale, new(intCodec))
+	if err != nil {
+		return s, err
+	}
+	return s.FastForward(f.FileRev), nil
+}
+
+// GetDesiredScale returns the number of instances app:pty@rev should
+// have, and the revision it was set at. It fails with ErrNoEnt if no
+// desired scale was set.
+func (s Snapshot) GetDesiredScale(app, rev, pty string) (scale int, filerev int64, err error) {
+	f, err := s.getFile(desiredScaleFilePath(app, rev, pty), new(intCodec))
+	if err != nil {
+		return -1, 0, err
+	}
+	return f.Value.(int), f.FileRev, nil
+}
+
+func desiredScaleFilePath(app, rev, pty string) string {
+	return path.Join(appsPath, app, procsPath, pty, desiredScalePath, rev)
+}
+
+// A Reconciler registers replacement instances for the proctypes
+// which have fewer instances than their desired scale, e.g. because
+// instances failed or were lost. Replacements of every app:proc@rev
+// are spaced with an exponential backoff, and limited to MaxRestarts
+// within Window, so that instances which keep crashing don't flood
+// the process managers.
+//
+// A Reconciler only scales up. Instances beyond the desired scale
+// are left to Scale.
+type Reconciler struct {
+	// MaxRestarts is the number of instances registered per
+	// app:proc@rev within Window.
+	MaxRestarts int
+	Window      time.Duration
+
+	// MinBackoff is the time waited after replacing instances
+	// before replacing more. It doubles with every replacement
+	// up to MaxBackoff, and is reset once the proctype is back
+	// at its desired scale.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnRestart is called with the instances registered by every
+	// run of Reconcile which registered any.
+	OnRestart func(ins []*Instance)
+
+	// OnError is called when Reconcile fails. If nil, errors
+	// are written to the log.
+	OnError func(err error)
+
+	snapshot Snapshot
+	interval time.Duration
+	restarts map[string]*restarts
+	now      func() time.Time
+}
+
+// restarts tracks the replacements of an app:proc@rev.
+type restarts struct {
+	times   []time.Time
+	backoff time.Duration
+	next    time.Time
+}
+
+// NewReconciler returns a Reconciler checking the desired scales at
+// every interval. It allows 10 restarts within 10 minutes, with a
+// backoff from 1 second to 5 minutes.
+func NewReconciler(s Snapshot, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		MaxRestarts: 10,
+		Window:      10 * time.Minute,
+		MinBackoff:  time.Second,
+		MaxBackoff:  5 * time.Minute,
+		snapshot:    s,
+		interval:    interval,
+		restarts:    map[string]*restarts{},
+		now:         time.Now,
+	}
+}
+
+// Reconcile compares the desired scale of every app:proc@rev with its
+// number of instances, as returned by GetScale, and registers the
+// missing instances which backoff and restart limit allow. It returns
+// the instances it registered.
+func (r *Reconciler) Reconcile() (started []*Instance, err error) {
+	s := r.snapshot.FastForward(-1)
+
+	apps, err := s.getdir(appsPath)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, app := range apps {
+		procs, err := s.getdir(path.Join(appsPath, app, procsPath))
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			return started, err
+		}
+		for _, proc := range procs {
+			revs, err := s.getdir(path.Join(appsPath, app, procsPath, proc, desiredScalePath))
+			if IsErrNoEnt(err) {
+				continue
+			} else if err != nil {
+				return started, err
+			}
+			for _, rev := range revs {
+				ins, err := r.reconcile(s, app, rev, proc)
+				started = append(started, ins...)
+				if err != nil {
+					return started, err
+				}
+				if len(ins) > 0 {
+					s = s.FastForward(ins[len(ins)-1].Dir.Snapshot.Rev)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (r *Reconciler) reconcile(s Snapshot, app, rev, proc string) (started []*Instance, err error) {
+	key := fmt.Sprintf("%s:%s@%s", app, proc, rev)
+	now := r.now()
+
+	registered, _, err := s.exists(path.Join(appsPath, app, revsPath, rev))
+	if err != nil || !registered {
+		return
+	}
+	desired, _, err := s.GetDesiredScale(app, rev, proc)
+	if err != nil {
+		return
+	}
+	current, _, err := s.GetScale(app, rev, proc)
+	if err != nil {
+		return
+	}
+
+	rs := r.restarts[key]
+	if rs == nil {
+		rs = &restarts{backoff: r.MinBackoff}
+		r.restarts[key] = rs
+	}
+	if current >= desired {
+		rs.backoff = r.MinBackoff
+		return
+	}
+	if now.Before(rs.next) {
+		return
+	}
+
+	// Forget restarts which left the window
+	times := rs.times[:0]
+	for _, t := range rs.times {
+		if now.Sub(t) < r.Window {
+			times = append(times, t)
+		}
+	}
+	rs.times = times
+
+	n := desired - current
+	if left := r.MaxRestarts - len(rs.times); n > left {
+		n = left
+	}
+	if n <= 0 {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		ins, err := RegisterInstance(app, rev, proc, s)
+		if err != nil {
+			return started, err
+		}
+		s = s.FastForward(ins.Dir.Snapshot.Rev)
+		started = append(started, ins)
+		rs.times = append(rs.times, now)
+	}
+	rs.next = now.Add(rs.backoff)
+	if rs.backoff *= 2; rs.backoff > r.MaxBackoff {
+		rs.backoff = r.MaxBackoff
+	}
+	return
+}
+
+// Run runs Reconcile right away and then at every interval, until
+// ctx is done. It returns ctx.Err(), or an error if the interval
+// isn't positive.
+func (r *Reconciler) Run(ctx context.Context) error {
+	return runEvery(ctx, r.interval, "reconcile", r.OnError, func() error {
+		started, err := r.Reconcile()
+		if len(started) > 0 && r.OnRestart != nil {
+			r.OnRestart(started)
+		}
+		return err
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func reconcileSetup(t *testing.T) (s Snapshot) {
+	s, err := DialUri("mem:", "/reconcile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp("healcat", "git://healcat", "s1", s.FastForward(rev)).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewRevision(app, "r1", app.Dir.Snapshot).Register(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewProcType(app, "web", app.Dir.Snapshot.FastForward(-1)).Register(); err != nil {
+		t.Fatal(err)
+	}
+	return s.FastForward(-1)
+}
+
+func TestDesiredScale(t *testing.T) {
+	s := reconcileSetup(t)
+
+	if _, _, err := s.GetDesiredScale("healcat", "r1", "web"); !IsErrNoEnt(err) {
+		t.Errorf("expected ErrNoEnt without desired scale, got %v", err)
+	}
+	s, err := s.SetDesiredScale("healcat", "r1", "web", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scale, _, err := s.GetDesiredScale("healcat", "r1", "web")
+	if err != nil || scale != 3 {
+		t.Errorf("expected desired scale 3, got %d (%v)", scale, err)
+	}
+	if _, err = s.SetDesiredScale("healcat", "r2", "web", 3); !IsErrNoEnt(err) {
+		t.Errorf("expected ErrNoEnt for unknown revision, got %v", err)
+	}
+	if _, err = s.SetDesiredScale("healcat", "r1", "web", -1); err == nil {
+		t.Error("expected negative desired scale to be refused")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	s := reconcileSetup(t)
+
+	s, err := s.SetDesiredScale("healcat", "r1", "web", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2012, 7, 19, 16, 0, 0, 0, time.UTC)
+	r := NewReconciler(s, time.Second)
+	r.now = func() time.Time { return now }
+	r.MaxRestarts = 3
+
+	started, err := r.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 2 {
+		t.Fatalf("expected 2 instances to be registered, got %v", started)
+	}
+	if more, _ := r.Reconcile(); len(more) != 0 {
+		t.Errorf("expected no instances at desired scale, got %v", more)
+	}
+
+	fail := func(ins *Instance) {
+		ins, err := ins.Claim("10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ins.Failed("10.0.0.1", errors.New("crash")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fail(started[0])
+
+	// Within the backoff of the last restart
+	if started, _ = r.Reconcile(); len(started) != 0 {
+		t.Errorf("expected no instances during backoff, got %v", started)
+	}
+	now = now.Add(2 * time.Second)
+	if started, _ = r.Reconcile(); len(started) != 1 {
+		t.Fatalf("expected failed instance to be replaced, got %v", started)
+	}
+
+	// The restart limit is reached
+	fail(started[0])
+	now = now.Add(time.Minute)
+	if started, _ = r.Reconcile(); len(started) != 0 {
+		t.Errorf("expected restart limit to be enforced, got %v", started)
+	}
+	now = now.Add(r.Window)
+	if started, _ = r.Reconcile(); len(started) != 1 {
+		t.Errorf("expected instance to be replaced after the window, got %v", started)
+	}
+
+	scale, _, err := s.FastForward(-1).GetScale("healcat", "r1", "web")
+	if err != nil || scale != 2 {
+		t.Errorf("expected scale 2, got %d (%v)", scale, err)
+	}
+}
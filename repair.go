@@ -0,0 +1,182 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// Repair finds objects left half-written by registrations, claims
+// and status changes which were interrupted, and completes or
+// removes them:
+//
+//   - attributes and environment of apps without a registered
+//     file are removed
+//   - instances without an object or start file are unregistered
+//   - claimed instances missing the entry of their claimer under
+//     claims/ get it added
+//   - failed, exited and lost instances still listed under the instances
+//     of their proctype are removed from it, and failed instances
+//     missing from failed/ are added to it
+//
+// Objects which are being written while Repair runs look no
+// different from abandoned ones, so it should only be used while
+// no registrations are in flight, e.g. after a coordinator outage.
+// It returns a description of every repair made.
+func Repair(s Snapshot) (repairs []string, err error) {
+	r, err := repairApps(s)
+	repairs = append(repairs, r...)
+	if err != nil {
+		return
+	}
+	r, err = repairInstances(s)
+	repairs = append(repairs, r...)
+
+	return
+}
+
+func repairApps(s Snapshot) (repairs []string, err error) {
+	names, err := s.getdir(appsPath)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, name := range names {
+		p := path.Join(appsPath, name)
+
+		registered, _, err := s.exists(path.Join(p, "registered"))
+		if err != nil {
+			return repairs, err
+		}
+		if registered {
+			continue
+		}
+		// Only the files written by App.Register are removed, the
+		// app dir may also hold the instances of a removed app.
+		removed := false
+
+		for _, f := range []string{"attrs", "env"} {
+			exists, _, err := s.exists(path.Join(p, f))
+			if err != nil {
+				return repairs, err
+			}
+			if !exists {
+				continue
+			}
+			if err = s.del(path.Join(p, f)); err != nil {
+				return repairs, err
+			}
+			removed = true
+		}
+		if removed {
+			repairs = append(repairs, fmt.Sprintf("removed partially registered app '%s'", name))
+		}
+	}
+	return
+}
+
+func repairInstances(s Snapshot) (repairs []string, err error) {
+	names, err := s.getdir(instancesPath)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, name := range names {
+		id, e := strconv.ParseInt(name, 10, 64)
+		if e != nil {
+			continue
+		}
+		r, err := repairInstance(s, id)
+		repairs = append(repairs, r...)
+		if err != nil {
+			return repairs, err
+		}
+	}
+	return
+}
+
+func repairInstance(s Snapshot, id int64) (repairs []string, err error) {
+	p := instancePath(id)
+
+	f, err := s.getFile(path.Join(p, "object"), new(listCodec))
+	if IsErrNoEnt(err) {
+		if err = s.del(p); err != nil {
+			return
+		}
+		return []string{fmt.Sprintf("removed instance %d without object", id)}, nil
+	} else if err != nil {
+		return
+	}
+	fields := f.Value.([]string)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid object for instance %d: %v", id, fields)
+	}
+
+	started, _, err := s.exists(path.Join(p, startPath))
+	if err != nil {
+		return
+	}
+	if !started {
+		ins := &Instance{Id: id, AppName: fields[0], RevisionName: fields[1], ProcessName: fields[2]}
+
+		if err = s.del(ins.ptyInstancesPath()); err != nil && !IsErrNoEnt(err) {
+			return
+		}
+		if err = s.del(p); err != nil {
+			return
+		}
+		return []string{fmt.Sprintf("removed partially registered instance %d", id)}, nil
+	}
+
+	ins, err := GetInstance(s, id)
+	if err != nil {
+		return
+	}
+
+	if ins.Ip != "" {
+		claimed, _, err := s.exists(ins.claimPath(ins.Ip))
+		if err != nil {
+			return repairs, err
+		}
+		if !claimed {
+			if _, err = s.set(ins.claimPath(ins.Ip), timestamp()); err != nil {
+				return repairs, err
+			}
+			repairs = append(repairs, fmt.Sprintf("added missing claim of instance %d by %s", id, ins.Ip))
+		}
+	}
+
+	if ins.Status != InsStatusFailed && ins.Status != InsStatusExited && ins.Status != InsStatusLost {
+		return
+	}
+	if ins.Status == InsStatusFailed {
+		listed, _, err := s.exists(ins.ptyFailedPath())
+		if err != nil {
+			return repairs, err
+		}
+		if !listed {
+			if _, err = s.set(ins.ptyFailedPath(), timestamp()+" unknown"); err != nil {
+				return repairs, err
+			}
+			repairs = append(repairs, fmt.Sprintf("added failed instance %d to the failures of %s", id, ins.RefString()))
+		}
+	}
+	listed, _, err := s.exists(ins.ptyInstancesPath())
+	if err != nil {
+		return
+	}
+	if listed {
+		if err = s.del(ins.ptyInstancesPath()); err != nil {
+			return
+		}
+		repairs = append(repairs, fmt.Sprintf("removed %s instance %d from the instances of %s", ins.Status, id, ins.RefString()))
+	}
+	return
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func repairSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/repair-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+func TestAppsSkipsPartialApps(t *testing.T) {
+	s := repairSetup()
+
+	if _, err := NewApp("wholecat", "git://wholecat", "s1", s).Register(); err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by a registration which died after the first write
+	s, err := s.FastForward(-1).set(path.Join(appsPath, "halfcat", "env", "MEOW"), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apps, err := Apps(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Name != "wholecat" {
+		t.Errorf("expected only wholecat, got %v", apps)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	s := repairSetup()
+
+	// Partially registered app
+	s, err := s.set(path.Join(appsPath, "halfcat", "attrs"), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Instance registered without start
+	pending, err := RegisterInstance("repaircat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pending.Dir.del(startPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instance claimed without claims entry
+	s = s.FastForward(-1)
+	claimed, err := RegisterInstance("repaircat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err = claimed.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = claimed.Dir.del(path.Join(claimsPath, "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instance failed without being moved to failed/
+	s = s.FastForward(-1)
+	failed, err := RegisterInstance("repaircat", "f00", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed, err = failed.Claim("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = failed.Dir.set(statusPath, InsStatusFailed); err != nil {
+		t.Fatal(err)
+	}
+
+	s = s.FastForward(-1)
+	repairs, err := Repair(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 5 {
+		t.Errorf("expected 5 repairs, got %d: %v", len(repairs), repairs)
+	}
+	s = s.FastForward(-1)
+
+	if exists, _, _ := s.exists(path.Join(appsPath, "halfcat")); exists {
+		t.Error("expected partially registered app to be removed")
+	}
+	if exists, _, _ := s.exists(pending.Dir.Name); exists {
+		t.Error("expected instance without start to be removed")
+	}
+	if exists, _, _ := s.exists(pending.ptyInstancesPath()); exists {
+		t.Error("expected instance without start to be unlisted")
+	}
+	if exists, _, _ := s.exists(claimed.claimPath("10.0.0.1")); !exists {
+		t.Error("expected claim to be added")
+	}
+	if exists, _, _ := s.exists(failed.ptyFailedPath()); !exists {
+		t.Error("expected failed instance to be added to failures")
+	}
+	if exists, _, _ := s.exists(failed.ptyInstancesPath()); exists {
+		t.Error("expected failed instance to be unlisted")
+	}
+
+	// Repairing a consistent registry is a no-op
+	if repairs, err = Repair(s); err != nil || len(repairs) != 0 {
+		t.Errorf("expected no repairs, got %v (%v)", repairs, err)
+	}
+}
+
+func TestRepairLeavesCompleteObjects(t *testing.T) {
+	s := repairSetup()
+
+	if _, err := NewApp("okcat", "git://okcat", "s1", s).Register(); err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance("okcat", "f00", "web", s.FastForward(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ins.Failed("10.0.0.1", errors.New("no reason")); err != nil {
+		t.Fatal(err)
+	}
+
+	repairs, err := Repair(s.FastForward(-1))
+	if err != nil || len(repairs) != 0 {
+		t.Errorf("expected no repairs, got %v (%v)", repairs, err)
+	}
+}
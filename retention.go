@@ -0,0 +1,73 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"sort"
+	"time"
+)
+
+// PruneRevisions unregisters the revisions of the app which are not
+// retained by its KeepRevisions policy. The KeepRevisions most recently
+// registered revisions are kept, as well as the head of the app and all
+// revisions which still have instances. Apps with a KeepRevisions of 0
+// keep all their revisions.
+//
+// The policy is applied to the latest state of the app. It returns the
+// revisions which were unregistered. If instances of a revision are
+// registered meanwhile, it fails with ErrRevMismatch.
+func PruneRevisions(app *App) (removed []*Revision, err error) {
+	s := app.Dir.Snapshot.FastForward(-1)
+
+	app, err = GetApp(s, app.Name)
+	if err != nil || app.KeepRevisions == 0 {
+		return
+	}
+	revs, err := AppRevisions(s, app)
+	if IsErrNoEnt(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	if len(revs) <= app.KeepRevisions {
+		return
+	}
+
+	registered := map[*Revision]time.Time{}
+	filerevs := map[*Revision]int64{}
+
+	for _, r := range revs {
+		val, filerev, err := r.Dir.get("registered")
+		if err != nil && !IsErrNoEnt(err) {
+			return nil, err
+		}
+		// Revisions without a valid registration time are considered oldest
+		registered[r], _ = time.Parse(time.RFC3339, val)
+		filerevs[r] = filerev
+	}
+	// Most recently registered first
+	sort.Slice(revs, func(i, j int) bool {
+		ti, tj := registered[revs[i]], registered[revs[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return filerevs[revs[i]] > filerevs[revs[j]]
+	})
+
+	for _, r := range revs[app.KeepRevisions:] {
+		if r.Ref == app.Head {
+			continue
+		}
+		// Unregistering at s refuses instances registered since
+		if err := r.Unregister(); IsErrRevInUse(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		removed = append(removed, r)
+	}
+	return
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+)
+
+func retentionSetup() (app *App) {
+	s, err := DialUri("mem:", "/retention-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	app, err = NewApp("prunecat", "git://prunecat", "s1", s.FastForward(rev)).Register()
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func TestAppKeepRevisions(t *testing.T) {
+	app := retentionSetup()
+
+	app, err := app.SetKeepRevisions(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = GetApp(app.Dir.Snapshot, app.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.KeepRevisions != 3 || app.Stack != "s1" {
+		t.Errorf("expected 3 revisions to be kept, got %#v", app)
+	}
+	if _, err = app.SetKeepRevisions(-1); err == nil {
+		t.Error("expected negative retention to be refused")
+	}
+}
+
+func TestRevisionUnregisterInUse(t *testing.T) {
+	app := retentionSetup()
+
+	rev, err := NewRevision(app, "f00", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance(app.Name, rev.Ref, "web", rev.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rev.FastForward(-1).Unregister()
+	if e, ok := err.(*Error); !ok || e.Err != ErrRevInUse {
+		t.Fatalf("expected ErrRevInUse, got %v", err)
+	}
+
+	if err = ins.Unregister(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rev.FastForward(-1).Unregister(); err != nil {
+		t.Errorf("expected revision without instances to be unregistered, got %v", err)
+	}
+}
+
+func TestRevisionUnregisterRace(t *testing.T) {
+	app := retentionSetup()
+
+	rev, err := NewRevision(app, "f00", app.Dir.Snapshot).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered after the snapshot of rev was taken
+	if _, err = RegisterInstance(app.Name, rev.Ref, "web", rev.Dir.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	err = rev.Unregister()
+	if !IsErrRevMismatch(err) {
+		t.Fatalf("expected ErrRevMismatch, got %v", err)
+	}
+	if _, err = GetRevision(rev.Dir.Snapshot.FastForward(-1), app, rev.Ref); err != nil {
+		t.Errorf("expected revision to be kept, got %v", err)
+	}
+}
+
+func TestPruneRevisions(t *testing.T) {
+	app := retentionSetup()
+
+	removed, err := PruneRevisions(app)
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("expected nothing to be removed without policy, got %v (%v)", removed, err)
+	}
+
+	times := map[string]string{
+		"r1": "2012-07-01T10:00:00Z",
+		"r2": "2012-07-02T10:00:00Z",
+		"r3": "2012-07-03T10:00:00Z",
+		"r4": "2012-07-04T10:00:00Z",
+		"r5": "2012-07-05T10:00:00Z",
+	}
+	// Register out of order, so that registration time is what counts
+	for _, ref := range []string{"r5", "r3", "r1", "r4", "r2"} {
+		rev, err := NewRevision(app, ref, app.Dir.Snapshot.FastForward(-1)).Register()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = rev.Dir.set("registered", times[ref]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := app.Dir.Snapshot.FastForward(-1)
+
+	if _, err = RegisterInstance(app.Name, "r2", "web", s); err != nil {
+		t.Fatal(err)
+	}
+	if app, err = app.FastForward(-1).SetHead("r1"); err != nil {
+		t.Fatal(err)
+	}
+	if app, err = app.SetKeepRevisions(2); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err = PruneRevisions(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Ref != "r3" {
+		t.Fatalf("expected r3 to be removed, got %v", removed)
+	}
+
+	revs, err := AppRevisions(app.Dir.Snapshot.FastForward(-1), app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 4 {
+		t.Errorf("expected 4 revisions to be left, got %v", revs)
+	}
+}
@@ -64,11 +64,72 @@ func (r *Revision) Register() (revision *Revision, err error) {
 	return
 }
 
-// Unregister unregisters a revision from the registry.
+// Unregister unregisters a revision from the registry. Revisions
+// which still have instances are refused with ErrRevInUse. The
+// revision is deleted at the revision of its snapshot: if it or its
+// instances were changed since, Unregister fails with ErrRevMismatch.
 func (r *Revision) Unregister() (err error) {
+	n, err := r.numInstances()
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		return NewError(ErrRevInUse, fmt.Sprintf("%s: %s has %d instances", ErrRevInUse.Error(), r.RefString(), n))
+	}
+	if err = r.checkInstances(); err != nil {
+		return
+	}
 	return r.Dir.del("/")
 }
 
+// numInstances returns the number of instances of
+// the revision, across all proctypes of its app.
+func (r *Revision) numInstances() (n int, err error) {
+	procs, err := r.Dir.Snapshot.getdir(r.App.Dir.prefix(procsPath))
+	if IsErrNoEnt(err) {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	for _, proc := range procs {
+		size, _, err := r.Dir.Snapshot.conn.Stat(ptyInstancesPath(r.App.Name, r.Ref, proc), &r.Dir.Snapshot.Rev)
+		if err != nil {
+			return 0, err
+		}
+		n += size
+	}
+	return
+}
+
+// checkInstances fails with ErrRevMismatch if instances of the
+// revision were registered or unregistered after its snapshot.
+func (r *Revision) checkInstances() error {
+	conn := r.Dir.Snapshot.conn
+
+	latest, err := conn.Rev()
+	if err != nil {
+		return err
+	}
+	procs, err := conn.Getdir(r.App.Dir.prefix(procsPath), latest)
+	if IsErrNoEnt(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, proc := range procs {
+		modrev, err := conn.LastModified(ptyInstancesPath(r.App.Name, r.Ref, proc), latest)
+		if IsErrNoEnt(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if modrev > r.Dir.Snapshot.Rev {
+			return NewError(ErrRevMismatch, fmt.Sprintf("instances of %s were modified at %d, after %d", r.RefString(), modrev, r.Dir.Snapshot.Rev))
+		}
+	}
+	return nil
+}
+
 func (r *Revision) SetArchiveUrl(url string) (revision *Revision, err error) {
 	rev, err := r.Dir.set("archive-url", url)
 	if err != nil {
@@ -78,6 +139,11 @@ func (r *Revision) SetArchiveUrl(url string) (revision *Revision, err error) {
 	return
 }
 
+// RefString returns the revision as app@ref.
+func (r *Revision) RefString() string {
+	return fmt.Sprintf("%s@%s", r.App.Name, r.Ref)
+}
+
 func (r *Revision) String() string {
 	return fmt.Sprintf("Revision<%s:%s>", r.App.Name, r.Ref)
 }
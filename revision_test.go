@@ -10,7 +10,7 @@ import (
 )
 
 func revSetup() (s Snapshot, app *App) {
-	s, err := Dial(DefaultAddr, "/revision-test")
+	s, err := testDial("/revision-test")
 	if err != nil {
 		panic(err)
 	}
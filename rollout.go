@@ -0,0 +1,286 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+)
+
+const rolloutPath = "rollout"
+
+type RolloutState string
+
+const (
+	RolloutRunning    RolloutState = "running"
+	RolloutDone       RolloutState = "done"
+	RolloutRolledBack RolloutState = "rolled-back"
+)
+
+// A Rollout moves a proctype from one revision of an app to another.
+// The new revision is scaled up Step instances at a time. Once all
+// instances of a step are running, the old revision is scaled down
+// by as many instances. When more than MaxFailures instances of the
+// new revision fail or exit before running, the old revision is
+// scaled back up, the new one down to zero, and the rollout is
+// rolled back.
+//
+// The progress of a rollout is stored in the coordinator after every
+// step, so that a deployer which was stopped can resume it with
+// GetRollout and Run. A proctype has at most one running rollout.
+type Rollout struct {
+	Dir         dir          `json:"-"`
+	App         string       `json:"app"`
+	Proc        string       `json:"proc"`
+	From        string       `json:"from"` // Revision scaled down, may be empty
+	To          string       `json:"to"`   // Revision scaled up
+	Target      int          `json:"target"`
+	Step        int          `json:"step"`
+	MaxFailures int          `json:"max-failures"`
+	FromScale   int          `json:"from-scale"` // Instances of From when started
+	Done        int          `json:"done"`       // Instances of To running
+	Failures    int          `json:"failures"`
+	State       RolloutState `json:"state"`
+	Started     string       `json:"started"`
+}
+
+// NewRollout returns a Rollout of app:proc from revision from to revision
+// to, ending with target instances of the latter. It starts one instance
+// at a time and rolls back on the first failure, unless Step and
+// MaxFailures are changed before calling Start.
+func NewRollout(app, proc, from, to string, target int, s Snapshot) *Rollout {
+	return &Rollout{
+		App:    app,
+		Proc:   proc,
+		From:   from,
+		To:     to,
+		Target: target,
+		Step:   1,
+		Dir:    dir{s, path.Join(appsPath, app, procsPath, proc)},
+	}
+}
+
+// GetRollout returns the last rollout of app:proc.
+func GetRollout(s Snapshot, app, proc string) (r *Rollout, err error) {
+	d := dir{s, path.Join(appsPath, app, procsPath, proc)}
+
+	val, _, err := d.get(rolloutPath)
+	if err != nil {
+		return
+	}
+	r = &Rollout{}
+	if err = json.Unmarshal([]byte(val), r); err != nil {
+		return nil, err
+	}
+	r.Dir = d
+
+	return
+}
+
+func (r *Rollout) createSnapshot(rev int64) snapshotable {
+	tmp := *r
+	tmp.Dir.Snapshot = Snapshot{rev, r.Dir.Snapshot.conn}
+	return &tmp
+}
+
+// FastForward advances the rollout in time. It returns
+// a new instance of Rollout with the supplied revision.
+func (r *Rollout) FastForward(rev int64) *Rollout {
+	return r.Dir.Snapshot.fastForward(r, rev).(*Rollout)
+}
+
+// Start stores the rollout in the coordinator. It fails with
+// ErrKeyConflict if another rollout of the proctype is running.
+func (r *Rollout) Start() (r1 *Rollout, err error) {
+	if r.Target < 1 || r.Step < 1 || r.MaxFailures < 0 {
+		return nil, errors.New("rollout target and step need to be positive integers")
+	}
+	if r.From == r.To {
+		return nil, fmt.Errorf("%s is already at %s", r, r.To)
+	}
+	s := r.Dir.Snapshot
+
+	for _, rev := range []string{r.From, r.To} {
+		if rev == "" {
+			continue
+		}
+		exists, _, err := s.conn.Exists(path.Join(appsPath, r.App, revsPath, rev))
+		if err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, NewError(ErrNoEnt, fmt.Sprintf("%s@%s not found", r.App, rev))
+		}
+	}
+	exists, _, err := s.conn.Exists(r.Dir.Name)
+	if err != nil {
+		return
+	} else if !exists {
+		return nil, NewError(ErrNoEnt, fmt.Sprintf("proc '%s' doesn't exist", r.Proc))
+	}
+
+	last, err := GetRollout(s, r.App, r.Proc)
+	if err == nil && last.State == RolloutRunning {
+		return nil, NewError(ErrKeyConflict, fmt.Sprintf("%s is already being rolled out to %s", r, last.To))
+	} else if err != nil && !IsErrNoEnt(err) {
+		return
+	}
+
+	if r.From != "" {
+		ids, err := liveInstanceIds(s, r.App, r.From, r.Proc)
+		if err != nil {
+			return nil, err
+		}
+		r.FromScale = len(ids)
+	}
+	r.Done, r.Failures = 0, 0
+	r.State = RolloutRunning
+	r.Started = timestamp()
+
+	return r.save()
+}
+
+// Run performs the remaining steps of a running rollout, until it is
+// done or rolled back. When ctx is done, the rollout is left running
+// and ctx.Err() is returned. Rollouts which were rolled back return an
+// ErrRolledBack.
+func (r *Rollout) Run(ctx context.Context) (r1 *Rollout, err error) {
+	for r.State == RolloutRunning {
+		if r, err = r.step(ctx); err != nil {
+			return r, err
+		}
+	}
+	if r.State == RolloutRolledBack {
+		err = NewError(ErrRolledBack, fmt.Sprintf("%s: rolled back to %s after %d failures", r, r.From, r.Failures))
+	}
+	return r, err
+}
+
+// step scales the new revision up to the next step and waits for its
+// instances. The progress is stored before returning.
+func (r *Rollout) step(ctx context.Context) (r1 *Rollout, err error) {
+	s := r.Dir.Snapshot.FastForward(-1)
+
+	want := r.Done + r.Step
+	if want > r.Target {
+		want = r.Target
+	}
+	if _, _, err = Scale(r.App, r.To, r.Proc, want, s); err != nil {
+		return r, err
+	}
+	s = s.FastForward(-1)
+
+	ids, err := liveInstanceIds(s, r.App, r.To, r.Proc)
+	if err != nil {
+		return r, err
+	}
+	// Instances which failed before being listed count as well
+	failures := want - len(ids)
+	if failures < 0 {
+		failures = 0
+	}
+	for _, id := range ids {
+		ins, err := waitRunning(ctx, s, id)
+		if IsErrNoEnt(err) {
+			failures++
+			continue
+		} else if err != nil {
+			return r, err
+		}
+		if ins.Status == InsStatusFailed || ins.Status == InsStatusExited || ins.Status == InsStatusLost {
+			failures++
+		}
+	}
+
+	r1 = r.FastForward(r.Dir.Snapshot.Rev)
+	if failures > 0 {
+		r1.Failures += failures
+		if r1.Failures > r1.MaxFailures {
+			return r1.rollback()
+		}
+		// Failed instances are unlisted, and replaced
+		// when the step is retried.
+		return r1.save()
+	}
+
+	if r1.From != "" {
+		rest := r1.FromScale - want
+		if rest < 0 || want == r1.Target {
+			rest = 0
+		}
+		if _, _, err = Scale(r1.App, r1.From, r1.Proc, rest, s.FastForward(-1)); err != nil {
+			return r, err
+		}
+	}
+	r1.Done = want
+	if r1.Done == r1.Target {
+		r1.State = RolloutDone
+	}
+	return r1.save()
+}
+
+// rollback restores the old revision to its scale,
+// scales the new revision down to zero and stores
+// the rollout as rolled back.
+func (r *Rollout) rollback() (r1 *Rollout, err error) {
+	s := r.Dir.Snapshot.FastForward(-1)
+
+	if r.From != "" {
+		if _, _, err = Scale(r.App, r.From, r.Proc, r.FromScale, s); err != nil {
+			return r, err
+		}
+		s = s.FastForward(-1)
+	}
+	if _, _, err = Scale(r.App, r.To, r.Proc, 0, s); err != nil {
+		return r, err
+	}
+	r.State = RolloutRolledBack
+
+	return r.save()
+}
+
+func (r *Rollout) save() (r1 *Rollout, err error) {
+	//
+	//   apps/<app>/procs/<proc>/
+	// +     rollout = {"from": "a1b2c3", "to": "d4e5f6", "state": "running", ...}
+	//
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	rev, err := r.Dir.set(rolloutPath, string(data))
+	if err != nil {
+		return r, err
+	}
+	return r.FastForward(rev), nil
+}
+
+// waitRunning waits until the instance is running, or has failed or
+// exited before, and returns it at that revision.
+func waitRunning(ctx context.Context, s Snapshot, id int64) (ins *Instance, err error) {
+	p := path.Join(instancePath(id), "*")
+
+	for {
+		ins, err = GetInstance(s, id)
+		if err != nil {
+			return
+		}
+		if ins.Status != InsStatusPending && ins.Status != InsStatusClaimed {
+			return
+		}
+		ev, err := s.conn.WaitContext(ctx, p, s.Rev+1)
+		if err != nil {
+			return nil, err
+		}
+		s = s.FastForward(ev.Rev)
+	}
+}
+
+func (r *Rollout) String() string {
+	return fmt.Sprintf("%s:%s", r.App, r.Proc)
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func rolloutSetup(t *testing.T) (s Snapshot) {
+	s, err := DialUri("mem:", "/rollout-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp("rollcat", "git://rollcat", "s1", s.FastForward(rev)).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"r1", "r2"} {
+		if _, err = NewRevision(app, ref, app.Dir.Snapshot.FastForward(-1)).Register(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = NewProcType(app, "web", app.Dir.Snapshot.FastForward(-1)).Register(); err != nil {
+		t.Fatal(err)
+	}
+	return s.FastForward(-1)
+}
+
+// rolloutPm starts all new instances, except those of the
+// revision fail, which fail, until ctx is done.
+func rolloutPm(ctx context.Context, t *testing.T, s Snapshot, fail string) {
+	l := make(chan *Instance)
+	go WatchInstanceStartContext(ctx, s, l)
+
+	for ins := range l {
+		ins, err := ins.Claim("10.0.0.1")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if ins.RevisionName == fail {
+			_, err = ins.Failed("10.0.0.1", errors.New("crash"))
+		} else {
+			_, err = ins.Started("10.0.0.1", 9000+int(ins.Id%1000), "box")
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func rolloutScale(t *testing.T, s Snapshot, rev string) int {
+	ids, err := liveInstanceIds(s.FastForward(-1), "rollcat", rev, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(ids)
+}
+
+func TestRollout(t *testing.T) {
+	s := rolloutSetup(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, _, err := Scale("rollcat", "r1", "web", 3, s); err != nil {
+		t.Fatal(err)
+	}
+	go rolloutPm(ctx, t, s.FastForward(-1), "")
+
+	r := NewRollout("rollcat", "web", "r1", "r2", 3, s.FastForward(-1))
+	r.Step = 2
+	r, err := r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewRollout("rollcat", "web", "r1", "r2", 1, s.FastForward(-1)).Start(); err == nil {
+		t.Error("expected a second rollout of the proctype to be refused")
+	}
+
+	r, err = r.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != RolloutDone || r.Done != 3 {
+		t.Errorf("expected rollout to be done, got %#v", r)
+	}
+	if n := rolloutScale(t, s, "r2"); n != 3 {
+		t.Errorf("expected 3 instances of r2, got %d", n)
+	}
+	if n := rolloutScale(t, s, "r1"); n != 0 {
+		t.Errorf("expected no instances of r1, got %d", n)
+	}
+
+	r, err = GetRollout(s.FastForward(-1), "rollcat", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != RolloutDone || r.FromScale != 3 || r.To != "r2" {
+		t.Errorf("expected rollout to be stored, got %#v", r)
+	}
+}
+
+func TestRolloutRollback(t *testing.T) {
+	s := rolloutSetup(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, _, err := Scale("rollcat", "r1", "web", 2, s); err != nil {
+		t.Fatal(err)
+	}
+	go rolloutPm(ctx, t, s.FastForward(-1), "r2")
+
+	r := NewRollout("rollcat", "web", "r1", "r2", 2, s.FastForward(-1))
+	r.MaxFailures = 1
+	r, err := r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = r.Run(ctx)
+	if e, ok := err.(*Error); !ok || e.Err != ErrRolledBack {
+		t.Fatalf("expected ErrRolledBack, got %v", err)
+	}
+	if r.State != RolloutRolledBack || r.Failures != 2 {
+		t.Errorf("expected rollout to be rolled back after 2 failures, got %#v", r)
+	}
+	if n := rolloutScale(t, s, "r2"); n != 0 {
+		t.Errorf("expected no instances of r2, got %d", n)
+	}
+	if n := rolloutScale(t, s, "r1"); n != 2 {
+		t.Errorf("expected 2 instances of r1, got %d", n)
+	}
+}
+
+func TestRolloutResume(t *testing.T) {
+	s := rolloutSetup(t)
+
+	r, err := NewRollout("rollcat", "web", "", "r2", 2, s).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a process manager, the first step never completes
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = r.Run(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+
+	r, err = GetRollout(s.FastForward(-1), "rollcat", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != RolloutRunning || r.Done != 0 {
+		t.Fatalf("expected rollout to be running, got %#v", r)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Instances registered before the restart are started too
+	for _, ins := range mustInstances(t, s, "r2") {
+		go func(ins *Instance) {
+			if ins, err := ins.Claim("10.0.0.2"); err == nil {
+				ins.Started("10.0.0.2", 9001, "box2")
+			}
+		}(ins)
+	}
+	go rolloutPm(ctx, t, s.FastForward(-1), "")
+
+	if r, err = r.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r.State != RolloutDone {
+		t.Errorf("expected resumed rollout to be done, got %#v", r)
+	}
+	if n := rolloutScale(t, s, "r2"); n != 2 {
+		t.Errorf("expected 2 instances of r2, got %d", n)
+	}
+}
+
+func mustInstances(t *testing.T, s Snapshot, rev string) (ins []*Instance) {
+	s = s.FastForward(-1)
+
+	ids, err := getInstanceIds(s, "rollcat", rev, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		i, err := GetInstance(s, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ins = append(ins, i)
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package visor
 
 import (
+	"context"
 	"strconv"
 )
 
@@ -13,21 +14,37 @@ type SchemaEvent struct {
 // WatchSchema notifies the specified ch channel on schema change,
 // and errch on error. If an error occures, WatchSchema exits.
 func WatchSchema(s Snapshot, ch chan SchemaEvent, errch chan error) {
+	if err := watchSchema(context.Background(), s, ch); err != nil {
+		errch <- err
+	}
+}
+
+// WatchSchemaContext notifies the specified ch channel on schema change
+// until an error occures or ctx is done, in which case ctx.Err() is
+// returned. The ch channel is closed on return.
+func WatchSchemaContext(ctx context.Context, s Snapshot, ch chan SchemaEvent) error {
+	defer close(ch)
+	return watchSchema(ctx, s, ch)
+}
+
+func watchSchema(ctx context.Context, s Snapshot, ch chan SchemaEvent) error {
 	rev := s.Rev
 	for {
-		ev, err := s.conn.Wait(schemaPath, rev+1)
+		ev, err := s.conn.WaitContext(ctx, schemaPath, rev+1)
 		if err != nil {
-			errch <- err
-			return
+			return err
 		}
 		rev = ev.Rev
 
 		v, err := strconv.Atoi(string(ev.Body))
 		if err != nil {
-			errch <- err
-			return
+			return err
+		}
+		select {
+		case ch <- SchemaEvent{v}:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		ch <- SchemaEvent{v}
 	}
 }
 
@@ -47,13 +64,17 @@ func SetSchemaVersion(s Snapshot, version int) (newSnapshot Snapshot, err error)
 	return
 }
 
-func verifySchemaVersion(s Snapshot, version int) (int, error) {
+// getSchemaVersion returns the schema version of the coordinator.
+func getSchemaVersion(s Snapshot) (int, error) {
 	value, _, err := s.get(schemaPath)
 	if err != nil {
 		return -1, err
 	}
+	return strconv.Atoi(value)
+}
 
-	intValue, err := strconv.Atoi(value)
+func verifySchemaVersion(s Snapshot, version int) (int, error) {
+	intValue, err := getSchemaVersion(s)
 	if err != nil {
 		return intValue, err
 	}
@@ -29,7 +29,7 @@ func cleanSchemaVersion(s Snapshot, t *testing.T) Snapshot {
 }
 
 func TestSchemaMissing(t *testing.T) {
-	s, err := Dial(DefaultAddr, DefaultRoot)
+	s, err := testDial(DefaultRoot)
 
 	if err != nil {
 		panic(err)
@@ -47,7 +47,7 @@ func TestSchemaMissing(t *testing.T) {
 }
 
 func TestSetVersion(t *testing.T) {
-	s, err := Dial(DefaultAddr, DefaultRoot)
+	s, err := testDial(DefaultRoot)
 
 	if err != nil {
 		panic(err)
@@ -65,7 +65,7 @@ func TestSetVersion(t *testing.T) {
 }
 
 func TestVersionTooNew(t *testing.T) {
-	s, err := Dial(DefaultAddr, DefaultRoot)
+	s, err := testDial(DefaultRoot)
 	coordinatorVersion := 0
 
 	if err != nil {
@@ -88,7 +88,7 @@ func TestVersionTooNew(t *testing.T) {
 }
 
 func TestVersionTooOld(t *testing.T) {
-	s, err := Dial(DefaultAddr, DefaultRoot)
+	s, err := testDial(DefaultRoot)
 	coordinatorVersion := 99
 
 	if err != nil {
@@ -111,7 +111,7 @@ func TestVersionTooOld(t *testing.T) {
 }
 
 func TestSchemaWatcher(t *testing.T) {
-	s, err := Dial(DefaultAddr, DefaultRoot)
+	s, err := testDial(DefaultRoot)
 	coordinatorVersion := 2
 
 	if err != nil {
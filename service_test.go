@@ -10,7 +10,7 @@ import (
 )
 
 func serviceSetup(name string) (srv *Service) {
-	s, err := Dial(DefaultAddr, "/service-test")
+	s, err := testDial("/service-test")
 	if err != nil {
 		panic(err)
 	}
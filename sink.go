@@ -0,0 +1,307 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrSinkFull is passed to the error handler of a Forwarder
+// when an event is dropped because the buffer of a sink is full.
+var ErrSinkFull = errors.New("sink buffer is full")
+
+// ErrSinkAborted is passed to the error handler of a Forwarder for
+// each event left in the buffer of a sink when the forwarder is stopped.
+var ErrSinkAborted = errors.New("forwarder stopped before sending")
+
+// A Sink receives the events forwarded by a Forwarder.
+type Sink interface {
+	Send(e *Event) error
+	Close() error
+}
+
+// A Forwarder watches the registry and forwards the events to a
+// set of sinks. Every sink has its own filter and buffer, and is
+// fed by its own goroutine, so that a slow sink doesn't stall the
+// others. Events which don't fit into the buffer of a sink are
+// dropped for that sink.
+type Forwarder struct {
+	// OnError is called when a sink fails to send an event, or when
+	// an event is dropped. If nil, errors are written to the log.
+	OnError func(sink Sink, e *Event, err error)
+
+	snapshot Snapshot
+	routes   []*sinkRoute
+}
+
+type sinkRoute struct {
+	sink   Sink
+	filter Filter
+	events chan *Event
+}
+
+// NewForwarder returns a Forwarder for the events
+// following the given snapshot.
+func NewForwarder(s Snapshot) *Forwarder {
+	return &Forwarder{snapshot: s}
+}
+
+// AddSink adds a sink receiving the events matching filter,
+// buffering up to buffer events. AddSink must not be called
+// while the forwarder is running.
+func (f *Forwarder) AddSink(sink Sink, filter Filter, buffer int) {
+	f.routes = append(f.routes, &sinkRoute{sink: sink, filter: filter, events: make(chan *Event, buffer)})
+}
+
+// Run forwards events until ctx is done or watching the registry
+// fails, and closes all sinks before returning. If watching fails,
+// the events left in the buffers are sent first. If ctx is done,
+// the sinks are closed right away, which aborts the sends in
+// progress, and the events left are dropped with ErrSinkAborted.
+func (f *Forwarder) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	abort := make(chan bool)
+
+	for _, r := range f.routes {
+		wg.Add(1)
+		go func(r *sinkRoute) {
+			defer wg.Done()
+			for e := range r.events {
+				select {
+				case <-abort:
+					f.error(r.sink, e, ErrSinkAborted)
+					continue
+				default:
+				}
+				if err := r.sink.Send(e); err != nil {
+					f.error(r.sink, e, err)
+				}
+			}
+		}(r)
+	}
+
+	listener := make(chan *Event)
+	errch := make(chan error, 1)
+
+	go func() {
+		errch <- WatchEventContext(ctx, f.snapshot, listener)
+	}()
+
+	for e := range listener {
+		for _, r := range f.routes {
+			if !r.filter.Match(e) {
+				continue
+			}
+			select {
+			case r.events <- e:
+			default:
+				f.error(r.sink, e, ErrSinkFull)
+			}
+		}
+	}
+
+	aborted := ctx.Err() != nil
+	if aborted {
+		close(abort)
+		f.closeSinks()
+	}
+	for _, r := range f.routes {
+		close(r.events)
+	}
+	wg.Wait()
+
+	if !aborted {
+		f.closeSinks()
+	}
+	return <-errch
+}
+
+func (f *Forwarder) closeSinks() {
+	for _, r := range f.routes {
+		if err := r.sink.Close(); err != nil {
+			f.error(r.sink, nil, err)
+		}
+	}
+}
+
+func (f *Forwarder) error(sink Sink, e *Event, err error) {
+	if f.OnError != nil {
+		f.OnError(sink, e, err)
+		return
+	}
+	if e != nil {
+		log.Printf("sink %s: error forwarding event %d %s: %s", sink, e.Rev, e.Type, err)
+	} else {
+		log.Printf("sink %s: %s", sink, err)
+	}
+}
+
+// JSONSink writes events as newline-delimited JSON.
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a sink writing to w. If w is an
+// io.Closer, it is closed when the sink is closed.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// NewJSONFileSink returns a sink appending to the file at path,
+// which is created if it doesn't exist. A path of "-" writes to
+// standard output.
+func NewJSONFileSink(path string) (*JSONSink, error) {
+	if path == "-" {
+		return NewJSONSink(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSink(f), nil
+}
+
+func (s *JSONSink) Send(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+func (s *JSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *JSONSink) String() string {
+	return "JSONSink"
+}
+
+// WebhookSink posts events as JSON to an HTTP endpoint. Requests
+// failing with a network error, a 5xx or a 429 status are retried
+// up to Retries times, doubling the delay after each attempt,
+// starting with Backoff and up to MaxBackoff. Closing the sink
+// cancels the request in progress and the pending retries.
+type WebhookSink struct {
+	Url        string
+	Client     *http.Client
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+// NewWebhookSink returns a sink posting to url with
+// the default retry settings.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		Url:        url,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		Retries:    5,
+		Backoff:    500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		closed:     make(chan bool),
+	}
+}
+
+func (s *WebhookSink) Send(e *Event) (err error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	backoff := s.Backoff
+
+	for attempt := 0; ; attempt++ {
+		var retry bool
+
+		retry, err = s.post(data)
+		if err == nil || !retry || attempt >= s.Retries {
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.closed:
+			return
+		}
+		if backoff *= 2; s.MaxBackoff > 0 && backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+func (s *WebhookSink) post(data []byte) (retry bool, err error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("webhook %s returned %s", s.Url, resp.Status)
+}
+
+// Close aborts the request in progress and pending retries.
+func (s *WebhookSink) Close() error {
+	s.closeOnce.Do(func() {
+		if s.closed != nil {
+			close(s.closed)
+		}
+	})
+	return nil
+}
+
+func (s *WebhookSink) String() string {
+	return fmt.Sprintf("WebhookSink<%s>", s.Url)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package visor
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogSink writes events as JSON to the local syslog daemon.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink returns a sink logging with the given tag
+// to the daemon facility.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w}, nil
+}
+
+func (s *SyslogSink) Send(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(data))
+}
+
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
+
+func (s *SyslogSink) String() string {
+	return "SyslogSink"
+}
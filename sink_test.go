@@ -0,0 +1,268 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sinkSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/sink-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+// blockingSink blocks on Send until release is closed.
+type blockingSink struct {
+	release chan bool
+	sent    int
+}
+
+func (s *blockingSink) Send(e *Event) error {
+	<-s.release
+	s.sent++
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestForwarderJSONSink(t *testing.T) {
+	s := sinkSetup()
+	buf := &syncBuffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := NewForwarder(s)
+	f.AddSink(NewJSONSink(buf), Filter{Types: []EventType{EvAppReg}}, 10)
+
+	done := make(chan error)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+
+	if _, err := NewApp("sinkcat", "git://sinkcat", "stack", s).Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for buf.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line, got %q", buf.String())
+	}
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["type"] != string(EvAppReg) || record["app"] != "sinkcat" || record["path"] != "/apps/sinkcat/registered" {
+		t.Errorf("unexpected record %v", record)
+	}
+}
+
+func TestForwarderDropsWhenFull(t *testing.T) {
+	s := sinkSetup()
+	slow := &blockingSink{release: make(chan bool)}
+	buf := &syncBuffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mu sync.Mutex
+	dropped := 0
+
+	f := NewForwarder(s)
+	f.OnError = func(sink Sink, e *Event, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sink == slow && (err == ErrSinkFull || err == ErrSinkAborted) {
+			dropped++
+		}
+	}
+	f.AddSink(slow, Filter{Types: []EventType{EvSrvReg}}, 1)
+	f.AddSink(NewJSONSink(buf), Filter{Types: []EventType{EvSrvReg}}, 10)
+
+	done := make(chan error)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+
+	for _, name := range []string{"one", "two", "three", "four"} {
+		if _, err := NewService("sink"+name, s).Register(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(buf.String(), "\n") < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 4 {
+		t.Errorf("expected the fast sink to receive 4 events, got %d", n)
+	}
+
+	cancel()
+	close(slow.release)
+	<-done
+
+	if dropped == 0 {
+		t.Error("expected events to be dropped for the slow sink")
+	}
+	if slow.sent+dropped != 4 {
+		t.Errorf("expected 4 events to be sent or dropped, got %d sent and %d dropped", slow.sent, dropped)
+	}
+}
+
+func TestForwarderCancelFailingWebhook(t *testing.T) {
+	s := sinkSetup()
+	requests := make(chan bool, 100)
+	release := make(chan bool)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- true
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	sink := NewWebhookSink(srv.URL)
+	sink.Client = &http.Client{}
+	sink.Backoff = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := NewForwarder(s)
+	f.OnError = func(Sink, *Event, error) {}
+	f.AddSink(sink, Filter{Types: []EventType{EvSrvReg}}, 10)
+
+	done := make(chan error)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+
+	for _, name := range []string{"one", "two"} {
+		if _, err := NewService("hook"+name, s).Register(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("expected the webhook to be called")
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return promptly after cancel")
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	body := ""
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL)
+	sink.Backoff = time.Millisecond
+
+	app := "hookcat"
+	err := sink.Send(&Event{Type: EvAppReg, Rev: 12, Path: EventData{App: &app}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+	if !strings.Contains(body, `"app":"hookcat"`) {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	sink.Retries = 1
+	attempts = -10
+	if err = sink.Send(&Event{Type: EvAppReg}); err == nil {
+		t.Error("expected error after exhausting retries")
+	}
+	if attempts != -8 {
+		t.Errorf("expected 2 attempts, got %d", attempts+10)
+	}
+}
+
+func TestWebhookSinkNoRetryOnClientError(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL)
+	sink.Backoff = time.Millisecond
+
+	if err := sink.Send(&Event{Type: EvAppReg}); err == nil {
+		t.Error("expected error")
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
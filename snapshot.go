@@ -7,7 +7,6 @@ package visor
 
 import (
 	"fmt"
-	"github.com/soundcloud/doozer"
 	"path"
 	"regexp"
 )
@@ -32,37 +31,46 @@ type snapshotable interface {
 	createSnapshot(rev int64) snapshotable
 }
 
-// Dial calls doozer.Dial and returns a Snapshot of the coordinator
-// at the latest revision.
+// Dial connects to the coordinator at addr and returns a Snapshot of
+// it at the latest revision. If addr starts with the scheme of a
+// registered Backend, that Backend is used, otherwise addr is
+// assumed to be the address of a doozerd instance.
 func Dial(addr string, root string) (s Snapshot, err error) {
-	dconn, err := doozer.Dial(addr)
-	if err != nil {
-		return
+	dial := dialDoozer
+	if dialer, ok := backendDialer(addr); ok {
+		dial = dialer
 	}
 
-	rev, err := dconn.Rev()
+	b, err := dial(addr)
 	if err != nil {
 		return
 	}
-
-	s = Snapshot{rev, &conn{addr, root, dconn}}
-	return
+	return newSnapshot(addr, root, b)
 }
 
-// DialUri calls doozer.DialUri and returns a Snapshot of the coordinator cluster
-// at the latest revision.
+// DialUri opens the Backend registered for the scheme of uri and returns
+// a Snapshot of the coordinator cluster at the latest revision.
 func DialUri(uri string, root string) (s Snapshot, err error) {
-	dconn, err := doozer.DialUri(uri, "")
+	b, err := dialBackend(uri)
 	if err != nil {
 		return
 	}
+	return newSnapshot(uri, root, b)
+}
+
+// NewSnapshot returns a Snapshot of the given Backend
+// at its latest revision.
+func NewSnapshot(b Backend, root string) (s Snapshot, err error) {
+	return newSnapshot("", root, b)
+}
 
-	rev, err := dconn.Rev()
+func newSnapshot(addr string, root string, b Backend) (s Snapshot, err error) {
+	rev, err := b.Rev()
 	if err != nil {
 		return
 	}
 
-	s = Snapshot{rev, &conn{uri, root, dconn}}
+	s = Snapshot{rev, &conn{addr, root, b}}
 	return
 }
 
@@ -195,10 +203,44 @@ func (s Snapshot) createSnapshot(rev int64) snapshotable {
 	return Snapshot{rev, s.conn}
 }
 
+// LastModified returns the revision of the latest change to the file
+// at path, or to any file below it if path is a directory, as of this
+// snapshot. The changes to a registry object can be checked with its
+// directory, e.g. app.Dir.Name.
+func (s Snapshot) LastModified(path string) (int64, error) {
+	return s.conn.LastModified(path, s.Rev)
+}
+
 func (s Snapshot) FastForward(rev int64) (ns Snapshot) {
 	return s.fastForward(s, rev).(Snapshot)
 }
 
+// Rewind moves the snapshot back in time. It returns a new Snapshot
+// at the supplied revision, or the snapshot itself if rev is not
+// older than its revision. Reads and watches on the new Snapshot
+// fail with ErrRevTooOld once the coordinator no longer holds
+// history for rev.
+//
+// Watchers started on a rewound snapshot replay all changes since
+// its revision, which allows resuming from the Rev of the last
+// processed Event:
+//
+//	go visor.WatchEvent(s.Rewind(lastEvent.Rev), listener)
+func (s Snapshot) Rewind(rev int64) Snapshot {
+	if rev < 0 || rev >= s.Rev {
+		return s
+	}
+	return Snapshot{rev, s.conn}
+}
+
+// CheckHistory returns an error for which IsErrRevTooOld returns
+// true if the coordinator no longer holds history for the revision
+// of the snapshot, e.g. after it was rewound.
+func (s Snapshot) CheckHistory() error {
+	_, _, err := s.conn.Stat("/", &s.Rev)
+	return err
+}
+
 // fastForward either calls *createSnapshot* on *obj* or returns *obj* if it
 // can't advance the object in time. Note that fastForward can never fail.
 func (s *Snapshot) fastForward(obj snapshotable, rev int64) snapshotable {
@@ -10,7 +10,7 @@ import (
 )
 
 func snapshotSetup() (s Snapshot) {
-	s, err := Dial(DefaultAddr, "/snapshot-test")
+	s, err := testDial("/snapshot-test")
 	if err != nil {
 		panic(err)
 	}
@@ -191,3 +191,71 @@ func TestSnapshotGetSnapshotablesError(t *testing.T) {
 		t.Error("expected result to be nil")
 	}
 }
+
+func TestSnapshotRewind(t *testing.T) {
+	s := snapshotSetup()
+
+	s1, err := s.set("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := s1.Rewind(s.Rev)
+	if s2.Rev != s.Rev {
+		t.Errorf("expected rev %d, got %d", s.Rev, s2.Rev)
+	}
+	if exists, _, _ := s2.exists("key"); exists {
+		t.Error("key shouldn't exist at rewound snapshot")
+	}
+	if s1.Rewind(s1.Rev+1).Rev != s1.Rev {
+		t.Error("rewind shouldn't advance the snapshot")
+	}
+}
+
+func TestSnapshotLastModified(t *testing.T) {
+	s := snapshotSetup()
+
+	s1, err := s.set("dir/a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := s1.set("dir/sub/b", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3, err := s2.set("other", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rev, err := s3.LastModified("dir"); err != nil || rev != s2.Rev {
+		t.Errorf("expected dir to be modified at %d, got %d (%v)", s2.Rev, rev, err)
+	}
+	if rev, err := s3.LastModified("dir/a"); err != nil || rev != s1.Rev {
+		t.Errorf("expected dir/a to be modified at %d, got %d (%v)", s1.Rev, rev, err)
+	}
+	if rev, err := s1.LastModified("dir"); err != nil || rev != s1.Rev {
+		t.Errorf("expected dir to be modified at %d as of %d, got %d (%v)", s1.Rev, s1.Rev, rev, err)
+	}
+	if _, err := s3.LastModified("nothing"); !IsErrNoEnt(err) {
+		t.Errorf("expected ErrNoEnt, got %v", err)
+	}
+}
+
+func TestSnapshotCheckHistory(t *testing.T) {
+	s, err := DialUri("mem:?history=1", "/snapshot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := s
+	for i := 0; i < 3; i++ {
+		if s, err = s.set("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.CheckHistory(); err != nil {
+		t.Errorf("expected history at the latest revision, got %v", err)
+	}
+	if err = old.CheckHistory(); !IsErrRevTooOld(err) {
+		t.Errorf("expected ErrRevTooOld, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A Filter selects the events delivered by Subscribe. Fields
+// left empty match any value. Events which can't be attributed
+// to the requested app, proctype or service, such as instance
+// unregistrations, are not delivered to filters setting them.
+type Filter struct {
+	Types    []EventType
+	App      string
+	Proctype string
+	Service  string
+}
+
+// eventTypes is the list of event types known to Subscribe.
+var eventTypes = []EventType{
+	EvAppReg, EvAppUnreg, EvAppEnvSet, EvAppEnvDel, EvAppHead,
+	EvRevReg, EvRevUnreg, EvRevArchive,
+	EvProcReg, EvProcUnreg, EvProcScale,
+	EvInsReg, EvInsUnreg, EvInsStart, EvInsFail, EvInsExit, EvInsLost, EvInsClaim, EvInsStop,
+	EvSrvReg, EvSrvUnreg,
+	EvEpReg, EvEpUnreg,
+	EvPmReg, EvPmUnreg,
+	EvProxyReg, EvProxyUnreg,
+}
+
+// Subscribe watches for changes to the registry matching the
+// given filter and sends them as *Event objects to the provided
+// channel. The coordinator is only watched below the paths which
+// can produce matching events. Events are sent in revision order,
+// so that the revision of the last event received is a safe point
+// to resume from.
+func Subscribe(s Snapshot, f Filter, listener chan *Event) error {
+	return watchEvent(context.Background(), s, f.Glob(), listener, f.Match)
+}
+
+// SubscribeContext is like Subscribe, but returns ctx.Err()
+// once ctx is done. The listener channel is closed on return.
+func SubscribeContext(ctx context.Context, s Snapshot, f Filter, listener chan *Event) error {
+	defer close(listener)
+	return watchEvent(ctx, s, f.Glob(), listener, f.Match)
+}
+
+// Match returns true if the event is selected by the filter.
+func (f Filter) Match(e *Event) bool {
+	if e.Type == EvUnknown || !f.matchType(e.Type) {
+		return false
+	}
+
+	ins, _ := e.Source.(*Instance)
+
+	if f.App != "" {
+		if e.Path.App != nil {
+			if *e.Path.App != f.App {
+				return false
+			}
+		} else if ins == nil || ins.AppName != f.App {
+			return false
+		}
+	}
+	if f.Proctype != "" {
+		if e.Path.Proctype != nil {
+			if *e.Path.Proctype != f.Proctype {
+				return false
+			}
+		} else if ins == nil || ins.ProcessName != f.Proctype {
+			return false
+		}
+	}
+	if f.Service != "" {
+		if e.Path.Service == nil || *e.Path.Service != f.Service {
+			return false
+		}
+	}
+	return true
+}
+
+// Glob returns the narrowest coordinator glob matching the
+// paths of all events selected by the filter. The coordinator
+// only orders the events of a single glob, so filters whose events
+// come from different top-level directories, such as app filters
+// which also select instance events, watch the whole registry.
+func (f Filter) Glob() string {
+	var glob string
+
+	for _, t := range eventTypes {
+		if !f.matchType(t) {
+			continue
+		}
+		for _, g := range f.typeGlobs(t) {
+			if glob == "" {
+				glob = g
+			} else {
+				glob = mergeGlobs(glob, g)
+			}
+		}
+	}
+	if glob == "" {
+		// Nothing can match, but a glob is still needed to wait on.
+		return "/" + doozerGlobPlural
+	}
+	return glob
+}
+
+func (f Filter) String() string {
+	return fmt.Sprintf("Filter{types: %v, app: %s, proc: %s, service: %s}", f.Types, f.App, f.Proctype, f.Service)
+}
+
+func (f Filter) matchType(t EventType) bool {
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, ft := range f.Types {
+		if ft == t {
+			return true
+		}
+	}
+	return false
+}
+
+// typeGlobs returns the globs of the paths which can
+// produce events of the given type matching the filter.
+func (f Filter) typeGlobs(t EventType) []string {
+	app := globOrAny(f.App)
+	proc := globOrAny(f.Proctype)
+	srv := globOrAny(f.Service)
+
+	hasApp := f.App != "" || f.Proctype != ""
+	appOnly := f.Service == "" && f.Proctype == ""
+
+	switch t {
+	case EvAppReg, EvAppUnreg:
+		if appOnly {
+			return []string{path.Join("/", appsPath, app, "registered")}
+		}
+	case EvAppEnvSet, EvAppEnvDel:
+		if appOnly {
+			return []string{path.Join("/", appsPath, app, "env", "*")}
+		}
+	case EvAppHead:
+		if appOnly {
+			return []string{path.Join("/", appsPath, app, "head")}
+		}
+	case EvRevReg, EvRevUnreg:
+		if appOnly {
+			return []string{path.Join("/", appsPath, app, revsPath, "*", "registered")}
+		}
+	case EvRevArchive:
+		if appOnly {
+			return []string{path.Join("/", appsPath, app, revsPath, "*", "archive-url")}
+		}
+	case EvProcReg, EvProcUnreg:
+		if f.Service == "" {
+			return []string{path.Join("/", appsPath, app, procsPath, proc, "registered")}
+		}
+	case EvProcScale:
+		if f.Service == "" {
+			return []string{path.Join("/", appsPath, app, procsPath, proc, desiredScalePath, "*")}
+		}
+	case EvInsReg, EvInsUnreg:
+		if f.Service == "" {
+			return []string{path.Join("/", instancesPath, "*", "object")}
+		}
+	case EvInsStart:
+		if f.Service == "" {
+			return []string{
+				path.Join("/", instancesPath, "*", startPath),
+				path.Join("/", instancesPath, "*", statusPath),
+			}
+		}
+	case EvInsFail, EvInsExit, EvInsLost:
+		if f.Service == "" {
+			return []string{path.Join("/", instancesPath, "*", statusPath)}
+		}
+	case EvInsClaim:
+		if f.Service == "" {
+			return []string{path.Join("/", instancesPath, "*", claimsPath, "*")}
+		}
+	case EvInsStop:
+		if f.Service == "" {
+			return []string{path.Join("/", instancesPath, "*", stopPath)}
+		}
+	case EvSrvReg, EvSrvUnreg:
+		if !hasApp {
+			return []string{path.Join("/", servicesPath, srv, "registered")}
+		}
+	case EvEpReg, EvEpUnreg:
+		if !hasApp {
+			return []string{path.Join("/", servicesPath, srv, endpointsPath, "*")}
+		}
+	case EvPmReg, EvPmUnreg:
+		if !hasApp && f.Service == "" {
+			return []string{path.Join(pmDir, "*")}
+		}
+	case EvProxyReg, EvProxyUnreg:
+		if !hasApp && f.Service == "" {
+			return []string{path.Join(proxyDir, "*")}
+		}
+	}
+	return nil
+}
+
+func globOrAny(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return name
+}
+
+// mergeGlobs returns a glob matching all paths matched by a or b,
+// by replacing differing path components with '*', or the remaining
+// path with '**' if the globs don't have the same depth.
+func mergeGlobs(a, b string) string {
+	ac := strings.Split(strings.TrimPrefix(a, "/"), "/")
+	bc := strings.Split(strings.TrimPrefix(b, "/"), "/")
+	merged := []string{}
+
+	for i := 0; i < len(ac) || i < len(bc); i++ {
+		if i == len(ac) || i == len(bc) || ac[i] == doozerGlobPlural || bc[i] == doozerGlobPlural {
+			merged = append(merged, doozerGlobPlural)
+			break
+		}
+		if ac[i] == bc[i] {
+			merged = append(merged, ac[i])
+		} else if len(ac) == len(bc) {
+			merged = append(merged, "*")
+		} else {
+			merged = append(merged, doozerGlobPlural)
+			break
+		}
+	}
+	return "/" + strings.Join(merged, "/")
+}
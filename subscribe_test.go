@@ -0,0 +1,110 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilterGlob(t *testing.T) {
+	globs := map[string]Filter{
+		"/**":                          {},
+		"/apps/cat/registered":         {Types: []EventType{EvAppReg}, App: "cat"},
+		"/apps/cat/**":                 {Types: []EventType{EvAppReg, EvRevReg}, App: "cat"},
+		"/apps/*/procs/web/registered": {Types: []EventType{EvProcReg}, Proctype: "web"},
+		"/instances/*/*":               {Types: []EventType{EvInsStart, EvInsReg}, App: "cat"},
+		"/instances/*/status":          {Types: []EventType{EvInsFail, EvInsExit}},
+		"/services/db/**":              {Service: "db"},
+		"/services/*/endpoints/*":      {Types: []EventType{EvEpReg, EvEpUnreg}},
+		"/apps/cat/revs/*/registered":  {Types: []EventType{EvRevReg, EvSrvReg}, App: "cat"},
+		"/apps/cat/head":               {Types: []EventType{EvAppHead}, App: "cat"},
+		"/apps/*/env/*":                {Types: []EventType{EvAppEnvSet, EvAppEnvDel}},
+		"/instances/*/claims/*":        {Types: []EventType{EvInsClaim}, Proctype: "web"},
+		"/*/*":                         {Types: []EventType{EvPmReg, EvProxyReg}},
+	}
+	for glob, f := range globs {
+		if g := f.Glob(); g != glob {
+			t.Errorf("expected glob %s for %s, got %s", glob, f, g)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s, err := DialUri("mem:", "/subscribe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev)
+	l := make(chan *Event)
+
+	go Subscribe(s, Filter{Types: []EventType{EvInsReg}, App: "subcat"}, l)
+
+	_, err = RegisterInstance("subdog", "128af9", "web", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance("subcat", "128af9", "web", s.FastForward(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := expectEvent(EvInsReg, ins, l, t)
+	if ev.Source.(*Instance).Id != ins.Id {
+		t.Errorf("expected event for %s, got %s", ins, ev.Source)
+	}
+}
+
+func TestSubscribeAppInOrder(t *testing.T) {
+	s, err := DialUri("mem:", "/subscribe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev)
+
+	app, err := NewApp("ordercat", "git://ordercat", "stack", s).Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins, err := RegisterInstance("ordercat", "128af9", "web", app.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = app.FastForward(ins.Dir.Snapshot.Rev).SetEnvironmentVar("KEY", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay the app and instance events written above
+	l := make(chan *Event, 10)
+	go Subscribe(s, Filter{App: "ordercat"}, l)
+
+	last := s.Rev
+	types := []EventType{}
+	for len(types) == 0 || types[len(types)-1] != EvAppEnvSet {
+		select {
+		case ev := <-l:
+			if ev.Rev <= last {
+				t.Errorf("expected an event after rev %d, got %s at %d", last, ev.Type, ev.Rev)
+			}
+			last = ev.Rev
+			if ev.Type == EvAppReg || ev.Type == EvInsReg || ev.Type == EvAppEnvSet {
+				types = append(types, ev.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s, got %v", EvAppEnvSet, types)
+		}
+	}
+	if len(types) != 3 || types[0] != EvAppReg || types[1] != EvInsReg {
+		t.Errorf("expected app, instance and env events in order, got %v", types)
+	}
+}
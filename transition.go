@@ -0,0 +1,139 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const historyPath = "history"
+
+// insTransitions lists the statuses an instance can go to from each
+// status. An instance is claimed by a process manager, which either
+// starts it or gives it up again. Running instances are stopped before
+// they exit. Instances can fail or get lost once claimed. Pending
+// instances can be stopped too, so that they are never claimed.
+// Failed, exited and lost instances don't change anymore.
+var insTransitions = map[InsStatus][]InsStatus{
+	InsStatusPending:  {InsStatusClaimed, InsStatusStopping},
+	InsStatusClaimed:  {InsStatusPending, InsStatusRunning, InsStatusStopping, InsStatusFailed, InsStatusLost},
+	InsStatusRunning:  {InsStatusStopping, InsStatusFailed, InsStatusLost},
+	InsStatusStopping: {InsStatusExited, InsStatusFailed, InsStatusLost},
+}
+
+// CanTransition tells whether an instance with status s can go to
+// status to.
+func (s InsStatus) CanTransition(to InsStatus) bool {
+	for _, next := range insTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// An InsTransition is a change of the status of an instance, as
+// stored in its history.
+type InsTransition struct {
+	Time string
+	From InsStatus // Empty for the registration
+	To   InsStatus
+	Host string // Host which made the change, if any
+}
+
+// History returns the status changes of the instance, oldest first.
+// Instances registered before histories were kept have none.
+func (i *Instance) History() (history []*InsTransition, err error) {
+	val, _, err := i.Dir.get(historyPath)
+	if IsErrNoEnt(err) {
+		return []*InsTransition{}, nil
+	} else if err != nil {
+		return
+	}
+	return parseHistory(i.Id, val)
+}
+
+// lastTransition returns the time of the latest change of the instance
+// to status to, or the zero time if its history has none.
+func (i *Instance) lastTransition(to InsStatus) (t time.Time, err error) {
+	history, err := i.History()
+	if err != nil {
+		return
+	}
+	for j := len(history) - 1; j >= 0; j-- {
+		if history[j].To == to {
+			return time.Parse(time.RFC3339, history[j].Time)
+		}
+	}
+	return
+}
+
+func parseHistory(id int64, val string) (history []*InsTransition, err error) {
+	history = []*InsTransition{}
+
+	for _, line := range strings.Split(strings.TrimSpace(val), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid history of instance %d: %s", id, line)
+		}
+		t := &InsTransition{Time: fields[0], From: InsStatus(fields[1]), To: InsStatus(fields[2])}
+		if t.From == "-" {
+			t.From = ""
+		}
+		if len(fields) > 3 {
+			t.Host = fields[3]
+		}
+		history = append(history, t)
+	}
+	return
+}
+
+// transition adds the change of the instance to status to, made by
+// host, to t. It fails with ErrInvalidState if the instance can't go
+// to that status from the one it has at the revision of t. The write
+// to the history comes first, so that a txn based on an older revision
+// of the instance always fails with ErrRevMismatch.
+func (i *Instance) transition(t *txn, to InsStatus, host string) error {
+	//
+	//   instances/
+	//       6868/
+	//           ...
+	// -         history = 2012-07-19T16:28:00Z - pending
+	// +         history = 2012-07-19T16:28:00Z - pending
+	// +                   2012-07-19T16:41:05Z pending claimed 10.0.0.1
+	//
+	cur, err := GetInstance(t.Snapshot, i.Id)
+	if err != nil {
+		return err
+	}
+	if !cur.Status.CanTransition(to) {
+		return NewError(ErrInvalidState, fmt.Sprintf("instance %d can't go from %s to %s", i.Id, cur.Status, to))
+	}
+
+	history, _, err := t.get(i.Dir.prefix(historyPath))
+	if err != nil && !IsErrNoEnt(err) {
+		return err
+	}
+	t.set(i.Dir.prefix(historyPath), history+historyEntry(cur.Status, to, host))
+
+	return nil
+}
+
+func historyEntry(from, to InsStatus, host string) string {
+	if from == "" {
+		from = "-"
+	}
+	entry := fmt.Sprintf("%s %s %s", timestamp(), from, to)
+	if host != "" {
+		entry += " " + host
+	}
+	return entry + "\n"
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func transitionSetup() (ins *Instance) {
+	s, err := DialUri("mem:", "/transition-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	ins, err = RegisterInstance("statecat", "f00", "web", s.FastForward(rev))
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func expectInvalidState(t *testing.T, err error, from, to InsStatus) {
+	e, ok := err.(*Error)
+	if !ok || e.Err != ErrInvalidState {
+		t.Errorf("expected ErrInvalidState going from %s to %s, got %v", from, to, err)
+		return
+	}
+	if !strings.Contains(e.Error(), "from "+string(from)+" to "+string(to)) {
+		t.Errorf("expected error to name %s and %s, got %s", from, to, e)
+	}
+}
+
+func TestInsStatusCanTransition(t *testing.T) {
+	valid := [][2]InsStatus{
+		{InsStatusPending, InsStatusClaimed},
+		{InsStatusClaimed, InsStatusPending},
+		{InsStatusClaimed, InsStatusRunning},
+		{InsStatusRunning, InsStatusStopping},
+		{InsStatusStopping, InsStatusExited},
+		{InsStatusRunning, InsStatusFailed},
+		{InsStatusRunning, InsStatusLost},
+	}
+	for _, tr := range valid {
+		if !tr[0].CanTransition(tr[1]) {
+			t.Errorf("expected %s -> %s to be valid", tr[0], tr[1])
+		}
+	}
+	invalid := [][2]InsStatus{
+		{InsStatusPending, InsStatusRunning},
+		{InsStatusPending, InsStatusExited},
+		{InsStatusRunning, InsStatusExited},
+		{InsStatusRunning, InsStatusPending},
+		{InsStatusFailed, InsStatusRunning},
+		{InsStatusExited, InsStatusStopping},
+		{InsStatusLost, InsStatusRunning},
+	}
+	for _, tr := range invalid {
+		if tr[0].CanTransition(tr[1]) {
+			t.Errorf("expected %s -> %s to be invalid", tr[0], tr[1])
+		}
+	}
+}
+
+func TestInstanceInvalidTransitions(t *testing.T) {
+	ip := "10.0.0.1"
+	ins := transitionSetup()
+
+	ins, err := ins.Claim(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Exited(ip)
+	expectInvalidState(t, err, InsStatusClaimed, InsStatusExited)
+
+	ins, err = ins.Started(ip, 9000, "box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Unclaim(ip)
+	expectInvalidState(t, err, InsStatusRunning, InsStatusPending)
+
+	ins, err = ins.Failed(ip, errors.New("crash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.Started(ip, 9001, "box")
+	expectInvalidState(t, err, InsStatusFailed, InsStatusRunning)
+
+	_, err = StopInstance(ins.Id, ins.Dir.Snapshot)
+	expectInvalidState(t, err, InsStatusFailed, InsStatusStopping)
+
+	testInstanceStatus(t, ins.Id, InsStatusFailed, ins.Dir.Snapshot.FastForward(-1))
+}
+
+func TestInstanceStoppedBeforeClaim(t *testing.T) {
+	ins := transitionSetup()
+
+	s, err := StopInstance(ins.Id, ins.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testInstanceStatus(t, ins.Id, InsStatusStopping, s)
+
+	_, err = ins.FastForward(s.Rev).Claim("10.0.0.1")
+	expectInvalidState(t, err, InsStatusStopping, InsStatusClaimed)
+}
+
+func TestInstanceHistory(t *testing.T) {
+	ins := transitionSetup()
+
+	// The protocol of doc/bazooka-instance-scaling.md
+	ins, err := ins.Claim("10.0.1.24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Unclaim("10.0.1.24"); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Claim("10.0.1.15"); err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.Started("10.0.1.15", 9090, "instance.local"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := StopInstance(ins.Id, ins.Dir.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins, err = ins.FastForward(s.Rev).Exited("10.0.1.15"); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := ins.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []InsTransition{
+		{From: "", To: InsStatusPending},
+		{From: InsStatusPending, To: InsStatusClaimed, Host: "10.0.1.24"},
+		{From: InsStatusClaimed, To: InsStatusPending, Host: "10.0.1.24"},
+		{From: InsStatusPending, To: InsStatusClaimed, Host: "10.0.1.15"},
+		{From: InsStatusClaimed, To: InsStatusRunning, Host: "10.0.1.15"},
+		{From: InsStatusRunning, To: InsStatusStopping},
+		{From: InsStatusStopping, To: InsStatusExited, Host: "10.0.1.15"},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("expected %d transitions, got %d", len(expected), len(history))
+	}
+	for i, tr := range history {
+		e := expected[i]
+		if tr.From != e.From || tr.To != e.To || tr.Host != e.Host || tr.Time == "" {
+			t.Errorf("expected transition %d to be %v, got %v", i, e, *tr)
+		}
+	}
+}
+
+func TestInstanceTransitionConflict(t *testing.T) {
+	ins := transitionSetup()
+
+	claimed, err := ins.Claim("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = claimed.Unclaim("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Started on the instance as claimed before the unclaim
+	_, err = claimed.Started("10.0.0.1", 9000, "box")
+	if !IsErrRevMismatch(err) {
+		t.Errorf("expected ErrRevMismatch, got %v", err)
+	}
+}
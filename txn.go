@@ -0,0 +1,141 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"fmt"
+)
+
+// A txn batches writes to several files, so that they are applied
+// together or not at all. All writes are checked against the
+// revision of the snapshot the txn was created at: if any of the
+// files was changed since, commit fails with ErrRevMismatch. When
+// a write fails, the writes applied before it are rolled back by
+// restoring the previous bodies of their files.
+//
+// The coordinator can't apply several writes atomically, so a
+// process dying during commit leaves the files half-written. Such
+// objects are found and fixed by Repair.
+type txn struct {
+	Snapshot
+	ops []*txnOp
+	err error
+}
+
+type txnOp struct {
+	path  string
+	value []byte
+	del   bool
+
+	// State of the file before the write, used for rollback.
+	prev    []byte
+	existed bool
+	// Revision after the write.
+	rev int64
+}
+
+// txn starts a transaction at the snapshot's revision. A
+// transaction must not write the same file more than once.
+func (s Snapshot) txn() *txn {
+	return &txn{Snapshot: s}
+}
+
+// set adds a write of val to path.
+func (t *txn) set(path string, val string) {
+	t.setBytes(path, []byte(val))
+}
+
+func (t *txn) setBytes(path string, val []byte) {
+	t.ops = append(t.ops, &txnOp{path: path, value: val})
+}
+
+// setFile adds a write of value to path, encoded with codec.
+func (t *txn) setFile(path string, value interface{}, codec codec) {
+	val, err := codec.Encode(value)
+	if err != nil {
+		if t.err == nil {
+			t.err = err
+		}
+		return
+	}
+	t.setBytes(path, val)
+}
+
+// del adds a deletion of the file at path. Deleting a missing
+// file is not an error.
+func (t *txn) del(path string) {
+	t.ops = append(t.ops, &txnOp{path: path, del: true})
+}
+
+// commit applies the writes in the order they were added and returns
+// the revision of the last one applied, deletions included. If a write fails, the preceding ones
+// are rolled back and its error is returned. If the rollback fails as
+// well, the returned error is an ErrIncomplete.
+func (t *txn) commit() (rev int64, err error) {
+	if t.err != nil {
+		return t.Rev, t.err
+	}
+	rev = t.Rev
+
+	for i, op := range t.ops {
+		if err = t.apply(op); err != nil {
+			if rerr := t.rollback(t.ops[:i]); rerr != nil {
+				err = NewError(ErrIncomplete, fmt.Sprintf("%s: %s, rollback failed: %s", ErrIncomplete.Error(), err, rerr))
+			}
+			return t.Rev, err
+		}
+		if op.rev > rev {
+			rev = op.rev
+		}
+	}
+	return
+}
+
+func (t *txn) apply(op *txnOp) (err error) {
+	prev, filerev, err := t.conn.Get(op.path, &t.Rev)
+	if err != nil && !IsErrNoEnt(err) {
+		return
+	}
+	op.prev, op.existed = prev, filerev > 0
+
+	if op.del {
+		if !op.existed {
+			return nil
+		}
+		if err = t.conn.Del(op.path, t.Rev); err != nil {
+			return
+		}
+		// Deletions don't return their revision, which is at most the latest
+		op.rev, err = t.conn.Rev()
+		return
+	}
+	op.rev, err = t.conn.Set(op.path, t.Rev, op.value)
+	return
+}
+
+// rollback undoes the given, applied, writes in reverse order. Files
+// changed by someone else since are left alone.
+func (t *txn) rollback(ops []*txnOp) (err error) {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+
+		var e error
+		switch {
+		case op.del && op.existed:
+			_, e = t.conn.Set(op.path, t.Rev, op.prev)
+		case op.del:
+			// Nothing was deleted
+		case op.existed:
+			_, e = t.conn.Set(op.path, op.rev, op.prev)
+		default:
+			e = t.conn.Del(op.path, op.rev)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2012, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/soundcloud/visor
+
+package visor
+
+import (
+	"testing"
+)
+
+func txnSetup() (s Snapshot) {
+	s, err := DialUri("mem:", "/txn-test")
+	if err != nil {
+		panic(err)
+	}
+	rev, err := Init(s)
+	if err != nil {
+		panic(err)
+	}
+	return s.FastForward(rev)
+}
+
+func TestTxnCommit(t *testing.T) {
+	s := txnSetup()
+
+	s, err := s.set("/txn/old", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := s.txn()
+	tx.set("/txn/a", "a")
+	tx.setFile("/txn/b", []string{"b", "c"}, new(listCodec))
+	tx.del("/txn/old")
+	tx.del("/txn/missing")
+
+	rev, err := tx.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = s.FastForward(rev)
+
+	if rev <= tx.Rev {
+		t.Errorf("expected commit rev to be after %d, got %d", tx.Rev, rev)
+	}
+	for p, expected := range map[string]string{"/txn/a": "a", "/txn/b": "b c"} {
+		if v, _, err := s.get(p); err != nil || v != expected {
+			t.Errorf("expected %s to be '%s', got '%s' (%v)", p, expected, v, err)
+		}
+	}
+	if exists, _, _ := s.exists("/txn/old"); exists {
+		t.Error("expected /txn/old to be deleted")
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	s := txnSetup()
+
+	s, err := s.set("/txn/a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = s.set("/txn/d", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := s.txn()
+	tx.set("/txn/a", "2")
+	tx.set("/txn/b", "2")
+	tx.del("/txn/d")
+	tx.set("/txn/c", "2")
+
+	// Change c after the txn was started
+	if _, err = s.set("/txn/c", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tx.commit()
+	if err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	if e, ok := err.(*Error); !ok || e.Err != ErrRevMismatch {
+		t.Errorf("expected ErrRevMismatch, got %v", err)
+	}
+	s = s.FastForward(-1)
+
+	for p, expected := range map[string]string{"/txn/a": "1", "/txn/c": "x", "/txn/d": "1"} {
+		if v, _, err := s.get(p); err != nil || v != expected {
+			t.Errorf("expected %s to be rolled back to '%s', got '%s' (%v)", p, expected, v, err)
+		}
+	}
+	if exists, _, _ := s.exists("/txn/b"); exists {
+		t.Error("expected /txn/b to be removed on rollback")
+	}
+}
+
+func TestAppRegisterConflictRollback(t *testing.T) {
+	s := txnSetup()
+
+	app := NewApp("txncat", "git://txncat", "s1", s)
+	app.Env["MEOW"] = "1"
+
+	// Someone else registers the app concurrently
+	if _, err := s.set(app.Dir.prefix("registered"), timestamp()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Register(); err == nil {
+		t.Fatal("expected registration to fail")
+	}
+	s = s.FastForward(-1)
+
+	for _, p := range []string{"attrs", "env/MEOW"} {
+		if exists, _, _ := s.exists(app.Dir.prefix(p)); exists {
+			t.Errorf("expected %s to be rolled back", p)
+		}
+	}
+}
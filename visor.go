@@ -40,7 +40,7 @@ import (
 	"time"
 )
 
-const SchemaVersion = 2
+const SchemaVersion = 3
 
 const (
 	DefaultUri   string = "doozer:?ca=localhost:8046"
@@ -56,6 +56,9 @@ const (
 // Set *automatically* at link time (see Makefile)
 var Version string
 
+// Init prepares the coordinator for use by visor. A coordinator without
+// a schema version is initialized with the current SchemaVersion, while
+// coordinators with an older schema are migrated (see Migrate).
 func Init(s Snapshot) (rev int64, err error) {
 	exists, _, err := s.conn.Exists(nextPortPath)
 	if err != nil {
@@ -69,7 +72,14 @@ func Init(s Snapshot) (rev int64, err error) {
 		}
 	}
 
-	s, err = SetSchemaVersion(s, SchemaVersion)
+	version, err := getSchemaVersion(s)
+	if IsErrNoEnt(err) {
+		s, err = SetSchemaVersion(s, SchemaVersion)
+	} else if err == nil && version < SchemaVersion {
+		s, _, err = Migrate(s, false)
+	} else if err == nil && version > SchemaVersion {
+		err = ErrSchemaMism
+	}
 	if err != nil {
 		return
 	}
@@ -98,6 +108,9 @@ func ClaimNextPort(s Snapshot) (port int, err error) {
 	return
 }
 
+// Scale sets the desired scale of app:processName@revision to factor,
+// and registers or stops instances until that many are live. It returns
+// the instances registered, and the number of live instances before.
 func Scale(app string, revision string, processName string, factor int, s Snapshot) (tickets []*Instance, current int, err error) {
 	if factor < 0 {
 		return nil, -1, errors.New("scaling factor needs to be a positive integer")
@@ -112,7 +125,21 @@ func Scale(app string, revision string, processName string, factor int, s Snapsh
 		return nil, -1, fmt.Errorf("proc '%s' doesn't exist", processName)
 	}
 
-	list, err := getInstanceIds(s, app, revision, processName)
+	s, err = s.SetDesiredScale(app, revision, processName, factor)
+	if err != nil {
+		return nil, -1, err
+	}
+	return reconcileScale(s, app, revision, processName)
+}
+
+// reconcileScale registers or stops instances of app:pty@rev until
+// the number of live instances matches its desired scale.
+func reconcileScale(s Snapshot, app, rev, pty string) (tickets []*Instance, current int, err error) {
+	factor, _, err := s.GetDesiredScale(app, rev, pty)
+	if err != nil {
+		return nil, -1, err
+	}
+	list, err := liveInstanceIds(s, app, rev, pty)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -125,7 +152,7 @@ func Scale(app string, revision string, processName string, factor int, s Snapsh
 		for i := 0; i < ntickets; i++ {
 			var ticket *Instance
 
-			ticket, err = RegisterInstance(app, revision, processName, s)
+			ticket, err = RegisterInstance(app, rev, pty, s)
 			if err != nil {
 				return
 			}
@@ -139,13 +166,32 @@ func Scale(app string, revision string, processName string, factor int, s Snapsh
 		for i := 0; i < stops; i++ {
 			s, err = StopInstance(list[i], s)
 			if err != nil {
-				panic(err)
+				return
 			}
 		}
 	}
 	return
 }
 
+// liveInstanceIds returns the ids of the instances of app:pty@rev
+// which aren't being stopped.
+func liveInstanceIds(s Snapshot, app, rev, pty string) (ids []int64, err error) {
+	all, err := getInstanceIds(s, app, rev, pty)
+	if err != nil {
+		return
+	}
+	for _, id := range all {
+		exists, _, err := s.conn.Exists(path.Join(instancePath(id), stopPath))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
 func timestamp() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
@@ -6,11 +6,22 @@
 package visor
 
 import (
+	"flag"
 	"testing"
 )
 
+// testAddr is the coordinator the tests run against. It defaults to an
+// in-memory store shared by all tests, so that no doozerd is needed.
+// Run "go test -coordinator localhost:8046" to test against doozerd.
+var testAddr = flag.String("coordinator", "mem:visor-test", "address or uri of the coordinator to test against")
+
+// testDial connects to the test coordinator with the given root.
+func testDial(root string) (Snapshot, error) {
+	return Dial(*testAddr, root)
+}
+
 func visorSetup(root string) (s Snapshot) {
-	s, err := Dial(DefaultAddr, root)
+	s, err := testDial(root)
 	if err != nil {
 		panic(err)
 	}
@@ -26,8 +37,8 @@ func visorSetup(root string) (s Snapshot) {
 	return
 }
 
-func TestDialWithDefaultAddrAndRoot(t *testing.T) {
-	_, err := Dial(DefaultAddr, DefaultRoot)
+func TestDialWithDefaultRoot(t *testing.T) {
+	_, err := testDial(DefaultRoot)
 	if err != nil {
 		t.Error(err)
 	}
@@ -132,7 +143,7 @@ func TestScale(t *testing.T) {
 }
 
 func TestGetuid(t *testing.T) {
-	s, err := Dial(DefaultAddr, "/scale-test")
+	s, err := testDial("/scale-test")
 	if err != nil {
 		panic(err)
 	}